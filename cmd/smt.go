@@ -5,19 +5,27 @@ import (
 	"os"
 
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/command"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/events"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
 )
 
 func rootUsage() {
-	utils.PrintErrln("smt <command> <options>")
+	utils.PrintErrln("smt [-output text|jsonl] <command> <options>")
+	utils.PrintErrln("")
+	utils.PrintErrln("    Global options:")
+	utils.PrintErrf("        -output	Output format: text (default), or jsonl to write deploy progress to stdout as JSON lines\n")
 	utils.PrintErrln("")
 	utils.PrintErrln("    Commands:")
 	utils.PrintErrf("        new		Create a new project from a template\n")
 	utils.PrintErrf("        deploy		Deploy an existing project to a remote server\n")
+	utils.PrintErrf("        project	Check an existing project\n")
 	utils.PrintErrf("        config		Configure connections to remote servers\n")
 	utils.PrintErrf("        secrets	Manage secrets for an existing project\n")
+	utils.PrintErrf("        env		Manage env values for an existing project\n")
 	utils.PrintErrf("        install	Install this executable on a remote server\n")
 	utils.PrintErrf("        service	View and manage deployed services\n")
+	utils.PrintErrf("        backup		Back up the data of a deployed service\n")
+	utils.PrintErrf("        restore	Restore the data of a deployed service from a backup\n")
 	utils.PrintErrln("")
 }
 
@@ -31,6 +39,26 @@ func Run(args []string) int {
 		rootUsage()
 		return 0
 	}
+
+	// Global options precede the command; flag parsing stops at the command name
+	fs := flag.NewFlagSet("smt", flag.ContinueOnError)
+	fs.SetOutput(&command.EmptyWriter{})
+	outputParam := fs.String("output", events.OutputText, "Output format")
+	if err := fs.Parse(args[1:]); err != nil {
+		utils.PrintErrf("error: %v\n\n", err)
+		rootUsage()
+		return 1
+	}
+	if err := events.SetOutput(*outputParam); err != nil {
+		utils.PrintErrf("error: %v\n", err)
+		return 1
+	}
+	if fs.NArg() == 0 {
+		rootUsage()
+		return 1
+	}
+	args = append(args[:1], fs.Args()...)
+
 	cmdStr := args[1]
 	var spec command.CommandSpec
 	switch cmdStr {
@@ -38,14 +66,22 @@ func Run(args []string) int {
 		spec = &command.NewCommandSpec{Args: args[2:]}
 	case "deploy":
 		spec = &command.DeployCommandSpec{Args: args[2:]}
+	case "project":
+		spec = &command.ProjectCommandSpec{Args: args[2:]}
 	case "config":
 		spec = &command.ConfigCommandSpec{Args: args[2:]}
 	case "secrets":
 		spec = &command.SecretsCommandSpec{Args: args[2:]}
+	case "env":
+		spec = &command.EnvCommandSpec{Args: args[2:]}
 	case "install":
 		spec = &command.InstallCommandSpec{Args: args[2:]}
 	case "service":
 		spec = &command.ServiceCommandSpec{Args: args[2:]}
+	case "backup":
+		spec = &command.BackupCommandSpec{Args: args[2:]}
+	case "restore":
+		spec = &command.RestoreCommandSpec{Args: args[2:]}
 	default:
 		utils.PrintErrf("error: unrecognized command %s\n\n", cmdStr)
 		rootUsage()
@@ -0,0 +1,455 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/service"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	ManifestFileName   string = "manifest.json"
+	DataArchiveName    string = "data.tar.gz"
+	VolumesDirName     string = "volumes"
+	SecretsArchiveName string = "secrets.tar.gz.enc"
+
+	// Optional registered commands that pause & resume the service for a backup without
+	// stopping it; the service is stopped & started if they are not registered
+	QuiesceCommandName string = "quiesce"
+	ResumeCommandName  string = "resume"
+
+	volumeHelperImage string = "alpine"
+	archiveTimeFormat string = "20060102T150405Z"
+	restoreDirPattern string = ".smt-restore.XXXXXX"
+)
+
+var validateVolumePattern *regexp.Regexp = regexp.MustCompile("^[a-zA-Z\\-_0-9]+$")
+
+// Describes the contents of a backup archive.
+type Manifest struct {
+	Service       string    `json:"service"`
+	Host          string    `json:"host"`
+	CreatedAt     time.Time `json:"created_at"`
+	DataDirs      []string  `json:"data_dirs"`
+	Volumes       []string  `json:"volumes"`
+	SecretsVolume string    `json:"secrets_volume,omitempty"`
+}
+
+// Checks that the archive's data directories stay within the service directory & that its
+// volume names are plain names, since both are used to build paths.
+func (m *Manifest) Validate() error {
+	for _, d := range m.DataDirs {
+		if !filepath.IsLocal(d) || filepath.Clean(d) == "." {
+			return fmt.Errorf("invalid data directory '%s' in backup manifest (must be a subdirectory of the service directory)", d)
+		}
+	}
+	volumes := m.Volumes
+	if m.SecretsVolume != "" {
+		volumes = append(slices.Clone(volumes), m.SecretsVolume)
+	}
+	for _, v := range volumes {
+		if !validateVolumePattern.MatchString(v) {
+			return fmt.Errorf("invalid volume name '%s' in backup manifest", v)
+		}
+	}
+	return nil
+}
+
+// A deployed service to back up or restore. Archives are streamed over client, while
+// other commands are run through the executor.
+type Service struct {
+	Name     string
+	Path     string
+	Commands map[string]string
+	Spec     *service.BackupSpec
+}
+
+// Gets the default file name of a new backup of the named service.
+func GetArchiveName(name string, t time.Time) string {
+	return fmt.Sprintf("%s-%s.tar", name, t.UTC().Format(archiveTimeFormat))
+}
+
+// Archives the service's data directories & volumes, along with its secrets volume
+// encrypted with passphrase if the spec names one, into a tar file at outPath. The service
+// is quiesced while its data is read.
+func Create(exec deploy.Executor, client *ssh.Client, s *Service, passphrase string, outPath string) (*Manifest, error) {
+	if s.Spec.SecretsVolume != "" && passphrase == "" {
+		return nil, fmt.Errorf("a passphrase is required to back up secrets volume %s", s.Spec.SecretsVolume)
+	}
+
+	dataDirs, err := existingDataDirs(exec, s)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{
+		Service:       s.Name,
+		Host:          exec.Name(),
+		CreatedAt:     time.Now().UTC(),
+		DataDirs:      dataDirs,
+		Volumes:       s.Spec.Volumes,
+		SecretsVolume: s.Spec.SecretsVolume,
+	}
+
+	stagingDir, err := os.MkdirTemp("", "smt-backup-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	resume, err := quiesce(exec, s)
+	if err != nil {
+		return nil, err
+	}
+	err = readService(client, s, manifest, stagingDir, passphrase)
+	if resumeErr := resume(); resumeErr != nil {
+		err = errors.Join(err, resumeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifestJson, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize backup manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(stagingDir, ManifestFileName), manifestJson, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+	if err := writeArchive(stagingDir, outPath); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Replaces the service's data directories, volumes & (if the archive has one) secrets
+// volume with the contents of the backup at archivePath. The service is quiesced while
+// its data is replaced. getPassphrase is only called if the backup includes secrets.
+func Restore(exec deploy.Executor, client *ssh.Client, s *Service, archivePath string, getPassphrase func() (string, error)) (*Manifest, error) {
+	stagingDir, err := os.MkdirTemp("", "smt-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if err := extractArchive(archivePath, stagingDir); err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Service != s.Name {
+		return nil, fmt.Errorf("backup %s is of service %s, not %s", archivePath, manifest.Service, s.Name)
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, fmt.Errorf("backup %s is invalid: %w", archivePath, err)
+	}
+
+	// Decrypt up front so that a wrong passphrase fails before the service is touched
+	var secrets []byte
+	if manifest.SecretsVolume != "" {
+		passphrase, err := getPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		encrypted, err := os.ReadFile(filepath.Join(stagingDir, SecretsArchiveName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secrets from backup: %w", err)
+		}
+		if secrets, err = Decrypt(encrypted, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	resume, err := quiesce(exec, s)
+	if err != nil {
+		return nil, err
+	}
+	err = writeService(exec, client, s, manifest, stagingDir, secrets)
+	if resumeErr := resume(); resumeErr != nil {
+		err = errors.Join(err, resumeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func existingDataDirs(exec deploy.Executor, s *Service) ([]string, error) {
+	dirs := []string{}
+	for _, d := range s.Spec.DataDirs {
+		path := filepath.Join(s.Path, d)
+		stdout, _, err := exec.ExecuteShell(fmt.Sprintf("(test -d %s && echo 'exists') || echo 'not-exists'", utils.ShellQuote(path)))
+		if err != nil {
+			return nil, fmt.Errorf("[%s] failed to check if data directory %s exists: %w", exec.Name(), path, err)
+		}
+		if strings.TrimSpace(stdout) != "exists" {
+			slog.Warn("data directory does not exist; skipping", "name", s.Name, "path", path)
+			continue
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// Pauses the service through its registered commands, returning a function that resumes it.
+func quiesce(exec deploy.Executor, s *Service) (func() error, error) {
+	pauseName, resumeName := QuiesceCommandName, ResumeCommandName
+	if _, prs := s.Commands[QuiesceCommandName]; !prs {
+		pauseName, resumeName = "stop", "start"
+	}
+	pauseCmd, pausePrs := s.Commands[pauseName]
+	resumeCmd, resumePrs := s.Commands[resumeName]
+	if !pausePrs || !resumePrs {
+		slog.Warn("service has no registered commands to quiesce it; reading data while it runs", "name", s.Name)
+		return func() error { return nil }, nil
+	}
+
+	slog.Info("quiescing service", "name", s.Name, "command", pauseName)
+	if _, stderr, err := exec.ExecuteShell(pauseCmd); err != nil {
+		return nil, fmt.Errorf("[%s] %s command exited with error (stderr: %s): %w", exec.Name(), pauseName, strings.TrimSpace(stderr), err)
+	}
+	return func() error {
+		slog.Info("resuming service", "name", s.Name, "command", resumeName)
+		if _, stderr, err := exec.ExecuteShell(resumeCmd); err != nil {
+			return fmt.Errorf("[%s] %s command exited with error (stderr: %s): %w", exec.Name(), resumeName, strings.TrimSpace(stderr), err)
+		}
+		return nil
+	}, nil
+}
+
+func readService(client *ssh.Client, s *Service, manifest *Manifest, stagingDir string, passphrase string) error {
+	if len(manifest.DataDirs) > 0 {
+		slog.Info("archiving data directories", "name", s.Name, "dirs", manifest.DataDirs)
+		quotedDirs := utils.Map(manifest.DataDirs, utils.ShellQuote)
+		cmd := fmt.Sprintf("tar -cz -C %s %s", utils.ShellQuote(s.Path), strings.Join(quotedDirs, " "))
+		if err := streamToFile(client, cmd, filepath.Join(stagingDir, DataArchiveName)); err != nil {
+			return err
+		}
+	}
+
+	if len(manifest.Volumes) > 0 {
+		if err := os.Mkdir(filepath.Join(stagingDir, VolumesDirName), 0700); err != nil {
+			return fmt.Errorf("failed to create staging directory: %w", err)
+		}
+	}
+	for _, v := range manifest.Volumes {
+		slog.Info("archiving volume", "name", s.Name, "volume", v)
+		if err := streamToFile(client, readVolumeCommand(v), filepath.Join(stagingDir, VolumesDirName, v+".tar.gz")); err != nil {
+			return err
+		}
+	}
+
+	if manifest.SecretsVolume != "" {
+		slog.Info("archiving secrets volume", "name", s.Name, "volume", manifest.SecretsVolume)
+		var secrets bytes.Buffer
+		if err := streamFrom(client, readVolumeCommand(manifest.SecretsVolume), &secrets); err != nil {
+			return err
+		}
+		encrypted, err := Encrypt(secrets.Bytes(), passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt secrets: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(stagingDir, SecretsArchiveName), encrypted, 0600); err != nil {
+			return fmt.Errorf("failed to write encrypted secrets: %w", err)
+		}
+	}
+	return nil
+}
+
+func writeService(exec deploy.Executor, client *ssh.Client, s *Service, manifest *Manifest, stagingDir string, secrets []byte) error {
+	if len(manifest.DataDirs) > 0 {
+		slog.Info("restoring data directories", "name", s.Name, "dirs", manifest.DataDirs)
+		if err := writeDataDirs(exec, client, s, manifest.DataDirs, filepath.Join(stagingDir, DataArchiveName)); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range manifest.Volumes {
+		slog.Info("restoring volume", "name", s.Name, "volume", v)
+		if err := streamFromFile(client, writeVolumeCommand(v), filepath.Join(stagingDir, VolumesDirName, v+".tar.gz")); err != nil {
+			return err
+		}
+	}
+
+	if manifest.SecretsVolume != "" {
+		slog.Info("restoring secrets volume", "name", s.Name, "volume", manifest.SecretsVolume)
+		if err := streamTo(client, writeVolumeCommand(manifest.SecretsVolume), bytes.NewReader(secrets)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extracts the data archive into a directory beside the data directories & only then swaps
+// them in, so that a failed extract leaves the current data in place.
+func writeDataDirs(exec deploy.Executor, client *ssh.Client, s *Service, dataDirs []string, archivePath string) error {
+	stdout, stderr, err := exec.ExecuteShell(fmt.Sprintf("mkdir -p %s && mktemp -d %s", utils.ShellQuote(s.Path), utils.ShellQuote(filepath.Join(s.Path, restoreDirPattern))))
+	if err != nil {
+		return fmt.Errorf("[%s] failed to create restore directory (stderr: %s): %w", exec.Name(), strings.TrimSpace(stderr), err)
+	}
+	restoreDir := strings.TrimSpace(stdout)
+	removeRestoreDir := func() error {
+		if _, stderr, err := exec.ExecuteShell(fmt.Sprintf("rm -rf %s", utils.ShellQuote(restoreDir))); err != nil {
+			return fmt.Errorf("[%s] failed to remove restore directory %s (stderr: %s): %w", exec.Name(), restoreDir, strings.TrimSpace(stderr), err)
+		}
+		return nil
+	}
+
+	if err := streamFromFile(client, fmt.Sprintf("tar -xz -C %s", utils.ShellQuote(restoreDir)), archivePath); err != nil {
+		return errors.Join(err, removeRestoreDir())
+	}
+
+	swaps := utils.Map(dataDirs, func(d string) string {
+		path := filepath.Join(s.Path, d)
+		return fmt.Sprintf("rm -rf %s && mkdir -p %s && mv %s %s",
+			utils.ShellQuote(path), utils.ShellQuote(filepath.Dir(path)), utils.ShellQuote(filepath.Join(restoreDir, d)), utils.ShellQuote(path))
+	})
+	if _, stderr, err := exec.ExecuteShell(strings.Join(swaps, " && ")); err != nil {
+		return errors.Join(fmt.Errorf("[%s] failed to replace data directories (stderr: %s): %w", exec.Name(), strings.TrimSpace(stderr), err), removeRestoreDir())
+	}
+	return removeRestoreDir()
+}
+
+func readVolumeCommand(volume string) string {
+	return fmt.Sprintf("docker run --rm -v %s:/volume:ro %s tar -cz -C /volume .", utils.ShellQuote(volume), volumeHelperImage)
+}
+
+// Empties (creating if needed) the volume & extracts the archive on stdin into it.
+func writeVolumeCommand(volume string) string {
+	return fmt.Sprintf("docker volume create %s > /dev/null && docker run --rm -i -v %s:/volume %s sh -c 'find /volume -mindepth 1 -delete && tar -xz -C /volume'",
+		utils.ShellQuote(volume), utils.ShellQuote(volume), volumeHelperImage)
+}
+
+func streamToFile(client *ssh.Client, cmd string, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+	return streamFrom(client, cmd, f)
+}
+
+func streamFromFile(client *ssh.Client, cmd string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	return streamTo(client, cmd, f)
+}
+
+// Runs cmd on the server as root, copying its stdout to w.
+func streamFrom(client *ssh.Client, cmd string, w io.Writer) error {
+	return runElevated(client, cmd, nil, w)
+}
+
+// Runs cmd on the server as root, with r as its stdin.
+func streamTo(client *ssh.Client, cmd string, r io.Reader) error {
+	return runElevated(client, cmd, r, io.Discard)
+}
+
+func runElevated(client *ssh.Client, cmd string, stdin io.Reader, stdout io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create ssh session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = &stderr
+	slog.Debug("streaming ssh command", "cmd", cmd)
+	if err := session.Run(fmt.Sprintf("sudo bash -c %s", utils.ShellQuote("set -o pipefail; "+cmd))); err != nil {
+		return fmt.Errorf("remote command failed (stderr: %s): %w", strings.TrimSpace(stderr.String()), err)
+	}
+	return nil
+}
+
+// Bundles the files under dir into a tar file at outPath.
+func writeArchive(dir string, outPath string) error {
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create backup archive %s: %w", outPath, err)
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		return fmt.Errorf("failed to write backup archive %s: %w", outPath, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write backup archive %s: %w", outPath, err)
+	}
+	return out.Close()
+}
+
+func extractArchive(archivePath string, dir string) error {
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup archive %s: %w", archivePath, err)
+	}
+	defer in.Close()
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read backup archive %s: %w", archivePath, err)
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("backup archive %s contains invalid path %s", archivePath, hdr.Name)
+		}
+		path := filepath.Join(dir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+		}
+	}
+}
+
+func readManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+	var manifest *Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,23 @@
+package backup
+
+import "testing"
+
+func TestManifestValidate(t *testing.T) {
+	valid := &Manifest{Service: "foo", DataDirs: []string{"data", "db/files"}, Volumes: []string{"foo-db"}, SecretsVolume: "foo-secrets"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected no error, got '%v'", err)
+	}
+
+	invalid := []*Manifest{
+		{Service: "foo", DataDirs: []string{"../bar"}},
+		{Service: "foo", DataDirs: []string{"/etc"}},
+		{Service: "foo", DataDirs: []string{"."}},
+		{Service: "foo", Volumes: []string{"../foo"}},
+		{Service: "foo", SecretsVolume: "foo secrets"},
+	}
+	for _, m := range invalid {
+		if err := m.Validate(); err == nil {
+			t.Errorf("expected manifest %+v to be invalid, got no error", m)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package backup
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	data := []byte("API_KEY=hunter2")
+	encrypted, err := Encrypt(data, "correct horse")
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if bytes.Contains(encrypted, data) {
+		t.Errorf("expected encrypted data not to contain plaintext")
+	}
+
+	decrypted, err := Decrypt(encrypted, "correct horse")
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("expected '%s', got '%s'", data, decrypted)
+	}
+
+	if _, err := Decrypt(encrypted, "battery staple"); err == nil {
+		t.Errorf("expected error decrypting with the wrong passphrase, got none")
+	}
+	if _, err := Decrypt(data, "correct horse"); err == nil {
+		t.Errorf("expected error decrypting unencrypted data, got none")
+	}
+}
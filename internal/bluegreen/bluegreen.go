@@ -0,0 +1,163 @@
+package bluegreen
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/content"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/health"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/nginx"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	UpstreamFileName string = "nginx-upstream.conf"
+)
+
+// A service deployed in blue/green mode.
+type Service struct {
+	Name        string
+	Path        string
+	Config      *project.BlueGreenConfig
+	HealthCheck *project.HealthCheck
+	Env         map[string]string
+}
+
+// Name of the compose project the given color of the service runs as.
+func GetComposeProject(name string, color string) string {
+	return fmt.Sprintf("%s-%s", name, color)
+}
+
+// The upstream that the service's generated nginx site proxies to.
+func GetUpstream(name string, servicePath string) *nginx.Upstream {
+	return &nginx.Upstream{
+		Name:        fmt.Sprintf("smt_%s", strings.ReplaceAll(name, "-", "_")),
+		IncludePath: filepath.Join(servicePath, UpstreamFileName),
+	}
+}
+
+func RenderUpstream(port int) string {
+	return fmt.Sprintf("server 127.0.0.1:%d;\n", port)
+}
+
+// Writes the upstream file pointing at the given color if the service does not have one
+// yet, so that its generated nginx site passes `nginx -t` before any color has started.
+func EnsureUpstream(exec deploy.Executor, s *Service, color string) error {
+	port, err := s.Config.Port(color, s.Env)
+	if err != nil {
+		return err
+	}
+	upstreamPath := GetUpstream(s.Name, s.Path).IncludePath
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("(test -e %s && echo 'exists') || echo 'not-exists'", utils.ShellQuote(upstreamPath)))
+	if err != nil {
+		return fmt.Errorf("[%s] failed to check for nginx upstream %s: %w", exec.Name(), upstreamPath, err)
+	}
+	if strings.TrimSpace(stdout) == "exists" {
+		return nil
+	}
+	if _, _, err := exec.ExecuteCommand("mkdir", "-p", s.Path); err != nil {
+		return fmt.Errorf("[%s] failed to create service directory %s: %w", exec.Name(), s.Path, err)
+	}
+	slog.Info("creating nginx upstream", "name", s.Name, "dst", exec.Name(), "color", color, "port", port)
+	return content.WriteRemote(exec, upstreamPath, RenderUpstream(port))
+}
+
+// Starts the color that replaces active, waits for it to become healthy & moves nginx
+// traffic to it, then stops active once its in-flight requests have drained. If the new
+// color does not become healthy, it is stopped & active keeps serving traffic. Returns the
+// new active color.
+func Switch(exec deploy.Executor, s *Service, active string, dryRun bool) (string, error) {
+	next := project.OtherColor(active)
+	port, err := s.Config.Port(next, s.Env)
+	if err != nil {
+		return active, err
+	}
+	if dryRun {
+		slog.Info("DRY RUN: switching colors", "name", s.Name, "dst", exec.Name(), "from", active, "to", next, "port", port)
+		return next, nil
+	}
+
+	slog.Info("starting color", "name", s.Name, "dst", exec.Name(), "color", next, "port", port)
+	if err := startColor(exec, s, next, port); err != nil {
+		stopFailedColor(exec, s, next)
+		return active, err
+	}
+
+	colorEnv := map[string]string{}
+	maps.Copy(colorEnv, s.Env)
+	colorEnv[project.ApiPortEnvName] = strconv.Itoa(port)
+	if err := health.WaitForHealthy(exec, s.Path, GetComposeProject(s.Name, next), s.HealthCheck, colorEnv); err != nil {
+		stopFailedColor(exec, s, next)
+		return active, err
+	}
+
+	if err := pointUpstream(exec, s, port); err != nil {
+		stopFailedColor(exec, s, next)
+		return active, err
+	}
+	slog.Info("moved traffic to color", "name", s.Name, "dst", exec.Name(), "color", next)
+
+	if active != "" {
+		slog.Info("draining color", "name", s.Name, "dst", exec.Name(), "color", active, "drain", s.Config.Drain())
+		time.Sleep(s.Config.Drain())
+		if err := StopColor(exec, s, active); err != nil {
+			slog.Warn("moved traffic but failed to stop old color", "name", s.Name, "dst", exec.Name(), "color", active, "err", err)
+		}
+	}
+	return next, nil
+}
+
+// Stops & removes the containers of the given color.
+func StopColor(exec deploy.Executor, s *Service, color string) error {
+	composeProject := GetComposeProject(s.Name, color)
+	cmd := fmt.Sprintf("docker compose -p %s -f docker-compose.yml down", utils.ShellQuote(composeProject))
+	if _, stderr, err := exec.ExecuteShellInDir(s.Path, cmd); err != nil {
+		return fmt.Errorf("[%s] failed to stop %s (stderr: %s): %w", exec.Name(), composeProject, strings.TrimSpace(stderr), err)
+	}
+	slog.Info("stopped color", "name", s.Name, "dst", exec.Name(), "color", color)
+	return nil
+}
+
+func startColor(exec deploy.Executor, s *Service, color string, port int) error {
+	composeProject := GetComposeProject(s.Name, color)
+	// Variables in the shell take precedence over the env file when compose interpolates
+	cmd := fmt.Sprintf("%s=%d docker compose -p %s -f docker-compose.yml --env-file %s up -d --force-recreate --remove-orphans",
+		project.ApiPortEnvName, port, utils.ShellQuote(composeProject), project.EnvFileName)
+	if _, stderr, err := exec.ExecuteShellInDir(s.Path, cmd); err != nil {
+		return fmt.Errorf("[%s] failed to start %s (stderr: %s): %w", exec.Name(), composeProject, strings.TrimSpace(stderr), err)
+	}
+	return nil
+}
+
+func stopFailedColor(exec deploy.Executor, s *Service, color string) {
+	if err := StopColor(exec, s, color); err != nil {
+		slog.Warn("failed to stop color that did not start", "name", s.Name, "dst", exec.Name(), "color", color, "err", err)
+	}
+}
+
+// Rewrites the upstream to the given port & reloads nginx, putting the previous upstream
+// back if nginx rejects the new one.
+func pointUpstream(exec deploy.Executor, s *Service, port int) error {
+	upstreamPath := GetUpstream(s.Name, s.Path).IncludePath
+	backupPath := upstreamPath + ".bak"
+	if _, _, err := exec.ExecuteShell(fmt.Sprintf("cp %s %s", utils.ShellQuote(upstreamPath), utils.ShellQuote(backupPath))); err != nil {
+		return fmt.Errorf("[%s] failed to back up nginx upstream %s: %w", exec.Name(), upstreamPath, err)
+	}
+	if err := content.WriteRemote(exec, upstreamPath, RenderUpstream(port)); err != nil {
+		return err
+	}
+	if _, stderr, err := exec.ExecuteShell(fmt.Sprintf("nginx -t && %s", nginx.ReloadCommand)); err != nil {
+		if _, _, restoreErr := exec.ExecuteShell(fmt.Sprintf("mv %s %s", utils.ShellQuote(backupPath), utils.ShellQuote(upstreamPath))); restoreErr != nil {
+			slog.Error("failed to restore nginx upstream", "dst", exec.Name(), "path", upstreamPath, "err", restoreErr)
+		}
+		return fmt.Errorf("[%s] failed to reload nginx with new upstream (stderr: %s): %w", exec.Name(), strings.TrimSpace(stderr), err)
+	}
+	return nil
+}
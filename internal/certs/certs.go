@@ -0,0 +1,170 @@
+package certs
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	LiveDir string = "/etc/letsencrypt/live"
+
+	certificateFileName string = "fullchain.pem"
+	certificateMarker   string = "== "
+	opensslExpiryFormat string = "Jan _2 15:04:05 2006 MST"
+)
+
+// A certificate installed on the server.
+type Certificate struct {
+	Name    string    `json:"name"`
+	Domains []string  `json:"domains"`
+	Expiry  time.Time `json:"expiry"`
+}
+
+// Issues certificates on the server.
+type Client interface {
+	Name() string
+	Issue(exec deploy.Executor, certName string, domains []string) error
+}
+
+func NewClient(cfg *project.AcmeConfig) (Client, error) {
+	switch cfg.GetClient() {
+	case project.AcmeClientCertbot:
+		email := ""
+		if cfg != nil {
+			email = cfg.Email
+		}
+		return &certbotClient{email: email}, nil
+	case project.AcmeClientCommand:
+		return &commandClient{command: cfg.Command}, nil
+	default:
+		return nil, fmt.Errorf("unsupported acme client: %s", cfg.GetClient())
+	}
+}
+
+type certbotClient struct {
+	email string
+}
+
+func (c *certbotClient) Name() string { return project.AcmeClientCertbot }
+
+func (c *certbotClient) Issue(exec deploy.Executor, certName string, domains []string) error {
+	args := []string{"certbot", "certonly", "--nginx", "--non-interactive", "--agree-tos", "--cert-name", utils.ShellQuote(certName)}
+	if c.email != "" {
+		args = append(args, "-m", utils.ShellQuote(c.email))
+	} else {
+		args = append(args, "--register-unsafely-without-email")
+	}
+	for _, d := range domains {
+		args = append(args, "-d", utils.ShellQuote(d))
+	}
+	if _, stderr, err := exec.ExecuteShell(strings.Join(args, " ")); err != nil {
+		return fmt.Errorf("[%s] certbot failed to issue certificate %s (stderr: %s): %w", exec.Name(), certName, strings.TrimSpace(stderr), err)
+	}
+	return nil
+}
+
+type commandClient struct {
+	command string
+}
+
+func (c *commandClient) Name() string { return project.AcmeClientCommand }
+
+func (c *commandClient) Issue(exec deploy.Executor, certName string, domains []string) error {
+	script := fmt.Sprintf("export SMT_CERT_NAME=%s\nexport SMT_DOMAINS=%s\n%s",
+		utils.ShellQuote(certName),
+		utils.ShellQuote(strings.Join(domains, " ")),
+		c.command)
+	if _, stderr, err := exec.ExecuteShell(script); err != nil {
+		return fmt.Errorf("[%s] acme command failed to issue certificate %s (stderr: %s): %w", exec.Name(), certName, strings.TrimSpace(stderr), err)
+	}
+	return nil
+}
+
+// Lists the certificates under /etc/letsencrypt/live on the server.
+func ListCertificates(exec deploy.Executor) ([]*Certificate, error) {
+	script := fmt.Sprintf(
+		"for d in %s/*/; do f=\"$d%s\"; test -f \"$f\" || continue; echo \"%s$(basename \"$d\")\"; openssl x509 -in \"$f\" -noout -enddate -ext subjectAltName; done; true",
+		LiveDir, certificateFileName, certificateMarker)
+	stdout, stderr, err := exec.ExecuteShell(script)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to list certificates in %s (stderr: %s): %w", exec.Name(), LiveDir, stderr, err)
+	}
+	return parseCertificates(stdout)
+}
+
+// Parses the output of the listing script in ListCertificates: for each certificate, a
+// marker line with its name followed by openssl's notAfter & subjectAltName output.
+func parseCertificates(output string) ([]*Certificate, error) {
+	certs := []*Certificate{}
+	var current *Certificate
+	for _, l := range strings.Split(output, "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, certificateMarker):
+			current = &Certificate{Name: strings.TrimPrefix(l, certificateMarker), Domains: []string{}}
+			certs = append(certs, current)
+		case current == nil || l == "":
+			continue
+		case strings.HasPrefix(l, "notAfter="):
+			expiry, err := time.Parse(opensslExpiryFormat, strings.TrimPrefix(l, "notAfter="))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse expiry of certificate %s: %w", current.Name, err)
+			}
+			current.Expiry = expiry
+		case strings.HasPrefix(l, "DNS:"):
+			for _, n := range strings.Split(l, ",") {
+				n = strings.TrimSpace(n)
+				if strings.HasPrefix(n, "DNS:") {
+					current.Domains = append(current.Domains, strings.TrimPrefix(n, "DNS:"))
+				}
+			}
+		}
+	}
+	return certs, nil
+}
+
+// Returns the domains not covered by the named certificate, or all of them if it does not exist.
+func MissingDomains(certs []*Certificate, certName string, domains []string) []string {
+	idx := slices.IndexFunc(certs, func(c *Certificate) bool { return c.Name == certName })
+	if idx < 0 {
+		return domains
+	}
+	return utils.Filter(domains, func(d string) bool { return !slices.Contains(certs[idx].Domains, d) })
+}
+
+// Issues the named certificate with the client if it does not exist or does not cover all
+// of the domains. Returns whether a certificate was issued.
+func EnsureCertificate(exec deploy.Executor, client Client, certName string, domains []string, dryRun bool) (bool, error) {
+	certs, err := ListCertificates(exec)
+	if err != nil {
+		return false, err
+	}
+	missing := MissingDomains(certs, certName, domains)
+	if len(missing) == 0 {
+		slog.Debug("certificate covers all domains", "cert", certName, "domains", domains)
+		return false, nil
+	}
+
+	if dryRun {
+		slog.Info("DRY RUN: issuing certificate", "cert", certName, "domains", domains, "missing", missing, "client", client.Name())
+		return true, nil
+	}
+
+	slog.Info("issuing certificate", "cert", certName, "domains", domains, "missing", missing, "client", client.Name(), "server", exec.Name())
+	if err := client.Issue(exec, certName, domains); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func GetCertificatePath(certName string) string {
+	return filepath.Join(LiveDir, certName, certificateFileName)
+}
@@ -0,0 +1,91 @@
+package certs
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+)
+
+const listOutput = `== foo.example.com
+notAfter=Mar  4 12:00:00 2027 GMT
+X509v3 Subject Alternative Name: 
+    DNS:foo.example.com, DNS:www.foo.example.com
+== bar.example.com
+notAfter=Dec 25 08:30:00 2026 GMT
+X509v3 Subject Alternative Name: 
+    DNS:bar.example.com
+`
+
+// Executor that answers the certificate listing with canned output
+type fakeExecutor struct {
+	output string
+}
+
+func (e *fakeExecutor) Name() string          { return "fake" }
+func (e *fakeExecutor) Yaml(depth int) string { return "" }
+func (e *fakeExecutor) ExecuteCommand(name string, args ...string) (string, string, error) {
+	return e.ExecuteShell(name + " " + strings.Join(args, " "))
+}
+func (e *fakeExecutor) ExecuteCommandInDir(workingDir string, name string, args ...string) (string, string, error) {
+	return e.ExecuteCommand(name, args...)
+}
+func (e *fakeExecutor) ExecuteShell(cmd string) (string, string, error) { return e.output, "", nil }
+func (e *fakeExecutor) ExecuteShellInDir(workingDir string, cmd string) (string, string, error) {
+	return e.ExecuteShell(cmd)
+}
+func (e *fakeExecutor) Close() {}
+
+// Client that records the certificates it was asked to issue
+type stubClient struct {
+	issued []string
+}
+
+func (c *stubClient) Name() string { return "stub" }
+func (c *stubClient) Issue(exec deploy.Executor, certName string, domains []string) error {
+	c.issued = append(c.issued, certName)
+	return nil
+}
+
+func TestParseCertificates(t *testing.T) {
+	certs, err := parseCertificates(listOutput)
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(certs))
+	}
+	if certs[0].Name != "foo.example.com" || !slices.Equal(certs[0].Domains, []string{"foo.example.com", "www.foo.example.com"}) {
+		t.Errorf("unexpected first certificate: %+v", certs[0])
+	}
+	expectedExpiry := time.Date(2027, time.March, 4, 12, 0, 0, 0, time.UTC)
+	if !certs[0].Expiry.Equal(expectedExpiry) {
+		t.Errorf("expected expiry %s, got %s", expectedExpiry, certs[0].Expiry)
+	}
+}
+
+func TestEnsureCertificate(t *testing.T) {
+	exec := &fakeExecutor{output: listOutput}
+	client := &stubClient{}
+
+	issued, err := EnsureCertificate(exec, client, "foo.example.com", []string{"foo.example.com"}, false)
+	if err != nil || issued {
+		t.Errorf("expected existing certificate to be kept, got issued=%v err=%v", issued, err)
+	}
+
+	issued, err = EnsureCertificate(exec, client, "bar.example.com", []string{"bar.example.com", "api.bar.example.com"}, false)
+	if err != nil || !issued {
+		t.Errorf("expected certificate missing a domain to be issued, got issued=%v err=%v", issued, err)
+	}
+
+	issued, err = EnsureCertificate(exec, client, "new.example.com", []string{"new.example.com"}, true)
+	if err != nil || !issued {
+		t.Errorf("expected dry run to report missing certificate, got issued=%v err=%v", issued, err)
+	}
+
+	if !slices.Equal(client.issued, []string{"bar.example.com"}) {
+		t.Errorf("expected only bar.example.com to be issued, got %v", client.issued)
+	}
+}
@@ -0,0 +1,333 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/go-utils/term"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/backup"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/install"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/lock"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/sshclient"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+
+	serverconfig "github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
+)
+
+const (
+	// Env variable holding the passphrase that encrypts secrets in backups, so that backups
+	// can be taken & restored without a prompt
+	BackupPassphraseEnvName string = "SMT_BACKUP_PASSPHRASE"
+)
+
+type BackupCommandSpec struct {
+	Args []string
+}
+
+type BackupCommand struct {
+	name           string
+	outPath        string
+	hostname       string
+	sshKeyFilePath string
+	sshUsername    string
+	breakLock      bool
+}
+
+type RestoreCommandSpec struct {
+	Args []string
+}
+
+type RestoreCommand struct {
+	name           string
+	archivePath    string
+	yes            bool
+	hostname       string
+	sshKeyFilePath string
+	sshUsername    string
+	breakLock      bool
+}
+
+func (s *BackupCommandSpec) Build() (Command, error) {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(&EmptyWriter{})
+
+	nameParam := fs.String(
+		"name",
+		"",
+		"Name of the service to back up",
+	)
+	pathParam := fs.String(
+		"path",
+		"",
+		"Path to the project whose environment is selected with -env. Defaults to current working directory.",
+	)
+	outParam := fs.String(
+		"out",
+		"",
+		"File to write the backup to, or directory to write it to under a timestamped name. Defaults to current working directory.",
+	)
+
+	serverConfigFlags := UseServerConfigFlags(fs)
+	envParam := UseEnvironmentFlag(fs)
+
+	breakLockParam := UseBreakLockFlag(fs)
+
+	debugParam := fs.Bool("debug", false, "Set log level to debug")
+
+	if err := fs.Parse(s.Args); err != nil {
+		if err != flag.ErrHelp {
+			utils.PrintErrf("error: %v\n", err)
+		}
+		fs.SetOutput(nil)
+		fs.Usage()
+		return nil, err
+	}
+
+	if *debugParam {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	} else {
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	}
+
+	name, err := ResolveServiceName(*nameParam, *envParam, *pathParam, serverConfigFlags)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("service name required")
+	}
+	if err := ValidateServerConfigFlags(serverConfigFlags); err != nil {
+		return nil, err
+	}
+
+	outPath := *outParam
+	if outPath == "" {
+		outPath = "."
+	}
+	if isDir, err := utils.DirExists(outPath); err != nil {
+		return nil, err
+	} else if isDir {
+		outPath = filepath.Join(outPath, backup.GetArchiveName(name, time.Now()))
+	}
+
+	return &BackupCommand{
+		name:           name,
+		outPath:        outPath,
+		hostname:       *serverConfigFlags.Hostname,
+		sshUsername:    *serverConfigFlags.SshUsername,
+		sshKeyFilePath: *serverConfigFlags.SshKeyFilePath,
+		breakLock:      *breakLockParam,
+	}, nil
+}
+
+func (c *BackupCommand) Invoke() error {
+	exec, err := sshclient.CreateSshExecutor(c.hostname, c.sshUsername, c.sshKeyFilePath, "")
+	if err != nil {
+		return err
+	}
+	defer exec.Close()
+
+	l, err := lock.Acquire(exec, c.name, "backup", c.breakLock)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(exec, l)
+
+	return takeBackup(exec, c.hostname, c.sshUsername, c.sshKeyFilePath, c.name, c.outPath, true)
+}
+
+func (s *RestoreCommandSpec) Build() (Command, error) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(&EmptyWriter{})
+
+	nameParam := fs.String(
+		"name",
+		"",
+		"Name of the service to restore",
+	)
+	pathParam := fs.String(
+		"path",
+		"",
+		"Path to the project whose environment is selected with -env. Defaults to current working directory.",
+	)
+	archiveParam := fs.String(
+		"archive",
+		"",
+		"Backup file created by `smt backup` to restore (required)",
+	)
+	yesParam := fs.Bool(
+		"yes",
+		false,
+		"Do not prompt before replacing the service's data",
+	)
+
+	serverConfigFlags := UseServerConfigFlags(fs)
+	envParam := UseEnvironmentFlag(fs)
+
+	breakLockParam := UseBreakLockFlag(fs)
+
+	debugParam := fs.Bool("debug", false, "Set log level to debug")
+
+	if err := fs.Parse(s.Args); err != nil {
+		if err != flag.ErrHelp {
+			utils.PrintErrf("error: %v\n", err)
+		}
+		fs.SetOutput(nil)
+		fs.Usage()
+		return nil, err
+	}
+
+	if *debugParam {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	} else {
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	}
+
+	name, err := ResolveServiceName(*nameParam, *envParam, *pathParam, serverConfigFlags)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("service name required")
+	}
+	if *archiveParam == "" {
+		return nil, fmt.Errorf("-archive is required")
+	}
+	if err := ValidateServerConfigFlags(serverConfigFlags); err != nil {
+		return nil, err
+	}
+
+	return &RestoreCommand{
+		name:           name,
+		archivePath:    *archiveParam,
+		yes:            *yesParam,
+		hostname:       *serverConfigFlags.Hostname,
+		sshUsername:    *serverConfigFlags.SshUsername,
+		sshKeyFilePath: *serverConfigFlags.SshKeyFilePath,
+		breakLock:      *breakLockParam,
+	}, nil
+}
+
+func (c *RestoreCommand) Invoke() error {
+	if !c.yes {
+		yes, err := utils.BinaryPrompt(fmt.Sprintf("Replace the data of service %s on %s with %s?", c.name, c.hostname, c.archivePath))
+		if err != nil {
+			return err
+		}
+		if !yes {
+			slog.Info("restore cancelled")
+			return nil
+		}
+	}
+
+	exec, err := sshclient.CreateSshExecutor(c.hostname, c.sshUsername, c.sshKeyFilePath, "")
+	if err != nil {
+		return err
+	}
+	defer exec.Close()
+
+	l, err := lock.Acquire(exec, c.name, "restore", c.breakLock)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(exec, l)
+
+	s, err := loadBackupService(exec, c.name)
+	if err != nil {
+		return err
+	}
+	client, err := sshclient.CreateSshClient(c.hostname, c.sshUsername, c.sshKeyFilePath, "")
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	manifest, err := backup.Restore(exec, client, s, c.archivePath, func() (string, error) { return getBackupPassphrase(false, true) })
+	if err != nil {
+		return err
+	}
+	slog.Info("restored backup", "name", c.name, "archive", c.archivePath, "created-at", manifest.CreatedAt, "from-host", manifest.Host)
+	return nil
+}
+
+// Backs up the named service to outPath. If prompt is set, the passphrase for an included
+// secrets volume is prompted for when it is not set in the environment.
+func takeBackup(exec deploy.Executor, hostname string, sshUsername string, sshKeyFilePath string, name string, outPath string, prompt bool) error {
+	s, err := loadBackupService(exec, name)
+	if err != nil {
+		return err
+	}
+
+	passphrase := ""
+	if s.Spec.SecretsVolume != "" {
+		if passphrase, err = getBackupPassphrase(true, prompt); err != nil {
+			return err
+		}
+	}
+
+	client, err := sshclient.CreateSshClient(hostname, sshUsername, sshKeyFilePath, "")
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0700); err != nil {
+		return fmt.Errorf("failed to create backup directory %s: %w", filepath.Dir(outPath), err)
+	}
+	manifest, err := backup.Create(exec, client, s, passphrase, outPath)
+	if err != nil {
+		return err
+	}
+	slog.Info("created backup", "name", name, "path", outPath, "data-dirs", manifest.DataDirs, "volumes", manifest.Volumes, "secrets", manifest.SecretsVolume != "")
+	return nil
+}
+
+func loadBackupService(exec deploy.Executor, name string) (*backup.Service, error) {
+	serverConfig, err := serverconfig.LoadServerConfig(exec, install.DefaultConfigFilePath, false)
+	if err != nil {
+		return nil, err
+	}
+	serviceDefn, err := serverConfig.LoadServiceDefinition(exec, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &backup.Service{
+		Name:     name,
+		Path:     serviceDefn.Path,
+		Commands: serviceDefn.ServiceConfig.Commands,
+		Spec:     serviceDefn.ServiceConfig.GetBackupSpec(),
+	}, nil
+}
+
+// Gets the backup passphrase from the environment, or prompts for it if allowed. New
+// passphrases are confirmed by entering them twice.
+func getBackupPassphrase(confirm bool, prompt bool) (string, error) {
+	if passphrase := os.Getenv(BackupPassphraseEnvName); passphrase != "" {
+		return passphrase, nil
+	}
+	if !prompt {
+		return "", fmt.Errorf("backup includes secrets; set %s to the passphrase to encrypt them with", BackupPassphraseEnvName)
+	}
+	for {
+		passphrase, err := term.PromptSensitive("Enter backup passphrase")
+		if err != nil {
+			return "", err
+		}
+		if !confirm {
+			return passphrase, nil
+		}
+		again, err := term.PromptSensitive("Enter passphrase again")
+		if err != nil {
+			return "", err
+		}
+		if passphrase == again {
+			return passphrase, nil
+		}
+		fmt.Fprintf(os.Stderr, "passphrases do not match; please enter again\n\n")
+	}
+}
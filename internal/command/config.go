@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/sshclient"
@@ -23,6 +25,10 @@ type ConfigCommand struct {
 	hostname       string
 	sshKeyFilePath string
 	sshUsername    string
+	transport      string
+	s3BaseUrl      string
+	group          string
+	members        []string
 	setDefault     bool
 	force          bool
 	action         ConfigAction
@@ -50,7 +56,18 @@ func (s *ConfigCommandSpec) Build() (Command, error) {
 	// TODO: Turn some of these into globals, and abstract out reading from config
 
 	serverConfigFlags := UseServerConfigFlags(fs)
+	transportFlags := UseTransportFlags(fs)
 
+	groupParam := fs.String(
+		"group",
+		"",
+		"Name of a server group to show, set or delete instead of a single server",
+	)
+	membersParam := fs.String(
+		"members",
+		"",
+		"Comma-separated list of the servers in the group given by -group (used with -set)",
+	)
 	setDefaultParam := fs.Bool(
 		"set-default",
 		false,
@@ -131,19 +148,55 @@ func (s *ConfigCommandSpec) Build() (Command, error) {
 		action = actions[0]
 	}
 
-	if action == DeleteConfig && server == "" {
-		return nil, fmt.Errorf("-server is required when deleting an entry")
+	group := *groupParam
+	members := []string{}
+	for _, m := range strings.Split(*membersParam, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			members = append(members, m)
+		}
+	}
+	if group != "" && server != "" {
+		return nil, fmt.Errorf("cannot specify both -server and -group")
+	}
+	if group != "" && setDefault {
+		return nil, fmt.Errorf("a group cannot be set as the default server")
+	}
+	if group == "" && len(members) > 0 {
+		return nil, fmt.Errorf("-members can only be used with -group")
+	}
+	if action == SetConfig && group != "" && len(members) == 0 {
+		return nil, fmt.Errorf("-members is required when setting a group")
+	}
+	if action == ValidateConfig && group != "" {
+		return nil, fmt.Errorf("cannot -validate a group; validate its servers individually")
+	}
+
+	if action == DeleteConfig && server == "" && group == "" {
+		return nil, fmt.Errorf("-server or -group is required when deleting an entry")
 	}
 	if action == DeleteConfig && setDefault {
 		return nil, fmt.Errorf("cannot both -delete and -set-default an entry")
 	}
 
+	transport := *transportFlags.Transport
+	if transport != "" && !slices.Contains(config.SupportedTransports, transport) {
+		return nil, fmt.Errorf("invalid transport: '%s' (must be one of: %s)", transport, strings.Join(config.SupportedTransports, ", "))
+	}
+	s3BaseUrl := *transportFlags.S3BaseUrl
+	if s3BaseUrl != "" && !strings.HasPrefix(s3BaseUrl, "s3://") {
+		return nil, fmt.Errorf("invalid S3 base URL: '%s' (must start with 's3://')", s3BaseUrl)
+	}
+
 	c := &ConfigCommand{
 		configPath:     configPath,
 		server:         server,
 		hostname:       *serverConfigFlags.Hostname,
 		sshUsername:    *serverConfigFlags.SshUsername,
 		sshKeyFilePath: *serverConfigFlags.SshKeyFilePath,
+		transport:      transport,
+		s3BaseUrl:      s3BaseUrl,
+		group:          group,
+		members:        members,
 		setDefault:     setDefault,
 		force:          *forceParam,
 		action:         action,
@@ -160,6 +213,10 @@ func (c *ConfigCommand) Invoke() error {
 		return fmt.Errorf("failed to load config at %s: %w", c.configPath, err)
 	}
 
+	if c.group != "" {
+		return c.invokeGroup(cfg)
+	}
+
 	if c.action == ShowConfig {
 		server := c.server
 		if server == "" {
@@ -174,6 +231,14 @@ func (c *ConfigCommand) Invoke() error {
 		fmt.Printf("    hostname:                 %s\n", entry.Hostname)
 		fmt.Printf("    ssh_username:             %s\n", entry.SshUsername)
 		fmt.Printf("    ssh_key_file_path:        %s\n", entry.SshKeyFilePath)
+		transport := entry.Transport
+		if transport == "" {
+			transport = fmt.Sprintf("%s (default)", config.DefaultTransport)
+		}
+		fmt.Printf("    transport:                %s\n", transport)
+		if entry.S3BaseUrl != "" {
+			fmt.Printf("    s3_base_url:              %s\n", entry.S3BaseUrl)
+		}
 		fmt.Println()
 
 		return nil
@@ -186,6 +251,9 @@ func (c *ConfigCommand) Invoke() error {
 		}
 
 		delete(cfg.Servers, c.server)
+		for g, members := range cfg.Groups {
+			cfg.Groups[g] = utils.Filter(members, func(m string) bool { return m != c.server })
+		}
 		return config.SaveClientConfig(c.configPath, cfg)
 	}
 
@@ -214,6 +282,9 @@ func (c *ConfigCommand) Invoke() error {
 			server = DefaultServerName
 			slog.Info("no server name provided, using default", "server", server)
 		}
+		if _, prs := cfg.Groups[server]; prs {
+			return fmt.Errorf("server name %s conflicts with an existing group", server)
+		}
 		entry, prs := cfg.Servers[server]
 
 		var hostname, sshUsername, sshKeyFilePath string
@@ -259,6 +330,15 @@ func (c *ConfigCommand) Invoke() error {
 		entry.Hostname = hostname
 		entry.SshUsername = sshUsername
 		entry.SshKeyFilePath = sshKeyFilePath
+		if c.transport != "" {
+			entry.Transport = c.transport
+		}
+		if c.s3BaseUrl != "" {
+			entry.S3BaseUrl = c.s3BaseUrl
+		}
+		if entry.Transport == config.TransportS3 && entry.S3BaseUrl == "" {
+			return fmt.Errorf("server %s uses the %s transport but has no S3 base URL - provide one with -s3-base-url", server, config.TransportS3)
+		}
 
 		if c.setDefault || cfg.DefaultServer == "" {
 			cfg.DefaultServer = server
@@ -268,6 +348,36 @@ func (c *ConfigCommand) Invoke() error {
 	return config.SaveClientConfig(c.configPath, cfg)
 }
 
+func (c *ConfigCommand) invokeGroup(cfg *config.ClientConfig) error {
+	switch c.action {
+	case ShowConfig:
+		members, prs := cfg.Groups[c.group]
+		if !prs {
+			return fmt.Errorf("group %s not found", c.group)
+		}
+		fmt.Printf("%s:\n", c.group)
+		for _, m := range members {
+			fmt.Printf("    - %s\n", m)
+		}
+		fmt.Println()
+		return nil
+	case DeleteConfig:
+		delete(cfg.Groups, c.group)
+	case SetConfig:
+		if _, prs := cfg.Servers[c.group]; prs {
+			return fmt.Errorf("group name %s conflicts with an existing server", c.group)
+		}
+		for _, m := range c.members {
+			if _, prs := cfg.Servers[m]; !prs {
+				return fmt.Errorf("group member %s is not a configured server", m)
+			}
+		}
+		cfg.Groups[c.group] = c.members
+	}
+
+	return config.SaveClientConfig(c.configPath, cfg)
+}
+
 func getInput(prompt string, currentValue string) (string, error) {
 	var fullPrompt string
 	required := currentValue == ""
@@ -8,7 +8,11 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
 	"github.com/mrshanahan/deploy-assets/pkg/executor"
@@ -16,12 +20,30 @@ import (
 	"github.com/mrshanahan/deploy-assets/pkg/provider"
 	"github.com/mrshanahan/deploy-assets/pkg/runner"
 	"github.com/mrshanahan/deploy-assets/pkg/transport"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/backup"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/bluegreen"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/certs"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/content"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/events"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/git"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/health"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/history"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/hooks"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/imagebuild"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/imageprune"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/imagestream"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/install"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/lock"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/nginx"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/preflight"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/registry"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/release"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/secrets"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/service"
-	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/sshclient"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/systemd"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
 )
 
@@ -30,22 +52,93 @@ type DeployCommandSpec struct {
 }
 
 type DeployCommand struct {
-	projectConfig  *project.ProjectConfig
-	hostname       string
-	sshKeyFilePath string
-	sshUsername    string
-	s3BaseUrl      string
+	projectConfig *project.ProjectConfig
+	targets       []*ServerTarget
+	parallel      int
+	failFast      bool
+	imageTransfer string
+	// Images pushed to the project's registry, when images are transferred through it
+	registryImages []*registry.Image
 	dryRun         bool
 	show           bool
 	force          bool
+	rollback       bool
+	rollbackId     string
+	planOut        string
+	savedPlan      *plan.Plan
+	breakLock      bool
+	gitSha         string
+	build          bool
+	buildValue     string
+	backup         bool
+	skipChecks     bool
+	// Project directory given by -path, which outlives the worktree of -ref
+	projectDir string
+	// Temporary checkout of the git ref being deployed, if any
+	worktree *git.Worktree
+
+	planMu      sync.Mutex
+	serverPlans map[string]*plan.ServerPlan
+}
+
+// Flags of the deploy command that apply to each project deployed
+type deployFlags struct {
+	serverConfig  *ServerConfigFlags
+	transport     *TransportFlags
+	env           string
+	imageTransfer string
+	parallel      int
+	failFast      bool
+	show          bool
+	dryRun        bool
+	force         bool
+	rollback      bool
+	rollbackId    string
+	planOut       string
+	plan          string
+	build         bool
+	allowDirty    bool
+	breakLock     bool
+	backup        bool
+	skipChecks    bool
+}
+
+type DeployResult int
+
+const (
+	DeployUnchanged DeployResult = iota
+	DeployChanged
+	DeployFailed
+	DeploySkipped
+)
+
+var (
+	DeployResultNames map[DeployResult]string = map[DeployResult]string{
+		DeployUnchanged: "unchanged",
+		DeployChanged:   "changed",
+		DeployFailed:    "failed",
+		DeploySkipped:   "skipped",
+	}
+)
+
+type deployOutcome struct {
+	target  *ServerTarget
+	result  DeployResult
+	changed []string
+	err     error
 }
 
 const (
 	REMOTE_SERVER_NAME string = "remote"
 	LOCAL_SERVER_NAME  string = "local"
+
+	DefaultDeployParallelism int = 4
+
+	// Directory within the service directory holding the previous copies of its nginx sites
+	NginxBackupDirName string = "nginx-backup"
 )
 
-func (s *DeployCommandSpec) Build() (Command, error) {
+func (s *DeployCommandSpec) Build() (cmd Command, err error) {
 	fs := flag.NewFlagSet("deploy", flag.ContinueOnError)
 	fs.SetOutput(&EmptyWriter{})
 
@@ -56,18 +149,35 @@ func (s *DeployCommandSpec) Build() (Command, error) {
 		"",
 		"Path to the project to deploy. Defaults to current working directory.",
 	)
-	s3BaseUrlParam := fs.String(
-		"s3-base-url",
-		"s3://quemot-dev-bucket/smt",
-		"Base S3 URL to use for transfers to remote servers.",
-	)
 
 	serverConfigFlags := UseServerConfigFlags(fs)
+	transportFlags := UseTransportFlags(fs)
+	envParam := UseEnvironmentFlag(fs)
+	imageTransferParam := fs.String(
+		"image-transfer",
+		"",
+		fmt.Sprintf("How to move Docker images to the remote server (one of: %s). Overrides image_transfer in the project config; defaults to %s, or %s if the project has a registry.",
+			strings.Join(project.SupportedImageTransfers, ", "),
+			project.DefaultImageTransfer,
+			project.ImageTransferRegistry),
+	)
 
 	showParam := fs.Bool("show", false, "Do not actually copy anything, just show compiled manifest and exit")
 	dryRunParam := fs.Bool("dry-run", false, "Do not actually copy anything, just calculate differences and exit")
 	debugParam := fs.Bool("debug", false, "Set log level to debug")
 	forceParam := fs.Bool("force", false, "Force-create directory structures when necessary. Amounts to setting '\"force\": true' on all file resources.")
+	parallelParam := fs.Int("parallel", DefaultDeployParallelism, "Maximum number of servers to deploy to at once when deploying to multiple servers")
+	failFastParam := fs.Bool("fail-fast", false, "When deploying to multiple servers, skip servers not yet started once any server fails")
+	rollbackParam := fs.Bool("rollback", false, "Instead of deploying, restore a previous release & restart the service. Optionally followed by the ID of the release to restore (after all other flags); defaults to the release before the current one.")
+	planOutParam := fs.String("plan-out", "", "Write the plan calculated by a dry run to the given JSON file. Implies -dry-run.")
+	buildParam := fs.Bool("build", false, "Build the project's images from the current git commit before deploying them")
+	allowDirtyParam := fs.Bool("allow-dirty", false, "Allow -build to build from a git tree with uncommitted changes; the images are labelled with the commit SHA suffixed with -dirty")
+	breakLockParam := UseBreakLockFlag(fs)
+	backupParam := fs.Bool("backup", false, "Back up the service's data before deploying, as when the project's backup.before_deploy is set")
+	planParam := fs.String("plan", "", "Path to a plan written by -plan-out; refuse to deploy if the remote state has drifted since the plan was made")
+	skipChecksParam := fs.Bool("skip-checks", false, "Deploy even if the preflight checks of the project's docker-compose file against its config find problems")
+	refParam := fs.String("ref", "", "Deploy the given git branch, tag or commit instead of the working tree: it is checked out into a temporary worktree, & its smt.json & images are used. Implies -build.")
+	workspaceParam := fs.String("workspace", "", "Deploy every project with a smt.json under the given directory instead of a single project, in the order given by their depends_on, over one SSH connection per server")
 
 	if err := fs.Parse(s.Args); err != nil {
 		if err != flag.ErrHelp {
@@ -79,12 +189,58 @@ func (s *DeployCommandSpec) Build() (Command, error) {
 		return nil, err
 	}
 
+	if fs.NArg() > 0 && !*rollbackParam {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if fs.NArg() > 1 {
+		return nil, fmt.Errorf("at most one release may be provided to -rollback")
+	}
+
 	if *debugParam {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	} else {
 		slog.SetLogLoggerLevel(slog.LevelInfo)
 	}
 
+	if *parallelParam < 1 {
+		return nil, fmt.Errorf("-parallel must be at least 1")
+	}
+	if (*planOutParam != "" || *planParam != "") && (*showParam || *rollbackParam) {
+		return nil, fmt.Errorf("-plan-out & -plan cannot be combined with -show or -rollback")
+	}
+
+	f := &deployFlags{
+		serverConfig:  serverConfigFlags,
+		transport:     transportFlags,
+		env:           *envParam,
+		imageTransfer: *imageTransferParam,
+		parallel:      *parallelParam,
+		failFast:      *failFastParam,
+		show:          *showParam,
+		dryRun:        *dryRunParam,
+		force:         *forceParam,
+		rollback:      *rollbackParam,
+		rollbackId:    fs.Arg(0),
+		planOut:       *planOutParam,
+		plan:          *planParam,
+		build:         *buildParam,
+		allowDirty:    *allowDirtyParam,
+		breakLock:     *breakLockParam,
+		backup:        *backupParam,
+		skipChecks:    *skipChecksParam,
+	}
+
+	if *workspaceParam != "" {
+		if *pathParam != "" || *refParam != "" || *rollbackParam || *showParam || *planOutParam != "" || *planParam != "" {
+			return nil, fmt.Errorf("-workspace cannot be combined with -path, -ref, -rollback, -show, -plan-out or -plan")
+		}
+		w, err := newWorkspaceDeployCommand(*workspaceParam, f)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
 	path := *pathParam
 	if path == "" {
 		wd, err := os.Getwd()
@@ -100,53 +256,381 @@ func (s *DeployCommandSpec) Build() (Command, error) {
 		}
 		return nil, err
 	}
+	projectDir := filepath.Dir(projectConfigPath)
+
+	var worktree *git.Worktree
+	if *refParam != "" {
+		if *rollbackParam {
+			return nil, fmt.Errorf("-ref cannot be combined with -rollback")
+		}
+		worktree, err = git.AddWorktree(projectDir, *refParam)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check out git ref %s: %w", *refParam, err)
+		}
+		defer func() {
+			if err != nil {
+				removeWorktree(worktree)
+			}
+		}()
+		slog.Info("checked out git ref into temporary worktree", "ref", *refParam, "git-sha", worktree.Sha, "worktree", worktree.Dir)
+		projectConfigPath, err = worktree.Path(projectConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if err := ValidateServerConfigFlags(serverConfigFlags); err != nil {
+	c, err := newDeployCommand(projectConfigPath, projectDir, worktree, f)
+	if err != nil {
 		return nil, err
 	}
+	return c, nil
+}
 
-	s3BaseUrl := *s3BaseUrlParam
-	if !strings.HasPrefix(s3BaseUrl, "s3://") {
-		return nil, fmt.Errorf("invalid S3 base URL: '%s' (must start with 's3://')", s3BaseUrl)
+// Builds the deploy of the project at projectConfigPath. worktree, if any, is the temporary
+// checkout of -ref the project config is in, & projectDir is the project's directory outside it.
+func newDeployCommand(projectConfigPath string, projectDir string, worktree *git.Worktree, f *deployFlags) (*DeployCommand, error) {
+	projectConfig, err := project.LoadProjectConfigForEnvironment(projectConfigPath, f.env)
+	if err != nil {
+		return nil, err
 	}
 
-	projectConfig, err := project.LoadProjectConfig(projectConfigPath)
+	serverConfigFlags := copyServerConfigFlags(f.serverConfig)
+	ApplyEnvironmentServer(serverConfigFlags, projectConfig)
+	targets, err := ResolveServerTargets(serverConfigFlags, f.transport)
 	if err != nil {
 		return nil, err
 	}
 
+	imageTransfer := f.imageTransfer
+	if imageTransfer == "" {
+		imageTransfer = projectConfig.GetImageTransfer()
+	}
+	if !slices.Contains(project.SupportedImageTransfers, imageTransfer) {
+		return nil, fmt.Errorf("invalid image transfer mode: '%s' (must be one of: %s)", imageTransfer, strings.Join(project.SupportedImageTransfers, ", "))
+	}
+
+	var savedPlan *plan.Plan
+	if f.plan != "" {
+		savedPlan, err = plan.LoadPlan(f.plan)
+		if err != nil {
+			return nil, err
+		}
+		if savedPlan.Project != projectConfig.Name || savedPlan.Environment != projectConfig.Environment {
+			return nil, fmt.Errorf("plan %s was made for project %s (environment '%s'), not %s (environment '%s')",
+				f.plan, savedPlan.Project, savedPlan.Environment, projectConfig.Name, projectConfig.Environment)
+		}
+	}
+
+	build := f.build || worktree != nil
+	gitSha, err := git.HeadSha(projectConfig.ProjectDir)
+	if err != nil {
+		if build {
+			return nil, fmt.Errorf("-build requires the project to be in a git repository: %w", err)
+		}
+		slog.Debug("could not determine git SHA of project; it will not be recorded in history", "err", err)
+	}
+
+	buildValue := gitSha
+	if build {
+		if f.rollback {
+			return nil, fmt.Errorf("-build cannot be combined with -rollback")
+		}
+		dirty, err := git.IsDirty(projectConfig.ProjectDir)
+		if err != nil {
+			return nil, err
+		}
+		if dirty {
+			if !f.allowDirty {
+				return nil, fmt.Errorf("refusing to build images from a git tree with uncommitted changes; commit them or pass -allow-dirty")
+			}
+			slog.Warn("building images from a git tree with uncommitted changes", "git-sha", gitSha)
+			buildValue = fmt.Sprintf("%s-dirty", gitSha)
+		}
+	}
+
+	if imageTransfer == project.ImageTransferRegistry && !f.rollback {
+		if projectConfig.Registry == nil {
+			return nil, fmt.Errorf("image transfer mode '%s' requires a registry entry in %s", imageTransfer, projectConfig.ProjectConfigPath)
+		}
+		if buildValue == "" {
+			return nil, fmt.Errorf("image transfer mode '%s' tags images with the git SHA & requires the project to be in a git repository", imageTransfer)
+		}
+	}
+
 	return &DeployCommand{
-		projectConfig:  projectConfig,
-		hostname:       *serverConfigFlags.Hostname,
-		sshUsername:    *serverConfigFlags.SshUsername,
-		sshKeyFilePath: *serverConfigFlags.SshKeyFilePath,
-		s3BaseUrl:      s3BaseUrl,
-		dryRun:         *dryRunParam,
-		show:           *showParam,
-		force:          *forceParam,
+		projectConfig: projectConfig,
+		targets:       targets,
+		parallel:      f.parallel,
+		failFast:      f.failFast,
+		imageTransfer: imageTransfer,
+		dryRun:        f.dryRun || f.planOut != "",
+		show:          f.show,
+		force:         f.force,
+		rollback:      f.rollback,
+		rollbackId:    f.rollbackId,
+		planOut:       f.planOut,
+		savedPlan:     savedPlan,
+		breakLock:     f.breakLock,
+		gitSha:        gitSha,
+		build:         build,
+		buildValue:    buildValue,
+		backup:        f.backup || (projectConfig.Backup != nil && projectConfig.Backup.BeforeDeploy),
+		skipChecks:    f.skipChecks,
+		projectDir:    projectDir,
+		worktree:      worktree,
+		serverPlans:   map[string]*plan.ServerPlan{},
 	}, nil
 }
 
 func (c *DeployCommand) Invoke() error {
-	sshExecutor, err := sshclient.CreateSshExecutor(c.hostname, c.sshUsername, c.sshKeyFilePath, "")
-	if err != nil {
+	if c.worktree != nil {
+		defer removeWorktree(c.worktree)
+	}
+	start := time.Now()
+	err := c.invoke()
+	events.Emit((&events.Event{Type: events.TypeFinished, Project: c.projectConfig.Name, DryRun: c.dryRun, DurationMs: events.DurationSince(start)}).Finish(err))
+	return err
+}
+
+func (c *DeployCommand) invoke() error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+
+	if err := c.invokeTargets(); err != nil {
 		return err
 	}
 
+	if c.planOut != "" {
+		p := &plan.Plan{
+			Project:     c.projectConfig.Name,
+			Environment: c.projectConfig.Environment,
+			CreatedAt:   time.Now().UTC(),
+			Servers:     []*plan.ServerPlan{},
+		}
+		for _, t := range c.targets {
+			if sp, prs := c.serverPlans[t.Server]; prs {
+				p.Servers = append(p.Servers, sp)
+			}
+		}
+		if err := plan.SavePlan(c.planOut, p); err != nil {
+			return err
+		}
+		slog.Info("wrote deploy plan", "path", c.planOut)
+	}
+	return nil
+}
+
+// Does what the deploy needs before connecting to any server: runs the preflight checks,
+// builds the project's images & pushes them to its registry.
+func (c *DeployCommand) prepare() error {
+	if !c.rollback && !c.skipChecks {
+		if problems := preflight.Check(c.projectConfig); len(problems) > 0 {
+			for _, p := range problems {
+				slog.Error("preflight check failed", "check", p.Check, "problem", p.Message)
+			}
+			return fmt.Errorf("deploy aborted: found %d problem(s) in project %s; fix them or pass -skip-checks", len(problems), c.projectConfig.Name)
+		}
+	}
+
+	if c.build {
+		if err := imagebuild.BuildImages(c.projectConfig, c.buildValue); err != nil {
+			return err
+		}
+	}
+
+	if c.imageTransfer == project.ImageTransferRegistry && !c.rollback {
+		local := executor.NewLocalExecutor("local")
+		images, err := registry.Push(local, c.projectConfig.Registry.Url, c.projectConfig.ImageNames, c.buildValue, c.dryRun || c.show)
+		local.Close()
+		if err != nil {
+			return err
+		}
+		c.registryImages = images
+	}
+	return nil
+}
+
+func (c *DeployCommand) invokeTargets() error {
+	if len(c.targets) == 1 || c.show {
+		for _, t := range c.targets {
+			if _, err := c.deployTo(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	outcomes := make([]*deployOutcome, len(c.targets))
+	sem := make(chan struct{}, c.parallel)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for i, t := range c.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if c.failFast && failed.Load() {
+				outcomes[i] = &deployOutcome{target: t, result: DeploySkipped}
+				events.Emit(&events.Event{Type: events.TypeServerResult, Status: events.StatusSkipped, Project: c.projectConfig.Name, Server: t.Server, Hostname: t.Hostname})
+				return
+			}
+
+			slog.Info("deploying to server", "server", t.Server, "hostname", t.Hostname)
+			changed, err := c.deployTo(t)
+			outcome := &deployOutcome{target: t, changed: changed, err: err}
+			if err != nil {
+				slog.Error("deploy to server failed", "server", t.Server, "hostname", t.Hostname, "err", err)
+				outcome.result = DeployFailed
+				failed.Store(true)
+			} else if len(changed) > 0 {
+				outcome.result = DeployChanged
+			} else {
+				outcome.result = DeployUnchanged
+			}
+			outcomes[i] = outcome
+		}()
+	}
+	wg.Wait()
+
+	values := []map[string]string{}
+	failures := 0
+	for _, o := range outcomes {
+		details := strings.Join(o.changed, ", ")
+		if o.err != nil {
+			details = o.err.Error()
+			failures += 1
+		}
+		values = append(values, map[string]string{
+			"SERVER":   o.target.Server,
+			"HOSTNAME": o.target.Hostname,
+			"RESULT":   DeployResultNames[o.result],
+			"DETAILS":  details,
+		})
+	}
+	// With events enabled stdout is reserved for them, & each server's result is an event
+	if !events.Enabled() {
+		fmt.Println(utils.BuildTable([]string{"SERVER", "HOSTNAME", "RESULT", "DETAILS"}, values))
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("deploy failed on %d of %d servers", failures, len(c.targets))
+	}
+	return nil
+}
+
+// Deploys the project to a single server, returning the names of the assets that changed.
+func (c *DeployCommand) deployTo(t *ServerTarget) ([]string, error) {
+	start := time.Now()
+	sshExecutor, err := connectTo(t, c.projectConfig.Name)
+	if err != nil {
+		c.emitServerResult(t, start, nil, err)
+		return nil, err
+	}
+	defer sshExecutor.Close()
+	return c.deployWith(sshExecutor, t, start)
+}
+
+// Opens the SSH connection to the server that deploys to it share. The executor is named after
+// the target, so that errors & runner output identify the server.
+func connectTo(t *ServerTarget, projectName string) (deploy.Executor, error) {
+	start := time.Now()
+	events.Emit(&events.Event{Type: events.TypeConnect, Status: events.StatusStarted, Project: projectName, Server: t.Server, Hostname: t.Hostname})
+	hostname := t.Hostname
+	if !strings.Contains(hostname, ":") {
+		hostname = fmt.Sprintf("%s:22", hostname)
+	}
+	runElevated := true
+	sshExecutor, err := executor.NewSSHExecutor(t.Server, hostname, t.SshUsername, t.SshKeyFilePath, "", runElevated)
+	events.Emit((&events.Event{Type: events.TypeConnect, Project: projectName, Server: t.Server, Hostname: t.Hostname, DurationMs: events.DurationSince(start)}).Finish(err))
+	return sshExecutor, err
+}
+
+func (c *DeployCommand) emitServerResult(t *ServerTarget, start time.Time, changed []string, err error) {
+	e := (&events.Event{Type: events.TypeServerResult, Project: c.projectConfig.Name, Server: t.Server, Hostname: t.Hostname, DryRun: c.dryRun, Changed: changed, DurationMs: events.DurationSince(start)}).Finish(err)
+	if err == nil {
+		e.Result = DeployResultNames[DeployUnchanged]
+		if len(changed) > 0 {
+			e.Result = DeployResultNames[DeployChanged]
+		}
+	}
+	events.Emit(e)
+}
+
+// Deploys the project to a single server over the given connection to it, returning the
+// names of the assets that changed. Deploys that change the server hold the service's lock
+// & are recorded in its history.
+func (c *DeployCommand) deployWith(sshExecutor deploy.Executor, t *ServerTarget, start time.Time) (changed []string, err error) {
+	defer func() { c.emitServerResult(t, start, changed, err) }()
+
+	if c.show || c.dryRun {
+		return c.syncTo(sshExecutor, t, nil)
+	}
+
+	operation := "deploy"
+	if c.rollback {
+		operation = "rollback"
+	}
+	l, err := lock.Acquire(sshExecutor, c.projectConfig.Name, operation, c.breakLock)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseLock(sshExecutor, l)
+
+	entry := history.NewEntry(operation, c.gitSha, c.projectConfig.Environment)
+	changed, err = c.syncTo(sshExecutor, t, entry)
+	entry.Finish(err)
+	if err := history.Append(sshExecutor, c.servicePath(sshExecutor), entry); err != nil {
+		slog.Warn("failed to record deploy in service history", "name", c.projectConfig.Name, "server", t.Server, "err", err)
+	}
+	return changed, err
+}
+
+// Gets the directory of the service on the server: the one recorded in the server config, or
+// the default one if the service has not been deployed to it.
+func (c *DeployCommand) servicePath(exec deploy.Executor) string {
+	if serverConfig, err := config.LoadServerConfig(exec, install.DefaultConfigFilePath, false); err == nil {
+		if path, prs := serverConfig.Services[c.projectConfig.Name]; prs {
+			return path
+		}
+	}
+	return service.NewServiceDefinition(c.projectConfig.Name).Path
+}
+
+// Syncs the project's assets to the server (or rolls them back), filling in the history
+// entry, if any, as it goes.
+func (c *DeployCommand) syncTo(sshExecutor deploy.Executor, t *ServerTarget, entry *history.Entry) ([]string, error) {
+	// The backup is taken before anything on the server is changed
+	if c.backup && !c.dryRun && !c.rollback {
+		if err := c.backupBeforeDeploy(sshExecutor, t); err != nil {
+			return nil, fmt.Errorf("deploy aborted: %w", err)
+		}
+	}
+
 	if c.projectConfig.DockerSecretsVolume != "" {
 		if _, err := secrets.EnsureSecretsVolume(sshExecutor, c.projectConfig.DockerSecretsVolume, c.dryRun); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	serverConfig, err := config.LoadServerConfig(sshExecutor, install.DefaultConfigFilePath, true)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if c.rollback {
+		target, err := c.invokeRollback(sshExecutor, serverConfig)
+		if entry != nil && target != nil {
+			entry.Release = target.ID
+		}
+		return nil, err
 	}
 
 	serviceDefn, err := serverConfig.LoadServiceDefinition(sshExecutor, c.projectConfig.Name, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if serviceDefn == nil {
 		serviceDefn = service.NewServiceDefinition(c.projectConfig.Name)
@@ -154,141 +638,615 @@ func (c *DeployCommand) Invoke() error {
 	}
 
 	serviceDefn.ServiceConfig.Commands = c.projectConfig.Commands
-	assets, err := buildAssets(serviceDefn, c.projectConfig, c.force)
-	if err != nil {
-		return fmt.Errorf("failed to build manifest assets list: %w", err)
+	serviceDefn.ServiceConfig.ImageNames = c.projectConfig.ImageNames
+	serviceDefn.ServiceConfig.ImageCompareLabel = c.projectConfig.ImageCompareLabel
+	serviceDefn.ServiceConfig.ImageRetention = c.projectConfig.GetImageRetention()
+	serviceDefn.ServiceConfig.Backup = buildBackupSpec(c.projectConfig)
+	// Copy of the config deployed by the last deploy, used to remove what the project no longer declares
+	previousConfig := *serviceDefn.ServiceConfig
+
+	if c.savedPlan != nil {
+		if err := c.checkPlan(sshExecutor, t, serviceDefn, &previousConfig); err != nil {
+			return nil, err
+		}
 	}
-	manifest, err := buildManifest(c, assets)
+
+	assets, tracker, manifest, err := c.prepareManifest(sshExecutor, t, serviceDefn, &previousConfig, c.planOut != "")
 	if err != nil {
-		return fmt.Errorf("failed to build manifest: %w", err)
+		return nil, err
 	}
 
 	if c.show {
-		fmt.Println("transport:")
-		fmt.Println(manifest.Transport.Yaml(4))
-		fmt.Println("servers:")
+		// With events enabled stdout is reserved for them
+		out := os.Stdout
+		if events.Enabled() {
+			out = os.Stderr
+		}
+		if len(c.targets) > 1 {
+			fmt.Fprintf(out, "%s:\n", t.Server)
+		}
+		fmt.Fprintln(out, "transport:")
+		fmt.Fprintln(out, manifest.Transport.Yaml(4))
+		fmt.Fprintln(out, "servers:")
 		for _, e := range manifest.Executors {
-			fmt.Println(e.Yaml(4))
+			fmt.Fprintln(out, e.Yaml(4))
 		}
-		fmt.Println("assets:")
+		fmt.Fprintln(out, "assets:")
 		for _, p := range manifest.Providers {
-			fmt.Println(p.Yaml(4))
+			fmt.Fprintln(out, p.Yaml(4))
 		}
-		return nil
+		return nil, nil
 	}
 
-	if err := runner.Execute(manifest, c.dryRun, false); err != nil {
-		return err
+	if err := nginx.CheckOwnership(sshExecutor, c.projectConfig.Name, serviceDefn.ServiceConfig.NginxSites, previousConfig.NginxSites, serverConfig.Sites); err != nil {
+		return nil, fmt.Errorf("deploy aborted: %w", err)
+	}
+
+	previousRelease, err := release.GetCurrentRelease(sshExecutor, serviceDefn.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	hookCtx := &hooks.Context{
+		Name:        c.projectConfig.Name,
+		Server:      t.Server,
+		Hostname:    t.Hostname,
+		ServiceDir:  serviceDefn.Path,
+		Environment: c.projectConfig.Environment,
+	}
+	if err := hooks.Run(c.projectConfig.Hooks, project.HookStagePreDeploy, sshExecutor, c.projectConfig.ProjectDir, hookCtx, c.dryRun); err != nil {
+		return nil, fmt.Errorf("deploy aborted: %w", err)
+	}
+
+	if nginxConfig := c.projectConfig.Nginx; nginxConfig != nil && nginxConfig.Tls {
+		client, err := certs.NewClient(nginxConfig.Acme)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := certs.EnsureCertificate(sshExecutor, client, nginxConfig.GetCertificateName(), nginxConfig.ServerNames, c.dryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.projectConfig.BlueGreen != nil && !c.dryRun {
+		// Before the first deploy no color is active & blue is started first
+		color := serviceDefn.ServiceConfig.ActiveColor
+		if color == "" {
+			color = project.ColorBlue
+		}
+		if err := bluegreen.EnsureUpstream(sshExecutor, c.blueGreenService(serviceDefn.Path), color); err != nil {
+			return nil, err
+		}
+	}
+
+	execErr := runner.Execute(manifest, c.dryRun, false)
+	if entry != nil {
+		entry.Changed = tracker.Changed()
+	}
+	if execErr != nil {
+		// A post-command like the restart failing leaves the synced assets in place, so the
+		// previous release is restored as for a failed health check
+		if !c.dryRun && len(tracker.Changed()) > 0 {
+			return nil, c.rollbackFailedDeploy(sshExecutor, serverConfig, serviceDefn.Path, previousRelease, "sync", execErr, c.projectConfig.BlueGreen == nil)
+		}
+		return nil, execErr
+	}
+
+	if c.planOut != "" {
+		c.planMu.Lock()
+		c.serverPlans[t.Server] = buildServerPlan(t, assets, manifest, tracker)
+		c.planMu.Unlock()
+	}
+
+	if c.projectConfig.BlueGreen != nil {
+		// The new color is health-checked before it takes traffic, so a failed switch leaves
+		// the previous release serving & only its files need restoring
+		if len(tracker.Changed()) > 0 || serviceDefn.ServiceConfig.ActiveColor == "" {
+			if err := c.switchColor(sshExecutor, serverConfig, serviceDefn); err != nil {
+				return nil, c.rollbackFailedDeploy(sshExecutor, serverConfig, serviceDefn.Path, previousRelease, "blue/green switch", err, false)
+			}
+		}
+	} else if !c.dryRun && c.projectConfig.HealthCheck != nil && len(tracker.Changed()) > 0 {
+		slog.Info("waiting for service to become healthy", "name", c.projectConfig.Name, "server", t.Server, "timeout", c.projectConfig.HealthCheck.Timeout())
+		if err := health.WaitForHealthy(sshExecutor, serviceDefn.Path, "", c.projectConfig.HealthCheck, c.projectConfig.Env); err != nil {
+			return nil, c.rollbackFailedDeploy(sshExecutor, serverConfig, serviceDefn.Path, previousRelease, "health check", err, true)
+		}
+	}
+
+	hookCtx.Changed = tracker.Changed()
+	if err := hooks.Run(c.projectConfig.Hooks, project.HookStagePostDeploy, sshExecutor, c.projectConfig.ProjectDir, hookCtx, c.dryRun); err != nil {
+		return nil, c.rollbackFailedDeploy(sshExecutor, serverConfig, serviceDefn.Path, previousRelease, "post-deploy hook", err, true)
 	}
 
 	if !c.dryRun {
+		// A deploy that changed nothing would record a copy of the current release, which a
+		// rollback would then pick & change nothing
+		currentRelease := previousRelease
+		if len(tracker.Changed()) > 0 || currentRelease == "" {
+			r, err := release.RecordRelease(sshExecutor, serviceDefn.Path, c.projectConfig.ImageNames, c.projectConfig.ImageCompareLabel, serviceDefn.ServiceConfig.NginxSites)
+			if err != nil {
+				return nil, fmt.Errorf("deploy succeeded but failed to record release: %w", err)
+			}
+			slog.Info("recorded release", "name", c.projectConfig.Name, "release", r.ID)
+			currentRelease = r.ID
+		} else {
+			slog.Info("nothing changed; keeping current release", "name", c.projectConfig.Name, "release", currentRelease)
+		}
+		if entry != nil {
+			entry.Release = currentRelease
+		}
+
 		slog.Debug("updating server config with new service path", "path", serviceDefn.Path)
-		serverConfig.Services[c.projectConfig.Name] = serviceDefn.Path
-		if err := config.SaveServerConfig(sshExecutor, install.DefaultConfigFilePath, serverConfig); err != nil {
+		err := updateServerConfig(sshExecutor, serverConfig, "deploy", func(s *config.ServerConfig) error {
+			// Another service may have claimed one of the sites while this one was deploying
+			if err := nginx.CheckOwnership(sshExecutor, c.projectConfig.Name, serviceDefn.ServiceConfig.NginxSites, serviceDefn.ServiceConfig.NginxSites, s.Sites); err != nil {
+				return err
+			}
+			s.Services[c.projectConfig.Name] = serviceDefn.Path
+			s.SetServiceSites(c.projectConfig.Name, serviceDefn.ServiceConfig.NginxSites)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("deploy succeeded but failed to update server config: %w", err)
+		}
+
+		c.prune(sshExecutor, serviceDefn.Path)
+	}
+
+	return tracker.Changed(), nil
+}
+
+func removeWorktree(w *git.Worktree) {
+	if err := w.Remove(); err != nil {
+		slog.Warn("failed to remove temporary git worktree", "worktree", w.Dir, "err", err)
+	}
+}
+
+// Removes releases & images outside the project's retention policy. Images of the releases
+// that are kept are kept too, so that they can still be rolled back to. Failing to prune does
+// not fail the deploy, which has already succeeded.
+func (c *DeployCommand) prune(exec deploy.Executor, servicePath string) {
+	keep := c.projectConfig.GetImageRetention()
+	prunedReleases, kept, err := release.Prune(exec, servicePath, keep, false)
+	if err != nil {
+		slog.Warn("deploy succeeded but failed to prune old releases", "name", c.projectConfig.Name, "dst", exec.Name(), "err", err)
+		return
+	}
+	if len(prunedReleases) > 0 {
+		slog.Info("pruned old releases", "name", c.projectConfig.Name, "dst", exec.Name(), "count", len(prunedReleases))
+	}
+
+	if c.projectConfig.ImageCompareLabel == "" {
+		slog.Debug("no image compare label; skipping image pruning", "name", c.projectConfig.Name)
+		return
+	}
+	pruned, err := imageprune.Prune(exec, c.projectConfig.ImageNames, c.projectConfig.ImageCompareLabel, keep, release.ImageIDs(kept), false)
+	if err != nil {
+		slog.Warn("deploy succeeded but failed to prune old images", "name", c.projectConfig.Name, "dst", exec.Name(), "err", err)
+		return
+	}
+	if len(pruned) > 0 {
+		slog.Info("pruned old images", "name", c.projectConfig.Name, "dst", exec.Name(), "count", len(pruned), "freed-up-to", utils.FormatBytes(imageprune.TotalSize(pruned)))
+	}
+}
+
+// Builds the assets of the deploy to the given server, wrapped for tracking, & the manifest
+// that syncs them over the connection to it. The manifest's executors are closed once it is
+// run, so each run needs a fresh manifest. With digests set the content of each asset is
+// digested for a plan.
+func (c *DeployCommand) prepareManifest(sshExecutor deploy.Executor, t *ServerTarget, serviceDefn *service.ServiceDefinition, previousConfig *service.ServiceConfig, digests bool) ([]*deploy.ProviderConfig, *syncTracker, *manifest.Manifest, error) {
+	assets, err := buildAssets(serviceDefn, c.projectConfig, c.force, buildImagesProvider(c, t), c.registryImages, previousConfig)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to build manifest assets list: %w", err)
+	}
+	tracker := newSyncTracker(digests)
+	tracker.Track(assets)
+	manifest, err := buildManifest(t, assets, sshExecutor)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to build manifest: %w", err)
+	}
+	events.ObserveManifest(manifest, t.Server)
+	return assets, tracker, manifest, nil
+}
+
+// Recalculates the plan for the given server with a dry run & compares it to the saved plan,
+// returning an error describing any drift.
+func (c *DeployCommand) checkPlan(sshExecutor deploy.Executor, t *ServerTarget, serviceDefn *service.ServiceDefinition, previousConfig *service.ServiceConfig) error {
+	saved := c.savedPlan.FindServer(t.Server)
+	if saved == nil {
+		return fmt.Errorf("saved plan has no entry for server %s", t.Server)
+	}
+
+	assets, tracker, manifest, err := c.prepareManifest(sshExecutor, t, serviceDefn, previousConfig, true)
+	if err != nil {
+		return err
+	}
+	slog.Info("checking remote state against saved plan", "server", t.Server)
+	if err := runner.Execute(manifest, true, false); err != nil {
+		return fmt.Errorf("failed to recalculate plan: %w", err)
+	}
+
+	diffs := plan.Diff(saved, buildServerPlan(t, assets, manifest, tracker))
+	if len(diffs) > 0 {
+		return fmt.Errorf("remote state of %s has drifted since the plan was made:\n    %s", t.Server, strings.Join(diffs, "\n    "))
+	}
+	return nil
+}
+
+func buildServerPlan(t *ServerTarget, assets []*deploy.ProviderConfig, manifest *manifest.Manifest, tracker *syncTracker) *plan.ServerPlan {
+	serverPlan := &plan.ServerPlan{
+		Server:   t.Server,
+		Hostname: t.Hostname,
+		Assets:   []*plan.AssetPlan{},
+	}
+	for _, a := range assets {
+		result, prs := tracker.Result(a.Provider.Name())
+		if !prs {
+			continue
+		}
+		serverPlan.Assets = append(serverPlan.Assets, plan.NewAssetPlan(a, manifest.Executors[a.Src].Name(), manifest.Executors[a.Dst].Name(), result, tracker.Digest(a.Provider.Name())))
+	}
+	return serverPlan
+}
+
+func (c *DeployCommand) invokeRollback(exec deploy.Executor, serverConfig *config.ServerConfig) (*release.Release, error) {
+	name := c.projectConfig.Name
+	serviceDefn, err := serverConfig.LoadServiceDefinition(exec, name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	releases, err := release.ListReleases(exec, serviceDefn.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		return nil, fmt.Errorf("no releases recorded for service %s - cannot roll back", name)
+	}
+
+	current, err := release.GetCurrentRelease(exec, serviceDefn.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := release.FindRollbackTarget(releases, current, c.rollbackId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find release to roll back to for service %s: %w", name, err)
+	}
+
+	if c.dryRun {
+		slog.Info("DRY RUN: rolling back service", "name", name, "current-release", current, "target-release", target.ID)
+		return target, nil
+	}
+
+	slog.Info("rolling back service", "name", name, "current-release", current, "target-release", target.ID)
+	return target, c.restoreRelease(exec, serverConfig, serviceDefn.Path, target, true)
+}
+
+// Restores the given release of the service at servicePath &, if restart is set, restarts
+// the service. In blue/green mode the restored release is started as the inactive color &
+// traffic is moved to it.
+func (c *DeployCommand) restoreRelease(exec deploy.Executor, serverConfig *config.ServerConfig, servicePath string, target *release.Release, restart bool) error {
+	name := c.projectConfig.Name
+	// The restored config.json records the color that was active when the release was made,
+	// so the color that is active now has to be read first
+	activeColor, currentSites := "", []string{}
+	if currentDefn, err := serverConfig.LoadServiceDefinition(exec, name, true); err != nil {
+		return err
+	} else if currentDefn != nil {
+		activeColor, currentSites = currentDefn.ServiceConfig.ActiveColor, currentDefn.ServiceConfig.NginxSites
+	}
+
+	if err := release.RestoreRelease(exec, servicePath, target, currentSites); err != nil {
+		return err
+	}
+	if target.Sites != nil {
+		err := updateServerConfig(exec, serverConfig, "rollback", func(s *config.ServerConfig) error {
+			s.SetServiceSites(name, target.Sites)
+			return nil
+		})
+		if err != nil {
 			return err
 		}
 	}
 
+	if _, _, err := exec.ExecuteCommand("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("[%s] failed to reload systemctl units: %w", exec.Name(), err)
+	}
+
+	restoredDefn, err := serverConfig.LoadServiceDefinition(exec, name, false)
+	if err != nil {
+		return err
+	}
+	if c.projectConfig.BlueGreen != nil {
+		restoredDefn.ServiceConfig.ActiveColor = activeColor
+		if restart {
+			return c.switchColor(exec, serverConfig, restoredDefn)
+		}
+		return serverConfig.SaveServiceConfig(exec, name, restoredDefn.ServiceConfig)
+	}
+	if !restart {
+		return nil
+	}
+	cmd, prs := restoredDefn.ServiceConfig.Commands["restart"]
+	if !prs {
+		return fmt.Errorf("service %s has no registered restart command", name)
+	}
+	if _, _, err := exec.ExecuteShell(cmd); err != nil {
+		return fmt.Errorf("restart command exited with error: %w", err)
+	}
+
 	return nil
 }
 
-func buildManifest(c *DeployCommand, assets []*deploy.ProviderConfig) (*manifest.Manifest, error) {
-	sshKeyFilePassphrase := ""
-	runElevated := true
-	hostname := c.hostname
-	if !strings.Contains(hostname, ":") {
-		hostname = fmt.Sprintf("%s:22", hostname)
+// Restores the release that was running before a deploy that failed after changing the
+// server, e.g. because its health check failed. restart is passed on to restoreRelease. The
+// returned error always describes the failure, along with the outcome of the restore.
+func (c *DeployCommand) rollbackFailedDeploy(exec deploy.Executor, serverConfig *config.ServerConfig, servicePath string, previousRelease string, failure string, failureErr error, restart bool) error {
+	name := c.projectConfig.Name
+	if previousRelease == "" {
+		return fmt.Errorf("%s failed and no previous release of service %s exists to restore: %w", failure, name, failureErr)
+	}
+
+	releases, err := release.ListReleases(exec, servicePath)
+	if err != nil {
+		return fmt.Errorf("%s failed (%w) and listing releases to restore failed: %w", failure, failureErr, err)
+	}
+	target, err := release.FindRollbackTarget(releases, previousRelease, previousRelease)
+	if err != nil {
+		return fmt.Errorf("%s failed (%w) and finding the previous release failed: %w", failure, failureErr, err)
 	}
-	sshExecutor, err := executor.NewSSHExecutor(REMOTE_SERVER_NAME, hostname, c.sshUsername, c.sshKeyFilePath, sshKeyFilePassphrase, runElevated)
+
+	slog.Warn("deploy failed; restoring previous release", "name", name, "failure", failure, "target-release", target.ID, "err", failureErr)
+	if err := c.restoreRelease(exec, serverConfig, servicePath, target, restart); err != nil {
+		return fmt.Errorf("%s failed (%w) and restoring release %s failed: %w", failure, failureErr, target.ID, err)
+	}
+	return fmt.Errorf("%s failed; restored release %s: %w", failure, target.ID, failureErr)
+}
+
+// Backs up the service as it is before the deploy into the project's backup directory, if
+// it has been deployed to the server. The passphrase for included secrets must be set in the
+// environment, since targets may be deployed to in parallel.
+func (c *DeployCommand) backupBeforeDeploy(exec deploy.Executor, t *ServerTarget) error {
+	// The server config is only read, since it is created by the deploy if missing
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("(test -f %s && echo 'exists') || echo 'not-exists'", utils.ShellQuote(install.DefaultConfigFilePath)))
+	if err != nil {
+		return fmt.Errorf("[%s] failed to check for server config file %s: %w", exec.Name(), install.DefaultConfigFilePath, err)
+	}
+	deployed := false
+	if strings.TrimSpace(stdout) == "exists" {
+		serverConfig, err := config.LoadServerConfig(exec, install.DefaultConfigFilePath, false)
+		if err != nil {
+			return err
+		}
+		_, deployed = serverConfig.Services[c.projectConfig.Name]
+	}
+	if !deployed {
+		slog.Info("service not yet deployed; skipping backup", "name", c.projectConfig.Name, "server", t.Server)
+		return nil
+	}
+
+	backupDir := c.projectConfig.Backup.GetDir()
+	if !filepath.IsAbs(backupDir) {
+		backupDir = filepath.Join(c.projectDir, backupDir)
+	}
+	name := fmt.Sprintf("%s-%s", c.projectConfig.Name, t.Server)
+	outPath := filepath.Join(backupDir, backup.GetArchiveName(name, time.Now()))
+	if err := takeBackup(exec, t.Hostname, t.SshUsername, t.SshKeyFilePath, c.projectConfig.Name, outPath, false); err != nil {
+		return fmt.Errorf("failed to back up service: %w", err)
+	}
+	return nil
+}
+
+// Moves the service from its active color to the other one & records the new active color
+// in its config.json.
+func (c *DeployCommand) switchColor(exec deploy.Executor, serverConfig *config.ServerConfig, serviceDefn *service.ServiceDefinition) error {
+	activeColor, err := bluegreen.Switch(exec, c.blueGreenService(serviceDefn.Path), serviceDefn.ServiceConfig.ActiveColor, c.dryRun)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		return nil
+	}
+	serviceDefn.ServiceConfig.ActiveColor = activeColor
+	serverConfig.Services[c.projectConfig.Name] = serviceDefn.Path
+	return serverConfig.SaveServiceConfig(exec, c.projectConfig.Name, serviceDefn.ServiceConfig)
+}
+
+func (c *DeployCommand) blueGreenService(servicePath string) *bluegreen.Service {
+	return &bluegreen.Service{
+		Name:        c.projectConfig.Name,
+		Path:        servicePath,
+		Config:      c.projectConfig.BlueGreen,
+		HealthCheck: c.projectConfig.HealthCheck,
+		Env:         c.projectConfig.Env,
+	}
+}
+
+// Builds the manifest syncing the assets to the server over sshExecutor, which is left open
+// once the manifest is run.
+func buildManifest(t *ServerTarget, assets []*deploy.ProviderConfig, sshExecutor deploy.Executor) (*manifest.Manifest, error) {
+	transport, err := buildTransport(t)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build SSH executor: %w", err)
+		return nil, fmt.Errorf("failed to build transport: %w", err)
 	}
 	m := &manifest.Manifest{
-		Transport: transport.NewS3Transport("smt", "s3://quemot-dev-bucket/smt"),
+		Transport: transport,
 		Executors: map[string]deploy.Executor{
 			LOCAL_SERVER_NAME:  executor.NewLocalExecutor("local"),
-			REMOTE_SERVER_NAME: sshExecutor,
+			REMOTE_SERVER_NAME: &sharedExecutor{sshExecutor},
 		},
 		Providers: assets,
 	}
 	return m, nil
 }
 
-func buildAssets(serviceDefn *service.ServiceDefinition, c *project.ProjectConfig, force bool) ([]*deploy.ProviderConfig, error) {
+// Executor whose connection outlives the manifest it is in, which the runner closes once run
+type sharedExecutor struct {
+	deploy.Executor
+}
+
+func (e *sharedExecutor) Close() {}
+
+func buildTransport(t *ServerTarget) (deploy.Transport, error) {
+	switch t.Transport {
+	case config.TransportS3:
+		return transport.NewS3Transport("smt-s3", t.S3BaseUrl), nil
+	case config.TransportScp:
+		return transport.NewScpTransport("smt-scp", t.Hostname, t.SshUsername, t.SshKeyFilePath, "")
+	default:
+		return nil, fmt.Errorf("unsupported transport: %s", t.Transport)
+	}
+}
+
+func buildImagesProvider(c *DeployCommand, t *ServerTarget) deploy.Provider {
+	name, images, compareLabel := project.AssetDockerImages, c.projectConfig.ImageNames, c.projectConfig.ImageCompareLabel
+	switch c.imageTransfer {
+	case project.ImageTransferRegistry:
+		return registry.NewPullProvider(name, c.registryImages)
+	case project.ImageTransferStream:
+		return imagestream.NewDockerStreamProvider(name, images, compareLabel, t.Hostname, t.SshUsername, t.SshKeyFilePath, "")
+	default:
+		return &digestedProvider{provider.NewDockerProvider(name, images, compareLabel), digestImages(images)}
+	}
+}
+
+// Creates a file provider from deploy-assets that can digest the files it syncs.
+func newFileProvider(name string, srcDir string, srcPath string, dstPath string, recursive bool, force bool) deploy.Provider {
+	return &digestedProvider{
+		provider.NewFileProvider(name, srcDir, srcPath, dstPath, recursive, force),
+		func(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+			srcDigest, err := plan.HashLocalFiles(filepath.Join(srcDir, srcPath))
+			if err != nil {
+				return nil, err
+			}
+			dstDigest, err := plan.HashRemoteFiles(dst, dstPath)
+			if err != nil {
+				return nil, err
+			}
+			return &plan.Digest{Src: srcDigest, Dst: dstDigest}, nil
+		},
+	}
+}
+
+// Digests the named images on both sides of a sync.
+func digestImages(images []string) func(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+	return func(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+		srcDigest, err := plan.HashImages(src, images)
+		if err != nil {
+			return nil, err
+		}
+		dstDigest, err := plan.HashImages(dst, images)
+		if err != nil {
+			return nil, err
+		}
+		return &plan.Digest{Src: srcDigest, Dst: dstDigest}, nil
+	}
+}
+
+// Builds the assets deployed for the project. previousConfig is the service config deployed
+// before this deploy, so that nginx sites & systemd units no longer in the project are removed.
+// registryImages, if any, are pinned in the deployed docker-compose file.
+func buildAssets(serviceDefn *service.ServiceDefinition, c *project.ProjectConfig, force bool, imagesProvider deploy.Provider, registryImages []*registry.Image, previousConfig *service.ServiceConfig) ([]*deploy.ProviderConfig, error) {
 	remoteDir := serviceDefn.Path
 	assets := []*deploy.ProviderConfig{}
+	dockerComposeProvider := newFileProvider(project.AssetDockerComposeFile, c.ProjectDir, c.DockerComposePath, filepath.Join(remoteDir, "docker-compose.yml"), false, force)
+	if len(registryImages) > 0 {
+		contents, err := os.ReadFile(filepath.Join(c.ProjectDir, c.DockerComposePath))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read docker-compose file %s: %w", c.DockerComposePath, err)
+		}
+		pinned, unused := registry.PinComposeImages(string(contents), registryImages)
+		if len(unused) > 0 {
+			slog.Warn("images not used by any service in docker-compose file; they are pulled but not pinned", "path", c.DockerComposePath, "images", unused)
+		}
+		dockerComposeProvider = content.NewContentProvider(project.AssetDockerComposeFile, pinned, filepath.Join(remoteDir, "docker-compose.yml"))
+	}
 	dockerComposeAsset := &deploy.ProviderConfig{
-		Provider:     provider.NewFileProvider("docker-compose-file", c.ProjectDir, c.DockerComposePath, filepath.Join(remoteDir, "docker-compose.yml"), false, force),
+		Provider:     dockerComposeProvider,
 		Src:          LOCAL_SERVER_NAME,
 		Dst:          REMOTE_SERVER_NAME,
 		PostCommands: []*deploy.PostCommand{},
 	}
 	assets = append(assets, dockerComposeAsset)
 
-	remoteSystemctlDir := filepath.Join(remoteDir, "systemctl")
-	// enableSystemctlServicesCommand := fmt.Sprintf("systemctl enable %s --now && systemctl enable %s --now",
-	// 	filepath.Join(remoteSystemctlDir, "*.service"),
-	// 	filepath.Join(remoteSystemctlDir, "*.timer"))
-	// TODO: Make this smarter, and abstract out service registration
-	enableSystemctlServicesCommand := fmt.Sprintf("systemctl enable %s --now",
-		filepath.Join(remoteSystemctlDir, "*.service"))
-	systemctlInstallFilesAsset := &deploy.ProviderConfig{
-		Provider: provider.NewFileProvider("systemctl-install-files", c.ProjectDir, c.SystemctlFilesDir, remoteSystemctlDir, true, force),
-		Src:      LOCAL_SERVER_NAME,
-		Dst:      REMOTE_SERVER_NAME,
-		PostCommands: []*deploy.PostCommand{
-			{
-				Command: enableSystemctlServicesCommand,
-				Trigger: "on_changed",
-			},
-		},
+	units, err := readSystemdUnits(c)
+	if err != nil {
+		return nil, err
+	}
+	serviceDefn.ServiceConfig.SystemdUnits = utils.Map(units, func(u *systemd.Unit) string { return u.Name })
+	if len(units) > 0 || len(previousConfig.SystemdUnits) > 0 {
+		systemdUnitsAsset := &deploy.ProviderConfig{
+			Provider:     systemd.NewUnitsProvider(project.AssetSystemdUnits, units, previousConfig.SystemdUnits, service.GetSystemdUnitDir(remoteDir)),
+			Src:          LOCAL_SERVER_NAME,
+			Dst:          REMOTE_SERVER_NAME,
+			PostCommands: []*deploy.PostCommand{},
+		}
+		assets = append(assets, systemdUnitsAsset)
 	}
-	assets = append(assets, systemctlInstallFilesAsset)
 
-	systemctlServiceName := fmt.Sprintf("%s.service", c.Name)
+	// In blue/green mode deploy starts a new color instead of restarting the service
+	restartCommands := []*deploy.PostCommand{}
+	if c.BlueGreen == nil {
+		restartCommands = append(restartCommands, &deploy.PostCommand{
+			Command: fmt.Sprintf("systemctl restart %s.service", c.Name),
+			Trigger: "on_changed",
+		})
+	}
 	dockerImagesAsset := &deploy.ProviderConfig{
-		Provider: provider.NewDockerProvider("docker-images", c.ImageNames, c.ImageCompareLabel),
-		Src:      LOCAL_SERVER_NAME,
-		Dst:      REMOTE_SERVER_NAME,
-		PostCommands: []*deploy.PostCommand{
-			{
-				Command: fmt.Sprintf("systemctl restart %s", systemctlServiceName),
-				Trigger: "on_changed",
-			},
-		},
+		Provider:     imagesProvider,
+		Src:          LOCAL_SERVER_NAME,
+		Dst:          REMOTE_SERVER_NAME,
+		PostCommands: restartCommands,
 	}
 	assets = append(assets, dockerImagesAsset)
 
-	if c.NginxConfFiles != nil {
-		remoteNginxSitesAvailable := "/etc/nginx/sites-available"
-		remoteNginxSitesEnabled := "/etc/nginx/sites-enabled"
-
-		// Do a separate asset for each conf file to properly handle the automatic linking
-		// from sites-available to sites-enabled without knowing anything about the filenames
-		for i, f := range c.NginxConfFiles {
-			remoteAvailablePath := filepath.Join(remoteNginxSitesAvailable, filepath.Base(f))
-			remoteEnabledPath := filepath.Join(remoteNginxSitesEnabled, filepath.Base(f))
-			confFileAsset := &deploy.ProviderConfig{
-				Provider: provider.NewFileProvider(fmt.Sprintf("nginx-conf-files-%02d", i+1), c.ProjectDir, f, remoteAvailablePath, false, force),
-				Src:      LOCAL_SERVER_NAME,
-				Dst:      REMOTE_SERVER_NAME,
-				PostCommands: []*deploy.PostCommand{
-					{
-						// TODO: Real escaping, probably
-						Command: fmt.Sprintf("ln -s '%s' '%s'",
-							remoteAvailablePath,
-							remoteEnabledPath),
-						Trigger: "on_created",
-					},
-					{
-						Command: "nginx -t && nginx -s reload",
-						Trigger: "on_changed",
-					},
+	nginxSites := []*nginx.Site{}
+	for _, f := range c.NginxConfFiles {
+		contents, err := os.ReadFile(filepath.Join(c.ProjectDir, f))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read nginx conf file %s: %w", f, err)
+		}
+		nginxSites = append(nginxSites, &nginx.Site{Name: filepath.Base(f), Contents: string(contents)})
+	}
+	// A hand-written conf file for the project's site takes precedence over generating one
+	generatedSiteName := project.GetGeneratedNginxSiteName(c.Name)
+	if c.Nginx != nil && slices.ContainsFunc(nginxSites, func(s *nginx.Site) bool { return s.Name == generatedSiteName }) {
+		slog.Debug("using hand-written nginx conf instead of generating one", "site", generatedSiteName)
+	} else if c.Nginx != nil {
+		var upstream *nginx.Upstream
+		if c.BlueGreen != nil {
+			upstream = bluegreen.GetUpstream(c.Name, remoteDir)
+		}
+		contents, err := nginx.GenerateSite(c.Nginx, c.Env, upstream)
+		if err != nil {
+			return nil, err
+		}
+		nginxSites = append(nginxSites, &nginx.Site{Name: generatedSiteName, Contents: contents})
+	}
+	serviceDefn.ServiceConfig.NginxSites = utils.Map(nginxSites, func(s *nginx.Site) string { return s.Name })
+	if len(nginxSites) > 0 || len(previousConfig.NginxSites) > 0 {
+		nginxSitesAsset := &deploy.ProviderConfig{
+			Provider: nginx.NewSitesProvider(project.AssetNginxSites, nginxSites, previousConfig.NginxSites, filepath.Join(remoteDir, NginxBackupDirName)),
+			Src:      LOCAL_SERVER_NAME,
+			Dst:      REMOTE_SERVER_NAME,
+			PostCommands: []*deploy.PostCommand{
+				{
+					Command: nginx.ReloadCommand,
+					Trigger: "on_changed",
 				},
-			}
-			assets = append(assets, confFileAsset)
+			},
 		}
+		assets = append(assets, nginxSitesAsset)
+	}
+
+	envFileAsset := &deploy.ProviderConfig{
+		Provider:     content.NewContentProvider(project.AssetEnvFile, project.RenderEnvFile(c.Env), filepath.Join(remoteDir, project.EnvFileName)),
+		Src:          LOCAL_SERVER_NAME,
+		Dst:          REMOTE_SERVER_NAME,
+		PostCommands: restartCommands,
 	}
+	assets = append(assets, envFileAsset)
 
 	serviceConfigJson, err := json.MarshalIndent(serviceDefn.ServiceConfig, "", "\t")
 	if err != nil {
@@ -296,22 +1254,63 @@ func buildAssets(serviceDefn *service.ServiceDefinition, c *project.ProjectConfi
 	}
 	serviceConfigPath := service.GetDefaultConfigPath(serviceDefn.Path)
 	serviceConfigAsset := &deploy.ProviderConfig{
-		Provider:     provider.NewLiteralProvider("service-config-json", string(serviceConfigJson), serviceConfigPath),
+		Provider:     content.NewContentProvider(project.AssetServiceConfigJson, string(serviceConfigJson), serviceConfigPath),
 		Src:          LOCAL_SERVER_NAME,
 		Dst:          REMOTE_SERVER_NAME,
 		PostCommands: []*deploy.PostCommand{},
 	}
 	assets = append(assets, serviceConfigAsset)
 
+	assetVars := &project.AssetVars{ServiceDir: serviceDefn.Path, Name: c.Name, Environment: c.Environment}
 	for _, a := range c.AdditionalAssets {
+		postCommands := []*deploy.PostCommand{}
+		for _, cmd := range a.GetPostCommands(assetVars) {
+			postCommands = append(postCommands, &deploy.PostCommand{Command: cmd, Trigger: "on_changed"})
+		}
 		additionalAsset := &deploy.ProviderConfig{
-			Provider:     provider.NewFileProvider(a.Name, c.ProjectDir, a.SrcPath, a.DstPath, a.Recursive, a.Force),
+			Provider:     newFileProvider(a.Name, c.ProjectDir, a.SrcPath, a.GetDstPath(assetVars), a.Recursive, a.Force),
 			Src:          LOCAL_SERVER_NAME,
 			Dst:          REMOTE_SERVER_NAME,
-			PostCommands: []*deploy.PostCommand{},
+			PostCommands: postCommands,
 		}
 		assets = append(assets, additionalAsset)
 	}
 
 	return assets, nil
 }
+
+// Reads the unit files at the top level of the project's systemd unit directory.
+func readSystemdUnits(c *project.ProjectConfig) ([]*systemd.Unit, error) {
+	units := []*systemd.Unit{}
+	if c.SystemctlFilesDir == "" {
+		return units, nil
+	}
+	unitDir := filepath.Join(c.ProjectDir, c.SystemctlFilesDir)
+	entries, err := os.ReadDir(unitDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read systemd unit directory %s: %w", unitDir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			slog.Warn("skipping directory in systemd unit directory", "path", filepath.Join(unitDir, e.Name()))
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(unitDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read systemd unit %s: %w", e.Name(), err)
+		}
+		units = append(units, &systemd.Unit{Name: e.Name(), Contents: string(contents)})
+	}
+	return units, nil
+}
+
+func buildBackupSpec(c *project.ProjectConfig) *service.BackupSpec {
+	spec := &service.BackupSpec{DataDirs: c.Backup.GetDataDirs()}
+	if c.Backup != nil {
+		spec.Volumes = c.Backup.Volumes
+		if c.Backup.IncludeSecrets {
+			spec.SecretsVolume = c.DockerSecretsVolume
+		}
+	}
+	return spec
+}
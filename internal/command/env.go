@@ -0,0 +1,278 @@
+package command
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/install"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/sshclient"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+type EnvCommandSpec struct {
+	Args []string
+}
+
+type EnvAction int
+
+const (
+	ListEnv EnvAction = iota
+	SetEnv
+	UnsetEnv
+)
+
+type EnvCommand struct {
+	projectConfig  *project.ProjectConfig
+	name           string
+	valueSet       bool
+	value          string
+	action         EnvAction
+	hostname       string
+	sshKeyFilePath string
+	sshUsername    string
+}
+
+func (s *EnvCommandSpec) Build() (Command, error) {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	fs.SetOutput(&EmptyWriter{})
+
+	pathParam := fs.String(
+		"path",
+		"",
+		"Path to the project. Defaults to current working directory.",
+	)
+	listParam := fs.Bool(
+		"list",
+		false,
+		"(action) (default) List the project's env values alongside those deployed to the server",
+	)
+	setParam := fs.Bool(
+		"set",
+		false,
+		"(action) Set an env value in the project config",
+	)
+	unsetParam := fs.Bool(
+		"unset",
+		false,
+		"(action) Remove an env value from the project config",
+	)
+	nameParam := fs.String(
+		"name",
+		"",
+		"Name of the env value to show/modify (if relevant)",
+	)
+	valueParam := fs.String(
+		"value",
+		"",
+		"Value to set (if relevant)",
+	)
+
+	serverConfigFlags := UseServerConfigFlags(fs, "hostname", "ssh-username", "ssh-key-file")
+	envParam := UseEnvironmentFlag(fs)
+
+	debugParam := fs.Bool("debug", false, "Set log level to debug")
+
+	if err := fs.Parse(s.Args); err != nil {
+		if err != flag.ErrHelp {
+			utils.PrintErrf("error: %v\n", err)
+		}
+		fs.SetOutput(nil)
+		fs.Usage()
+		return nil, err
+	}
+
+	if *debugParam {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	} else {
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	}
+
+	path := *pathParam
+	if path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cwd: %w", err)
+		}
+		path = wd
+	}
+	projectConfigPath, err := project.GetProjectConfigPath(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("project path '%s' is not a %s file nor does it contain one", path, project.ProjectConfigName)
+		}
+		return nil, err
+	}
+
+	projectConfig, err := project.LoadProjectConfigForEnvironment(projectConfigPath, *envParam)
+	if err != nil {
+		return nil, err
+	}
+
+	actionParams := map[EnvAction]bool{
+		ListEnv:  *listParam,
+		SetEnv:   *setParam,
+		UnsetEnv: *unsetParam,
+	}
+
+	var actions []EnvAction
+	for k, v := range actionParams {
+		if v {
+			actions = append(actions, k)
+		}
+	}
+
+	if len(actions) > 1 {
+		return nil, fmt.Errorf("multiple actions specified; please specify at most one")
+	}
+
+	var action EnvAction
+	if len(actions) == 0 {
+		action = ListEnv
+	} else {
+		action = actions[0]
+	}
+
+	name := *nameParam
+	if name == "" && (action == SetEnv || action == UnsetEnv) {
+		return nil, fmt.Errorf("env name required for specified action")
+	}
+	if name != "" && !project.ValidateEnvNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid env name %s (must match /%s/)", name, project.ValidateEnvNamePatternString)
+	}
+
+	valueSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "value" {
+			valueSet = true
+		}
+	})
+
+	cmd := &EnvCommand{
+		projectConfig: projectConfig,
+		name:          name,
+		valueSet:      valueSet,
+		value:         *valueParam,
+		action:        action,
+	}
+
+	// Only listing compares against the server; changes are applied on the next deploy
+	if action == ListEnv {
+		ApplyEnvironmentServer(serverConfigFlags, projectConfig)
+		if err := ValidateServerConfigFlags(serverConfigFlags); err != nil {
+			return nil, err
+		}
+		cmd.hostname = *serverConfigFlags.Hostname
+		cmd.sshUsername = *serverConfigFlags.SshUsername
+		cmd.sshKeyFilePath = *serverConfigFlags.SshKeyFilePath
+	}
+
+	return cmd, nil
+}
+
+func (c *EnvCommand) Invoke() error {
+	switch c.action {
+	case ListEnv:
+		remoteEnv, err := c.loadRemoteEnv()
+		if err != nil {
+			return err
+		}
+
+		names := utils.Keys(c.projectConfig.Env)
+		for k := range remoteEnv {
+			if _, prs := c.projectConfig.Env[k]; !prs {
+				names = append(names, k)
+			}
+		}
+		if c.name != "" {
+			names = utils.Filter(names, func(n string) bool { return n == c.name })
+		}
+		slices.Sort(names)
+
+		values := []map[string]string{}
+		for _, n := range names {
+			localValue, localPrs := c.projectConfig.Env[n]
+			remoteValue, remotePrs := remoteEnv[n]
+			var status string
+			switch {
+			case !remotePrs:
+				status = "local only"
+			case !localPrs:
+				status = "remote only"
+			case localValue != remoteValue:
+				status = "changed"
+			default:
+				status = "same"
+			}
+			values = append(values, map[string]string{
+				"NAME":   n,
+				"LOCAL":  localValue,
+				"REMOTE": remoteValue,
+				"STATUS": status,
+			})
+		}
+		fmt.Println(utils.BuildTable([]string{"NAME", "LOCAL", "REMOTE", "STATUS"}, values))
+	case SetEnv:
+		value := c.value
+		if !c.valueSet {
+			input, err := promptForInput("Enter value: ", false)
+			if err != nil {
+				return err
+			}
+			value = input
+		}
+		if err := c.projectConfig.SetEnvVar(c.name, value); err != nil {
+			return err
+		}
+		if err := project.SaveProjectConfig(c.projectConfig); err != nil {
+			return fmt.Errorf("failed to save project config with updated env: %w", err)
+		}
+		slog.Info("env value set in project config; deploy to apply it", "name", c.name)
+	case UnsetEnv:
+		if _, prs := c.projectConfig.Env[c.name]; !prs {
+			slog.Warn("env value not present in project config; skipping removal", "name", c.name)
+			return nil
+		}
+		if err := c.projectConfig.UnsetEnvVar(c.name); err != nil {
+			return err
+		}
+		if err := project.SaveProjectConfig(c.projectConfig); err != nil {
+			return fmt.Errorf("failed to save project config with updated env: %w", err)
+		}
+		slog.Info("env value removed from project config; deploy to apply it", "name", c.name)
+	}
+	return nil
+}
+
+// Reads the env file deployed for the project, or an empty set of values if the project has
+// not been deployed to the server.
+func (c *EnvCommand) loadRemoteEnv() (map[string]string, error) {
+	sshExecutor, err := sshclient.CreateSshExecutor(c.hostname, c.sshUsername, c.sshKeyFilePath, "")
+	if err != nil {
+		return nil, err
+	}
+	defer sshExecutor.Close()
+
+	serverConfig, err := config.LoadServerConfig(sshExecutor, install.DefaultConfigFilePath, false)
+	if err != nil {
+		return nil, err
+	}
+	servicePath, prs := serverConfig.Services[c.projectConfig.Name]
+	if !prs {
+		slog.Warn("service not deployed to server; no remote env values", "name", c.projectConfig.Name, "server", c.hostname)
+		return map[string]string{}, nil
+	}
+
+	envFilePath := filepath.Join(servicePath, project.EnvFileName)
+	stdout, _, err := sshExecutor.ExecuteShell(fmt.Sprintf("test -f '%s' && cat '%s'; true", envFilePath, envFilePath))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to read env file %s: %w", sshExecutor.Name(), envFilePath, err)
+	}
+	return project.ParseEnvFile(stdout)
+}
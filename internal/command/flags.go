@@ -1,11 +1,15 @@
 package command
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"slices"
+	"strings"
 
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
 )
 
 type ServerConfigFlags struct {
@@ -14,6 +18,13 @@ type ServerConfigFlags struct {
 	Hostname       *string
 	SshUsername    *string
 	SshKeyFilePath *string
+
+	entry *config.ClientServerConfigEntry
+}
+
+type TransportFlags struct {
+	Transport *string
+	S3BaseUrl *string
 }
 
 func UseServerConfigFlags(fs *flag.FlagSet, include ...string) *ServerConfigFlags {
@@ -53,21 +64,155 @@ func UseServerConfigFlags(fs *flag.FlagSet, include ...string) *ServerConfigFlag
 	return flags
 }
 
+type ServerTarget struct {
+	Server         string
+	Hostname       string
+	SshUsername    string
+	SshKeyFilePath string
+	Transport      string
+	S3BaseUrl      string
+}
+
+// Resolves the name of the service a command acts on. If env is given, the project at path
+// (the working directory by default) is loaded for that environment: its server is applied
+// to the server flags and its name is used if name is empty.
+func ResolveServiceName(name string, env string, path string, s *ServerConfigFlags) (string, error) {
+	if env == "" {
+		return name, nil
+	}
+	if path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get cwd: %w", err)
+		}
+		path = wd
+	}
+	projectConfigPath, err := project.GetProjectConfigPath(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("project path '%s' is not a %s file nor does it contain one", path, project.ProjectConfigName)
+		}
+		return "", err
+	}
+	projectConfig, err := project.LoadProjectConfigForEnvironment(projectConfigPath, env)
+	if err != nil {
+		return "", err
+	}
+	ApplyEnvironmentServer(s, projectConfig)
+	if name == "" {
+		name = projectConfig.Name
+	}
+	return name, nil
+}
+
 func ValidateServerConfigFlags(s *ServerConfigFlags) error {
+	cfg, err := loadClientConfigFromFlags(s)
+	if err != nil {
+		return err
+	}
+	return validateServerConfigFlags(cfg, s)
+}
+
+// Resolves the -server flag into one or more deploy targets. The flag may contain a
+// comma-separated list of server and group names; groups are expanded into their members
+// and duplicates are dropped. Each target is validated as with ValidateServerConfigFlags
+// and ValidateTransportFlags.
+func ResolveServerTargets(s *ServerConfigFlags, t *TransportFlags) ([]*ServerTarget, error) {
+	cfg, err := loadClientConfigFromFlags(s)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, n := range strings.Split(*s.Server, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		members, isGroup := cfg.Groups[n]
+		if !isGroup {
+			members = []string{n}
+		}
+		for _, m := range members {
+			if !slices.Contains(names, m) {
+				names = append(names, m)
+			}
+		}
+	}
+	if len(names) == 0 {
+		// Fall back to the default server
+		names = []string{""}
+	}
+
+	if len(names) > 1 && ((s.Hostname != nil && *s.Hostname != "") ||
+		(s.SshUsername != nil && *s.SshUsername != "") ||
+		(s.SshKeyFilePath != nil && *s.SshKeyFilePath != "")) {
+		return nil, fmt.Errorf("connection overrides (-hostname, -ssh-username, -ssh-key-file) cannot be used with multiple servers")
+	}
+
+	targets := []*ServerTarget{}
+	for _, n := range names {
+		sCopy := copyServerConfigFlags(s)
+		*sCopy.Server = n
+		if err := validateServerConfigFlags(cfg, sCopy); err != nil {
+			return nil, err
+		}
+		tCopy := &TransportFlags{
+			Transport: copyStringFlag(t.Transport),
+			S3BaseUrl: copyStringFlag(t.S3BaseUrl),
+		}
+		if err := ValidateTransportFlags(tCopy, sCopy); err != nil {
+			return nil, err
+		}
+		targets = append(targets, &ServerTarget{
+			Server:         *sCopy.Server,
+			Hostname:       *sCopy.Hostname,
+			SshUsername:    *sCopy.SshUsername,
+			SshKeyFilePath: *sCopy.SshKeyFilePath,
+			Transport:      *tCopy.Transport,
+			S3BaseUrl:      *tCopy.S3BaseUrl,
+		})
+	}
+
+	return targets, nil
+}
+
+func copyServerConfigFlags(s *ServerConfigFlags) *ServerConfigFlags {
+	return &ServerConfigFlags{
+		ConfigPath:     copyStringFlag(s.ConfigPath),
+		Server:         copyStringFlag(s.Server),
+		Hostname:       copyStringFlag(s.Hostname),
+		SshUsername:    copyStringFlag(s.SshUsername),
+		SshKeyFilePath: copyStringFlag(s.SshKeyFilePath),
+	}
+}
+
+func copyStringFlag(f *string) *string {
+	if f == nil {
+		return nil
+	}
+	v := *f
+	return &v
+}
+
+func loadClientConfigFromFlags(s *ServerConfigFlags) (*config.ClientConfig, error) {
 	configPath := *s.ConfigPath
 	if configPath == "" {
 		defaultPath, err := config.GetDefaultClientConfigPath()
 		if err != nil {
-			return fmt.Errorf("could not get default config file path: %w", err)
+			return nil, fmt.Errorf("could not get default config file path: %w", err)
 		}
 		configPath = defaultPath
 	}
 
 	cfg, err := config.LoadClientConfig(configPath, true)
 	if err != nil {
-		return fmt.Errorf("failed to load config at %s: %w", configPath, err)
+		return nil, fmt.Errorf("failed to load config at %s: %w", configPath, err)
 	}
+	return cfg, nil
+}
 
+func validateServerConfigFlags(cfg *config.ClientConfig, s *ServerConfigFlags) error {
 	server := *s.Server
 
 	var serverConfig *config.ClientServerConfigEntry
@@ -84,6 +229,7 @@ func ValidateServerConfigFlags(s *ServerConfigFlags) error {
 		return fmt.Errorf("no server config exists for specified server %s", server)
 	}
 	serverConfig = serverCfg
+	s.entry = serverConfig
 
 	if s.Hostname != nil {
 		hostname := *s.Hostname
@@ -120,3 +266,79 @@ func ValidateServerConfigFlags(s *ServerConfigFlags) error {
 
 	return nil
 }
+
+func UseEnvironmentFlag(fs *flag.FlagSet) *string {
+	return fs.String(
+		"env",
+		"",
+		"Name of the environment in the project config to use. Its overrides are applied on top of the top-level config, and its server is used if -server is not provided.",
+	)
+}
+
+func UseBreakLockFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool(
+		"break-lock",
+		false,
+		"Remove any lock held on the service by another command before proceeding. Only use this if the holder is known to have stopped.",
+	)
+}
+
+// Defaults the -server flag to the server declared by the project's active environment.
+func ApplyEnvironmentServer(s *ServerConfigFlags, projectConfig *project.ProjectConfig) {
+	if *s.Server == "" && projectConfig.EnvironmentServer != "" {
+		*s.Server = projectConfig.EnvironmentServer
+	}
+}
+
+func UseTransportFlags(fs *flag.FlagSet) *TransportFlags {
+	flags := &TransportFlags{}
+	flags.Transport = fs.String(
+		"transport",
+		"",
+		fmt.Sprintf("Transport to use for transfers to remote servers (one of: %s). Overrides property in config; defaults to %s.",
+			strings.Join(config.SupportedTransports, ", "),
+			config.DefaultTransport),
+	)
+	flags.S3BaseUrl = fs.String(
+		"s3-base-url",
+		"",
+		"Base S3 URL to use for transfers to remote servers when using the s3 transport. Overrides property in config.",
+	)
+	return flags
+}
+
+// Resolves the transport flags against the server entry resolved by ValidateServerConfigFlags,
+// which must be called first.
+func ValidateTransportFlags(t *TransportFlags, s *ServerConfigFlags) error {
+	if s.entry == nil {
+		return fmt.Errorf("server config flags must be validated before transport flags")
+	}
+
+	transport := *t.Transport
+	if transport == "" {
+		transport = s.entry.Transport
+		if transport == "" {
+			transport = config.DefaultTransport
+		}
+	}
+	if !slices.Contains(config.SupportedTransports, transport) {
+		return fmt.Errorf("invalid transport: '%s' (must be one of: %s)", transport, strings.Join(config.SupportedTransports, ", "))
+	}
+	*t.Transport = transport
+
+	s3BaseUrl := *t.S3BaseUrl
+	if s3BaseUrl == "" {
+		s3BaseUrl = s.entry.S3BaseUrl
+	}
+	if transport == config.TransportS3 {
+		if s3BaseUrl == "" {
+			return fmt.Errorf("no S3 base URL specified for server %s - required for the %s transport", *s.Server, transport)
+		}
+		if !strings.HasPrefix(s3BaseUrl, "s3://") {
+			return fmt.Errorf("invalid S3 base URL: '%s' (must start with 's3://')", s3BaseUrl)
+		}
+	}
+	*t.S3BaseUrl = s3BaseUrl
+
+	return nil
+}
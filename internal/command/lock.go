@@ -0,0 +1,44 @@
+package command
+
+import (
+	"log/slog"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/install"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/lock"
+
+	serverconfig "github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
+)
+
+// Releases a service lock at the end of a command. Failing to release is only logged, since
+// the command itself has already finished & the lock will eventually expire.
+func releaseLock(exec deploy.Executor, l *lock.Lock) {
+	if err := l.Release(exec); err != nil {
+		slog.Warn("failed to release service lock; it will expire on its own or can be removed with -break-lock", "name", l.Service, "err", err)
+	}
+}
+
+// Applies update to the server config as it is on the server now & saves it, holding the
+// server config lock. Only the service lock is held for the rest of a command, so the config
+// read at its start may since have been changed for other services; re-reading keeps their
+// entries. serverConfig is replaced with the saved config. If update fails nothing is saved.
+func updateServerConfig(exec deploy.Executor, serverConfig *serverconfig.ServerConfig, operation string, update func(c *serverconfig.ServerConfig) error) error {
+	l, err := lock.AcquireServerConfig(exec, operation)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(exec, l)
+
+	current, err := serverconfig.LoadServerConfig(exec, install.DefaultConfigFilePath, true)
+	if err != nil {
+		return err
+	}
+	if err := update(current); err != nil {
+		return err
+	}
+	if err := serverconfig.SaveServerConfig(exec, install.DefaultConfigFilePath, current); err != nil {
+		return err
+	}
+	*serverConfig = *current
+	return nil
+}
@@ -178,6 +178,10 @@ func (c *NewCommand) Invoke() error {
 		dockerSecretsVolume := fmt.Sprintf("%s-secrets", c.name)
 		hostname := fmt.Sprintf("%s.%s", c.name, domain)
 		systemctlServiceName := fmt.Sprintf("%s.service", c.name)
+		apiPortDefault := "8080"
+		if apiPortOverride, prs := c.varOverrides["API_PORT_DEFAULT"]; prs {
+			apiPortDefault = apiPortOverride
+		}
 		variables := map[string]file.VariableValue{
 			"NEW_GUID()":        file.VarFunc(func() string { return uuid.NewString() }),
 			"NAME":              file.VarValue(c.name),
@@ -185,7 +189,7 @@ func (c *NewCommand) Invoke() error {
 			"DOCKER_IMAGE_NAME": file.VarValue(dockerImageName),
 			"HOSTNAME":          file.VarValue(hostname),
 			"ENVVAR_PREFIX":     file.VarValue(envVarPrefix),
-			"API_PORT_DEFAULT":  file.VarValue("8080"),
+			"API_PORT_DEFAULT":  file.VarValue(apiPortDefault),
 		}
 		for k, v := range c.varOverrides {
 			variables[k] = file.VarValue(v)
@@ -221,6 +225,8 @@ func (c *NewCommand) Invoke() error {
 		// TODO: Figure out what to do with the project config path here.
 		// It's awkward that it's embedded in the struct.
 		projectConfigPath := filepath.Join(c.path, "smt.json")
+		// The service's unit runs the compose file, which blue/green deploys do themselves;
+		// adding blue_green means removing install/NAME.service & the start/stop commands
 		projectConfig := &project.ProjectConfig{
 			ProjectConfigPath:   projectConfigPath,
 			Name:                c.name,
@@ -237,8 +243,16 @@ func (c *NewCommand) Invoke() error {
 				"restart": fmt.Sprintf("systemctl restart %s", systemctlServiceName),
 				"status":  fmt.Sprintf("systemctl status %s", systemctlServiceName),
 			},
-			Secrets:          []string{},
-			Env:              map[string]string{},
+			Secrets: []string{},
+			Env: map[string]string{
+				project.ApiPortEnvName: apiPortDefault,
+			},
+			Nginx: &project.NginxConfig{
+				ServerNames:     []string{hostname},
+				Routes:          []*project.NginxRoute{{Path: "/"}},
+				Tls:             true,
+				RedirectToHttps: true,
+			},
 			AdditionalAssets: []project.AdditionalAsset{},
 		}
 
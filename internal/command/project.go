@@ -0,0 +1,140 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/preflight"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+type ProjectCommandSpec struct {
+	Args []string
+}
+
+type ProjectAction int
+
+const (
+	CheckProject ProjectAction = iota
+)
+
+var (
+	ProjectActionNames map[string]ProjectAction = map[string]ProjectAction{
+		"check": CheckProject,
+	}
+)
+
+type ProjectCommand struct {
+	projectConfig *project.ProjectConfig
+	action        ProjectAction
+	json          bool
+}
+
+func (s *ProjectCommandSpec) Build() (Command, error) {
+	if len(s.Args) == 0 || s.Args[0] == "-h" || s.Args[0] == "--help" {
+		utils.PrintErrln("smt project check <options>")
+		utils.PrintErrln("")
+		utils.PrintErrln("    Subcommands:")
+		utils.PrintErrf("        check		Check the project's docker-compose file against its config\n")
+		return nil, flag.ErrHelp
+	}
+	action, prs := ProjectActionNames[s.Args[0]]
+	if !prs {
+		return nil, fmt.Errorf("unrecognized project subcommand %s", s.Args[0])
+	}
+
+	fs := flag.NewFlagSet("project", flag.ContinueOnError)
+	fs.SetOutput(&EmptyWriter{})
+
+	pathParam := fs.String(
+		"path",
+		"",
+		"Path to the project. Defaults to current working directory.",
+	)
+	envParam := UseEnvironmentFlag(fs)
+	jsonParam := fs.Bool("json", false, "Print the problems found as JSON")
+	debugParam := fs.Bool("debug", false, "Set log level to debug")
+
+	if err := fs.Parse(s.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			utils.PrintErrf("error: %v\n", err)
+		}
+		fs.SetOutput(nil)
+		fs.Usage()
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	if *debugParam {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	} else {
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	}
+
+	path := *pathParam
+	if path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cwd: %w", err)
+		}
+		path = wd
+	}
+	projectConfigPath, err := project.GetProjectConfigPath(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("project path '%s' is not a %s file nor does it contain one", path, project.ProjectConfigName)
+		}
+		return nil, err
+	}
+
+	projectConfig, err := project.LoadProjectConfigForEnvironment(projectConfigPath, *envParam)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProjectCommand{
+		projectConfig: projectConfig,
+		action:        action,
+		json:          *jsonParam,
+	}, nil
+}
+
+func (c *ProjectCommand) Invoke() error {
+	switch c.action {
+	case CheckProject:
+		return c.check()
+	default:
+		return fmt.Errorf("unsupported project action: %d", c.action)
+	}
+}
+
+func (c *ProjectCommand) check() error {
+	problems := preflight.Check(c.projectConfig)
+	if c.json {
+		problemsJson, err := json.MarshalIndent(problems, "", "\t")
+		if err != nil {
+			return fmt.Errorf("failed to serialize problems: %w", err)
+		}
+		fmt.Println(string(problemsJson))
+	} else if len(problems) > 0 {
+		values := []map[string]string{}
+		for _, p := range problems {
+			values = append(values, map[string]string{"CHECK": p.Check, "PROBLEM": p.Message})
+		}
+		fmt.Println(utils.BuildTable([]string{"CHECK", "PROBLEM"}, values))
+	} else {
+		fmt.Printf("No problems found in project %s\n", c.projectConfig.Name)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s) in project %s", len(problems), c.projectConfig.Name)
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/mrshanahan/go-utils/term"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/lock"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/secrets"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/sshclient"
@@ -46,6 +47,7 @@ type SecretsCommand struct {
 	hostname       string
 	sshKeyFilePath string
 	sshUsername    string
+	breakLock      bool
 }
 
 func (s *SecretsCommandSpec) Build() (Command, error) {
@@ -90,6 +92,9 @@ func (s *SecretsCommandSpec) Build() (Command, error) {
 	)
 
 	serverConfigFlags := UseServerConfigFlags(fs, "hostname", "ssh-username", "ssh-key-file")
+	envParam := UseEnvironmentFlag(fs)
+
+	breakLockParam := UseBreakLockFlag(fs)
 
 	debugParam := fs.Bool("debug", false, "Set log level to debug")
 
@@ -125,6 +130,12 @@ func (s *SecretsCommandSpec) Build() (Command, error) {
 		return nil, err
 	}
 
+	projectConfig, err := project.LoadProjectConfigForEnvironment(projectConfigPath, *envParam)
+	if err != nil {
+		return nil, err
+	}
+
+	ApplyEnvironmentServer(serverConfigFlags, projectConfig)
 	if err := ValidateServerConfigFlags(serverConfigFlags); err != nil {
 		return nil, err
 	}
@@ -169,11 +180,6 @@ func (s *SecretsCommandSpec) Build() (Command, error) {
 		}
 	})
 
-	projectConfig, err := project.LoadProjectConfig(projectConfigPath)
-	if err != nil {
-		return nil, err
-	}
-
 	if projectConfig.DockerSecretsVolume == "" {
 		return nil, fmt.Errorf("no Docker secrets volume specified for this project; add a docker_secrets_volume entry to %s and try again", projectConfigPath)
 	}
@@ -187,6 +193,7 @@ func (s *SecretsCommandSpec) Build() (Command, error) {
 		hostname:       *serverConfigFlags.Hostname,
 		sshKeyFilePath: *serverConfigFlags.SshKeyFilePath,
 		sshUsername:    *serverConfigFlags.SshUsername,
+		breakLock:      *breakLockParam,
 	}, nil
 }
 
@@ -196,6 +203,18 @@ func (c *SecretsCommand) Invoke() error {
 		return err
 	}
 
+	if c.action == SetSecret || c.action == RemoveSecret {
+		operation := "secrets -set"
+		if c.action == RemoveSecret {
+			operation = "secrets -remove"
+		}
+		l, err := lock.Acquire(sshExecutor, c.projectConfig.Name, operation, c.breakLock)
+		if err != nil {
+			return err
+		}
+		defer releaseLock(sshExecutor, l)
+	}
+
 	secretVolumeName := c.projectConfig.DockerSecretsVolume
 	secretsVolume, err := secrets.GetSecretsVolume(sshExecutor, secretVolumeName)
 	if err != nil {
@@ -230,7 +249,9 @@ func (c *SecretsCommand) Invoke() error {
 		fmt.Println(utils.BuildComparisonTable("LOCAL", localEntries, "REMOTE", remoteEntries))
 	case SetSecret:
 		if !slices.Contains(c.projectConfig.Secrets, c.name) {
-			c.projectConfig.Secrets = append(c.projectConfig.Secrets, c.name)
+			if err := c.projectConfig.SetSecrets(append(c.projectConfig.Secrets, c.name)); err != nil {
+				return err
+			}
 			if err := project.SaveProjectConfig(c.projectConfig); err != nil {
 				return fmt.Errorf("failed to save project config with updated secrets: %w", err)
 			}
@@ -279,7 +300,9 @@ func (c *SecretsCommand) Invoke() error {
 		if !slices.Contains(c.projectConfig.Secrets, c.name) {
 			slog.Warn("secret not present in project config - checking deployed service", "secret", c.name)
 		} else {
-			c.projectConfig.Secrets = utils.Filter(c.projectConfig.Secrets, func(s string) bool { return s != c.name })
+			if err := c.projectConfig.SetSecrets(utils.Filter(c.projectConfig.Secrets, func(s string) bool { return s != c.name })); err != nil {
+				return err
+			}
 			if err := project.SaveProjectConfig(c.projectConfig); err != nil {
 				return fmt.Errorf("failed to save project config with updated secrets: %w", err)
 			}
@@ -1,14 +1,27 @@
 package command
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/mrshanahan/deploy-assets/pkg/config"
 	"github.com/mrshanahan/deploy-assets/pkg/executor"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/certs"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/history"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/imageprune"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/install"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/lock"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/nginx"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/release"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/service"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/sshclient"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/systemd"
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
 
 	serverconfig "github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
@@ -26,6 +39,12 @@ type ServiceCommand struct {
 	sshKeyFilePath         string
 	sshUsername            string
 	remoteServiceDirectory string
+	breakLock              bool
+	json                   bool
+	dryRun                 bool
+	keep                   int
+	// Projects of the workspace given by -workspace, in dependency order
+	workspace []*project.ProjectConfig
 }
 
 type ServiceAction int
@@ -37,6 +56,9 @@ const (
 	RestartService
 	GetServiceStatus
 	RemoveService
+	ServiceHistory
+	ListCerts
+	PruneImages
 )
 
 var (
@@ -81,20 +103,64 @@ func (s *ServiceCommandSpec) Build() (Command, error) {
 	statusParam := fs.Bool(
 		"status",
 		false,
-		"(action) Gets the status of a service provided by -name",
+		"(action) Shows the state of each systemd unit of a service provided by -name",
 	)
 	removeParam := fs.Bool(
 		"remove",
 		false,
 		"(action) Removes a service provided by -name, noop if it doesn't exist",
 	)
+	historyParam := fs.Bool(
+		"history",
+		false,
+		"(action) Shows the deploy history of a service provided by -name",
+	)
+	certsParam := fs.Bool(
+		"certs",
+		false,
+		"(action) Lists the TLS certificate of each hostname on the server & when it expires",
+	)
+	pruneParam := fs.Bool(
+		"prune",
+		false,
+		"(action) Removes old releases & images of a service provided by -name, keeping the number given by its image_retention",
+	)
+	keepParam := fs.Int(
+		"keep",
+		0,
+		"Number of releases, & images of each image name, to keep with -prune. Overrides the service's image_retention.",
+	)
+	dryRunParam := fs.Bool(
+		"dry-run",
+		false,
+		"List the releases & images -prune would remove & the space it would free without removing them",
+	)
+	jsonParam := fs.Bool(
+		"json",
+		false,
+		"Print output as JSON instead of a table (if relevant)",
+	)
 	nameParam := fs.String(
 		"name",
 		"",
 		"Name of the service",
 	)
 
+	pathParam := fs.String(
+		"path",
+		"",
+		"Path to the project whose environment is selected with -env. Defaults to current working directory.",
+	)
+	workspaceParam := fs.String(
+		"workspace",
+		"",
+		"Act on the service of every project with a smt.json under the given directory instead of a single service, in the order given by their depends_on (reversed for -stop). Supports -list, -start, -stop, -restart & -status.",
+	)
+
 	serverConfigFlags := UseServerConfigFlags(fs)
+	envParam := UseEnvironmentFlag(fs)
+
+	breakLockParam := UseBreakLockFlag(fs)
 
 	debugParam := fs.Bool("debug", false, "Set log level to debug")
 
@@ -120,6 +186,24 @@ func (s *ServiceCommandSpec) Build() (Command, error) {
 		sshUsername:            "",
 		sshKeyFilePath:         "",
 		remoteServiceDirectory: "",
+		breakLock:              *breakLockParam,
+		json:                   *jsonParam,
+		dryRun:                 *dryRunParam,
+		keep:                   *keepParam,
+	}
+
+	var name string
+	var err error
+	if *workspaceParam != "" {
+		if *nameParam != "" || *pathParam != "" {
+			return nil, fmt.Errorf("-workspace cannot be combined with -name or -path")
+		}
+		cmd.workspace, err = loadWorkspace(*workspaceParam, *envParam, serverConfigFlags)
+	} else {
+		name, err = ResolveServiceName(*nameParam, *envParam, *pathParam, serverConfigFlags)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if !*localParam {
@@ -138,6 +222,9 @@ func (s *ServiceCommandSpec) Build() (Command, error) {
 		RestartService:   *restartParam,
 		GetServiceStatus: *statusParam,
 		RemoveService:    *removeParam,
+		ServiceHistory:   *historyParam,
+		ListCerts:        *certsParam,
+		PruneImages:      *pruneParam,
 	}
 
 	var actions []ServiceAction
@@ -158,11 +245,21 @@ func (s *ServiceCommandSpec) Build() (Command, error) {
 		action = actions[0]
 	}
 
-	name := *nameParam
-	if name == "" && action != ListServices {
+	if cmd.workspace != nil {
+		if !slices.Contains([]ServiceAction{ListServices, StartService, StopService, RestartService, GetServiceStatus}, action) {
+			return nil, fmt.Errorf("-workspace can only be used with -list, -start, -stop, -restart or -status")
+		}
+	} else if name == "" && action != ListServices && action != ListCerts {
 		return nil, fmt.Errorf("service name required for specified action")
 	}
 
+	if action != PruneImages && (*dryRunParam || *keepParam != 0) {
+		return nil, fmt.Errorf("-dry-run and -keep can only be used with -prune")
+	}
+	if *keepParam < 0 {
+		return nil, fmt.Errorf("invalid -keep %d (must be positive)", *keepParam)
+	}
+
 	cmd.action = action
 	cmd.name = name
 
@@ -186,6 +283,10 @@ func (c *ServiceCommand) Invoke() error {
 		return err
 	}
 
+	if c.workspace != nil {
+		return c.invokeWorkspace(exec, serverConfig)
+	}
+
 	switch c.action {
 	case ListServices:
 		values := []map[string]string{}
@@ -200,25 +301,327 @@ func (c *ServiceCommand) Invoke() error {
 		if len(values) > 0 {
 			fmt.Println(utils.BuildTable([]string{"NAME", "PATH"}, values))
 		}
-	case StartService:
-	case StopService:
-	case RestartService:
+	case StartService, StopService, RestartService:
+		return runServiceAction(exec, serverConfig, c.name, c.action)
 	case GetServiceStatus:
-		serviceConfig, err := serverConfig.LoadServiceDefinition(exec, c.name, false)
-		if err != nil {
+		return c.showStatus(exec, serverConfig)
+	case RemoveService:
+		return c.removeService(exec, serverConfig)
+	case ServiceHistory:
+		return c.showHistory(exec, serverConfig)
+	case ListCerts:
+		return c.listCerts(exec)
+	case PruneImages:
+		return c.prune(exec, serverConfig)
+	default:
+		fmt.Println("not supported yet! Sorry!")
+	}
+
+	return nil
+}
+
+// Runs the registered command of the service for the given start, stop or restart action.
+func runServiceAction(exec config.Executor, serverConfig *serverconfig.ServerConfig, name string, action ServiceAction) error {
+	serviceConfig, err := serverConfig.LoadServiceDefinition(exec, name, false)
+	if err != nil {
+		return err
+	}
+	actionName := ActionNames[action]
+	cmd, prs := serviceConfig.ServiceConfig.Commands[actionName]
+	if !prs {
+		return fmt.Errorf("service %s has no registered %s command", name, actionName)
+	}
+	if _, _, err := exec.ExecuteShell(cmd); err != nil {
+		return fmt.Errorf("%s command exited with error: %w", actionName, err)
+	}
+	return nil
+}
+
+// Stops the service, removes its nginx sites, disables its systemd units, deletes its
+// directory & unregisters it from the server config.
+func (c *ServiceCommand) removeService(exec config.Executor, serverConfig *serverconfig.ServerConfig) error {
+	servicePath, prs := serverConfig.Services[c.name]
+	if !prs {
+		slog.Info("service not registered on server; nothing to remove", "name", c.name)
+		return nil
+	}
+
+	l, err := lock.Acquire(exec, c.name, "service -remove", c.breakLock)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(exec, l)
+
+	serviceDefn, err := serverConfig.LoadServiceDefinition(exec, c.name, true)
+	if err != nil {
+		return err
+	}
+	if serviceDefn != nil {
+		if cmd, prs := serviceDefn.ServiceConfig.Commands["stop"]; prs {
+			if _, _, err := exec.ExecuteShell(cmd); err != nil {
+				return fmt.Errorf("stop command exited with error: %w", err)
+			}
+		}
+	}
+
+	if serviceDefn != nil && len(serviceDefn.ServiceConfig.NginxSites) > 0 {
+		if err := nginx.RemoveSites(exec, serviceDefn.ServiceConfig.NginxSites); err != nil {
 			return err
 		}
-		actionName := ActionNames[c.action]
-		cmd, prs := serviceConfig.ServiceConfig.Commands[actionName]
-		if !prs {
-			return fmt.Errorf("service %s has no registered %s command", c.name, actionName)
+		if _, stderr, err := exec.ExecuteShell(fmt.Sprintf("nginx -t && %s", nginx.ReloadCommand)); err != nil {
+			return fmt.Errorf("[%s] failed to reload nginx after removing sites (stderr: %s): %w", exec.Name(), stderr, err)
 		}
-		if _, _, err := exec.ExecuteShell(cmd); err != nil {
-			return fmt.Errorf("%s command exited with error: %w", actionName, err)
+	}
+
+	unitDir := service.GetSystemdUnitDir(servicePath)
+	units, err := serviceUnits(exec, serviceDefn, unitDir)
+	if err != nil {
+		return err
+	}
+	for _, u := range units {
+		if err := systemd.RemoveUnit(exec, unitDir, u); err != nil {
+			return err
 		}
-	default:
-		fmt.Println("not supported yet! Sorry!")
+	}
+	if _, _, err := exec.ExecuteCommand("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("[%s] failed to reload systemd units: %w", exec.Name(), err)
+	}
+
+	if _, _, err := exec.ExecuteCommand("rm", "-rf", servicePath); err != nil {
+		return fmt.Errorf("[%s] failed to remove service directory %s: %w", exec.Name(), servicePath, err)
+	}
+
+	err = updateServerConfig(exec, serverConfig, "service -remove", func(s *serverconfig.ServerConfig) error {
+		delete(s.Services, c.name)
+		s.SetServiceSites(c.name, nil)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("removed service", "name", c.name, "path", servicePath)
+	return nil
+}
+
+// Prints the state of each systemd unit deployed for the service.
+func (c *ServiceCommand) showStatus(exec config.Executor, serverConfig *serverconfig.ServerConfig) error {
+	statuses, err := loadUnitStatuses(exec, serverConfig, c.name)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		statusesJson, err := json.MarshalIndent(statuses, "", "\t")
+		if err != nil {
+			return fmt.Errorf("failed to serialize unit states: %w", err)
+		}
+		fmt.Println(string(statusesJson))
+		return nil
+	}
+
+	if len(statuses) == 0 {
+		slog.Info("no systemd units deployed for service", "name", c.name)
+		return nil
+	}
+
+	printUnitStatuses(statuses)
+	return nil
+}
+
+func loadUnitStatuses(exec config.Executor, serverConfig *serverconfig.ServerConfig, name string) ([]*systemd.UnitStatus, error) {
+	serviceDefn, err := serverConfig.LoadServiceDefinition(exec, name, false)
+	if err != nil {
+		return nil, err
+	}
+	units, err := serviceUnits(exec, serviceDefn, service.GetSystemdUnitDir(serviceDefn.Path))
+	if err != nil {
+		return nil, err
+	}
+	return systemd.GetUnitStatuses(exec, units)
+}
+
+func printUnitStatuses(statuses []*systemd.UnitStatus) {
+	values := []map[string]string{}
+	for _, s := range statuses {
+		values = append(values, map[string]string{
+			"UNIT":    s.Name,
+			"LOAD":    s.LoadState,
+			"ACTIVE":  s.ActiveState,
+			"SUB":     s.SubState,
+			"ENABLED": s.UnitFileState,
+			"NEXT":    s.NextElapse,
+		})
+	}
+	fmt.Println(utils.BuildTable([]string{"UNIT", "LOAD", "ACTIVE", "SUB", "ENABLED", "NEXT"}, values))
+}
+
+// Gets the systemd units deployed for the service, falling back to the files in its unit
+// directory if it was deployed before units were tracked.
+func serviceUnits(exec config.Executor, serviceDefn *service.ServiceDefinition, unitDir string) ([]string, error) {
+	if serviceDefn != nil && len(serviceDefn.ServiceConfig.SystemdUnits) > 0 {
+		return serviceDefn.ServiceConfig.SystemdUnits, nil
+	}
+	return systemd.ListUnits(exec, unitDir)
+}
+
+func (c *ServiceCommand) showHistory(exec config.Executor, serverConfig *serverconfig.ServerConfig) error {
+	servicePath, prs := serverConfig.Services[c.name]
+	if !prs {
+		return fmt.Errorf("[%s] no service registered with name %s", exec.Name(), c.name)
+	}
+	entries, err := history.Load(exec, servicePath)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		entriesJson, err := json.MarshalIndent(entries, "", "\t")
+		if err != nil {
+			return fmt.Errorf("failed to serialize history: %w", err)
+		}
+		fmt.Println(string(entriesJson))
+		return nil
+	}
+
+	if len(entries) == 0 {
+		slog.Info("no deploy history recorded for service", "name", c.name)
+		return nil
+	}
+
+	values := []map[string]string{}
+	for _, e := range entries {
+		gitSha := e.GitSha
+		if len(gitSha) > 12 {
+			gitSha = gitSha[:12]
+		}
+		details := strings.Join(e.Changed, ", ")
+		if e.Error != "" {
+			details = e.Error
+		}
+		values = append(values, map[string]string{
+			"TIME":      e.Timestamp.Local().Format(time.DateTime),
+			"OPERATION": e.Operation,
+			"OPERATOR":  fmt.Sprintf("%s@%s", e.Operator, e.Host),
+			"GIT SHA":   gitSha,
+			"RELEASE":   e.Release,
+			"RESULT":    e.Result,
+			"DETAILS":   details,
+		})
+	}
+	fmt.Println(utils.BuildTable([]string{"TIME", "OPERATION", "OPERATOR", "GIT SHA", "RELEASE", "RESULT", "DETAILS"}, values))
+	return nil
+}
+
+func (c *ServiceCommand) listCerts(exec config.Executor) error {
+	certificates, err := certs.ListCertificates(exec)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		certificatesJson, err := json.MarshalIndent(certificates, "", "\t")
+		if err != nil {
+			return fmt.Errorf("failed to serialize certificates: %w", err)
+		}
+		fmt.Println(string(certificatesJson))
+		return nil
 	}
 
+	if len(certificates) == 0 {
+		slog.Info("no certificates found on server", "dir", certs.LiveDir)
+		return nil
+	}
+
+	values := []map[string]string{}
+	for _, cert := range certificates {
+		daysLeft := int(time.Until(cert.Expiry).Hours() / 24)
+		for _, d := range cert.Domains {
+			values = append(values, map[string]string{
+				"HOSTNAME":    d,
+				"CERTIFICATE": cert.Name,
+				"EXPIRES":     cert.Expiry.Local().Format(time.DateTime),
+				"DAYS LEFT":   fmt.Sprintf("%d", daysLeft),
+			})
+		}
+	}
+	slices.SortFunc(values, func(x, y map[string]string) int { return strings.Compare(x["HOSTNAME"], y["HOSTNAME"]) })
+	fmt.Println(utils.BuildTable([]string{"HOSTNAME", "CERTIFICATE", "EXPIRES", "DAYS LEFT"}, values))
+	return nil
+}
+
+// Removes the service's releases & images that fall outside its retention policy, or with
+// -dry-run lists them & the space removing them would free. Images of the releases that are
+// kept are kept too.
+func (c *ServiceCommand) prune(exec config.Executor, serverConfig *serverconfig.ServerConfig) error {
+	serviceDefn, err := serverConfig.LoadServiceDefinition(exec, c.name, false)
+	if err != nil {
+		return err
+	}
+	serviceConfig := serviceDefn.ServiceConfig
+	if len(serviceConfig.ImageNames) == 0 {
+		return fmt.Errorf("service %s has no recorded images; deploy it again to record them", c.name)
+	}
+	keep := c.keep
+	if keep == 0 {
+		keep = serviceConfig.ImageRetention
+	}
+	if keep == 0 {
+		keep = project.DefaultImageRetention
+	}
+
+	if !c.dryRun {
+		l, err := lock.Acquire(exec, c.name, "service -prune", c.breakLock)
+		if err != nil {
+			return err
+		}
+		defer releaseLock(exec, l)
+	}
+
+	prunedReleases, kept, err := release.Prune(exec, serviceDefn.Path, keep, c.dryRun)
+	if err != nil {
+		return err
+	}
+	if len(prunedReleases) > 0 {
+		slog.Info("pruned old releases", "name", c.name, "keep", keep, "releases", utils.Map(prunedReleases, func(r *release.Release) string { return r.ID }))
+	}
+	pruned, err := imageprune.Prune(exec, serviceConfig.ImageNames, serviceConfig.ImageCompareLabel, keep, release.ImageIDs(kept), c.dryRun)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		prunedJson, err := json.MarshalIndent(pruned, "", "\t")
+		if err != nil {
+			return fmt.Errorf("failed to serialize pruned images: %w", err)
+		}
+		fmt.Println(string(prunedJson))
+		return nil
+	}
+
+	if len(pruned) == 0 {
+		slog.Info("no images to prune", "name", c.name, "keep", keep)
+		return nil
+	}
+
+	values := []map[string]string{}
+	for _, i := range pruned {
+		id := strings.TrimPrefix(i.ID, "sha256:")
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		values = append(values, map[string]string{
+			"REPOSITORY": i.Repository,
+			"IMAGE ID":   id,
+			"TAGS":       strings.Join(i.Tags, ", "),
+			"CREATED":    i.Created.Local().Format(time.DateTime),
+			"SIZE":       utils.FormatBytes(i.Size),
+		})
+	}
+	fmt.Println(utils.BuildTable([]string{"REPOSITORY", "IMAGE ID", "TAGS", "CREATED", "SIZE"}, values))
+	verb := "Freed"
+	if c.dryRun {
+		verb = "Would free"
+	}
+	fmt.Printf("%s up to %s from %d image(s)\n", verb, utils.FormatBytes(imageprune.TotalSize(pruned)), len(pruned))
 	return nil
 }
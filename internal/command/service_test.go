@@ -0,0 +1,128 @@
+package command
+
+import (
+	"strings"
+	"testing"
+
+	serverconfig "github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/install"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/lock"
+)
+
+type scriptedReply struct {
+	match  string
+	stdout string
+}
+
+// Executor that records each command it runs & answers the first reply matching it
+type scriptedExecutor struct {
+	replies  []scriptedReply
+	commands []string
+}
+
+func (e *scriptedExecutor) Name() string          { return "scripted" }
+func (e *scriptedExecutor) Yaml(depth int) string { return "" }
+func (e *scriptedExecutor) ExecuteCommand(name string, args ...string) (string, string, error) {
+	return e.ExecuteShell(name + " " + strings.Join(args, " "))
+}
+func (e *scriptedExecutor) ExecuteCommandInDir(workingDir string, name string, args ...string) (string, string, error) {
+	return e.ExecuteCommand(name, args...)
+}
+func (e *scriptedExecutor) ExecuteShell(cmd string) (string, string, error) {
+	e.commands = append(e.commands, cmd)
+	for _, r := range e.replies {
+		if strings.Contains(cmd, r.match) {
+			return r.stdout, "", nil
+		}
+	}
+	return "", "", nil
+}
+func (e *scriptedExecutor) ExecuteShellInDir(workingDir string, cmd string) (string, string, error) {
+	return e.ExecuteShell(cmd)
+}
+func (e *scriptedExecutor) Close() {}
+
+func (e *scriptedExecutor) ran(substr string) bool {
+	for _, c := range e.commands {
+		if strings.Contains(c, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRemoveService(t *testing.T) {
+	exec := &scriptedExecutor{replies: []scriptedReply{
+		// Service baz was deployed while foo was being removed
+		{match: "cat " + install.DefaultConfigFilePath, stdout: `{"services": {"foo": "/srv/foo", "bar": "/srv/bar", "baz": "/srv/baz"}, "sites": {"foo.conf": "foo", "bar.conf": "bar", "baz.conf": "baz"}}`},
+		{match: "echo 'acquired'", stdout: "acquired"},
+		{match: "test -e '/srv/foo/config.json'", stdout: "exists"},
+		{match: "/srv/foo/config.json", stdout: `{"commands": {"stop": "systemctl stop foo.service"}}`},
+	}}
+	serverConfig := &serverconfig.ServerConfig{
+		Services: map[string]string{"foo": "/srv/foo", "bar": "/srv/bar"},
+		Sites:    map[string]string{"foo.conf": "foo", "bar.conf": "bar"},
+	}
+	c := &ServiceCommand{name: "foo"}
+
+	if err := c.removeService(exec, serverConfig); err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if !exec.ran(lock.GetLockPath("foo")) {
+		t.Errorf("expected service lock to be taken")
+	}
+	if !exec.ran("systemctl stop foo.service") {
+		t.Errorf("expected service to be stopped")
+	}
+	if !exec.ran("rm -rf /srv/foo") {
+		t.Errorf("expected service directory to be removed")
+	}
+	if _, prs := serverConfig.Services["foo"]; prs {
+		t.Errorf("expected service to be unregistered")
+	}
+	if _, prs := serverConfig.Services["bar"]; !prs {
+		t.Errorf("expected other services to be kept")
+	}
+	if _, prs := serverConfig.Sites["foo.conf"]; prs {
+		t.Errorf("expected service's sites to be released")
+	}
+	if _, prs := serverConfig.Sites["bar.conf"]; !prs {
+		t.Errorf("expected other services' sites to be kept")
+	}
+	if _, prs := serverConfig.Services["baz"]; !prs || serverConfig.Sites["baz.conf"] != "baz" {
+		t.Errorf("expected services registered since the config was read to be kept")
+	}
+	if !exec.ran(lock.GetLockPath(lock.ServerConfigLockName)) {
+		t.Errorf("expected server config lock to be taken")
+	}
+}
+
+func TestRemoveServiceNotRegistered(t *testing.T) {
+	exec := &scriptedExecutor{}
+	serverConfig := &serverconfig.ServerConfig{Services: map[string]string{"bar": "/srv/bar"}}
+	c := &ServiceCommand{name: "foo"}
+
+	if err := c.removeService(exec, serverConfig); err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if len(exec.commands) > 0 {
+		t.Errorf("expected nothing to be run, got %v", exec.commands)
+	}
+}
+
+func TestRemoveServiceLocked(t *testing.T) {
+	exec := &scriptedExecutor{replies: []scriptedReply{
+		{match: "echo 'acquired'", stdout: "held"},
+		{match: "cat '" + lock.GetLockPath("foo") + "'", stdout: `{"id": "other", "service": "foo", "operation": "deploy", "holder": "someone", "host": "elsewhere", "started_at": "2099-01-01T00:00:00Z"}`},
+	}}
+	serverConfig := &serverconfig.ServerConfig{Services: map[string]string{"foo": "/srv/foo"}}
+	c := &ServiceCommand{name: "foo"}
+
+	err := c.removeService(exec, serverConfig)
+	if err == nil || !strings.Contains(err.Error(), "someone@elsewhere") {
+		t.Fatalf("expected error naming lock holder, got '%v'", err)
+	}
+	if exec.ran("rm -rf /srv/foo") {
+		t.Errorf("expected service directory to be kept")
+	}
+}
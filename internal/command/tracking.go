@@ -0,0 +1,109 @@
+package command
+
+import (
+	"fmt"
+	"sync"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+)
+
+// Records the result of each provider's sync, since the runner does not report them, &
+// optionally the digest of the content each one syncs.
+type syncTracker struct {
+	mu      sync.Mutex
+	names   []string
+	results map[string]deploy.SyncResult
+	// Unset unless digests are being recorded
+	digests map[string]*plan.Digest
+}
+
+type trackedProvider struct {
+	deploy.Provider
+	tracker *syncTracker
+}
+
+// Adds a content digest to a provider that cannot digest its own, e.g. one from deploy-assets.
+type digestedProvider struct {
+	deploy.Provider
+	digest func(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error)
+}
+
+// Creates a tracker, recording the digest of each asset's content before it is synced if
+// digests is set. Digesting reads the content on both sides, so it is only done for plans.
+func newSyncTracker(digests bool) *syncTracker {
+	t := &syncTracker{results: map[string]deploy.SyncResult{}}
+	if digests {
+		t.digests = map[string]*plan.Digest{}
+	}
+	return t
+}
+
+// Wraps the provider of each asset so that its sync result is recorded by the tracker.
+func (t *syncTracker) Track(assets []*deploy.ProviderConfig) {
+	for _, a := range assets {
+		a.Provider = &trackedProvider{a.Provider, t}
+	}
+}
+
+func (t *syncTracker) record(name string, result deploy.SyncResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, prs := t.results[name]; !prs {
+		t.names = append(t.names, name)
+	}
+	t.results[name] = result
+}
+
+func (t *syncTracker) recordDigest(name string, digest *plan.Digest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.digests[name] = digest
+}
+
+// Names of the assets that were created or updated, in the order they were synced.
+func (t *syncTracker) Changed() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := []string{}
+	for _, n := range t.names {
+		if t.results[n] != deploy.SYNC_RESULT_NOCHANGE {
+			changed = append(changed, n)
+		}
+	}
+	return changed
+}
+
+// Result reported by the named asset's provider, if it has been synced.
+func (t *syncTracker) Result(name string) (deploy.SyncResult, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result, prs := t.results[name]
+	return result, prs
+}
+
+// Digest of the named asset's content, if it was recorded.
+func (t *syncTracker) Digest(name string) *plan.Digest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.digests[name]
+}
+
+func (p *trackedProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	if d, ok := p.Provider.(plan.Digester); ok && p.tracker.digests != nil {
+		digest, err := d.Digest(cfg.SrcExecutor, cfg.DstExecutor)
+		if err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("failed to digest content of %s: %w", p.Name(), err)
+		}
+		p.tracker.recordDigest(p.Name(), digest)
+	}
+	result, err := p.Provider.Sync(cfg)
+	if err == nil {
+		p.tracker.record(p.Name(), result)
+	}
+	return result, err
+}
+
+func (p *digestedProvider) Digest(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+	return p.digest(src, dst)
+}
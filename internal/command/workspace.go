@@ -0,0 +1,339 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/events"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/systemd"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+
+	serverconfig "github.com/mrshanahan/quemot-dev-service-management-tool/internal/config"
+)
+
+// Deploys every project of a workspace, i.e. a directory holding several projects each with
+// its own smt.json. Projects are deployed to each server in the order given by their
+// depends_on, one after the other over a single connection to it; servers are deployed to
+// in parallel.
+type WorkspaceDeployCommand struct {
+	root string
+	// Deploys of the workspace's projects, in dependency order
+	projects []*DeployCommand
+	byName   map[string]*project.ProjectConfig
+	parallel int
+	failFast bool
+	dryRun   bool
+}
+
+type workspaceOutcome struct {
+	project *DeployCommand
+	deployOutcome
+}
+
+func newWorkspaceDeployCommand(root string, f *deployFlags) (*WorkspaceDeployCommand, error) {
+	paths, err := project.FindProjectConfigs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	commands := map[*project.ProjectConfig]*DeployCommand{}
+	configs := []*project.ProjectConfig{}
+	for _, path := range paths {
+		c, err := newDeployCommand(path, filepath.Dir(path), nil, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load project %s: %w", path, err)
+		}
+		commands[c.projectConfig] = c
+		configs = append(configs, c.projectConfig)
+	}
+	ordered, err := project.OrderByDependencies(configs)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]*project.ProjectConfig{}
+	for _, p := range ordered {
+		byName[p.Name] = p
+	}
+	slog.Info("found projects in workspace", "root", root, "projects", utils.Map(ordered, func(p *project.ProjectConfig) string { return p.Name }))
+	return &WorkspaceDeployCommand{
+		root:     root,
+		projects: utils.Map(ordered, func(p *project.ProjectConfig) *DeployCommand { return commands[p] }),
+		byName:   byName,
+		parallel: f.parallel,
+		failFast: f.failFast,
+		dryRun:   f.dryRun,
+	}, nil
+}
+
+func (c *WorkspaceDeployCommand) Invoke() error {
+	start := time.Now()
+	err := c.invoke()
+	events.Emit((&events.Event{Type: events.TypeFinished, DryRun: c.dryRun, DurationMs: events.DurationSince(start)}).Finish(err))
+	return err
+}
+
+func (c *WorkspaceDeployCommand) invoke() error {
+	// Every project is checked & built before any is deployed, so that a project failing
+	// either leaves the servers untouched
+	for _, p := range c.projects {
+		if err := p.prepare(); err != nil {
+			return fmt.Errorf("failed to prepare project %s: %w", p.projectConfig.Name, err)
+		}
+	}
+
+	outcomes := []*workspaceOutcome{}
+	servers := []string{}
+	byServer := map[string][]*workspaceOutcome{}
+	for _, p := range c.projects {
+		for _, t := range p.targets {
+			o := &workspaceOutcome{project: p, deployOutcome: deployOutcome{target: t}}
+			outcomes = append(outcomes, o)
+			if _, prs := byServer[t.Server]; !prs {
+				servers = append(servers, t.Server)
+			}
+			byServer[t.Server] = append(byServer[t.Server], o)
+		}
+	}
+
+	sem := make(chan struct{}, c.parallel)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			c.deployToServer(byServer[s], &failed)
+		}()
+	}
+	wg.Wait()
+
+	values := []map[string]string{}
+	failedProjects := map[string]bool{}
+	for _, o := range outcomes {
+		details := strings.Join(o.changed, ", ")
+		if o.err != nil {
+			details = o.err.Error()
+			failedProjects[o.project.projectConfig.Name] = true
+		}
+		values = append(values, map[string]string{
+			"PROJECT": o.project.projectConfig.Name,
+			"SERVER":  o.target.Server,
+			"RESULT":  DeployResultNames[o.result],
+			"DETAILS": details,
+		})
+	}
+	// With events enabled stdout is reserved for them, & each project's result is an event
+	if !events.Enabled() {
+		fmt.Println(utils.BuildTable([]string{"PROJECT", "SERVER", "RESULT", "DETAILS"}, values))
+	}
+
+	if len(failedProjects) > 0 {
+		return fmt.Errorf("deploy failed for %d of %d projects", len(failedProjects), len(c.projects))
+	}
+	return nil
+}
+
+// Deploys projects to a single server in order over one connection to it. Projects depending
+// on one that failed or was skipped on the server are skipped.
+func (c *WorkspaceDeployCommand) deployToServer(outcomes []*workspaceOutcome, failed *atomic.Bool) {
+	t := outcomes[0].target
+	slog.Info("deploying workspace to server", "server", t.Server, "hostname", t.Hostname, "projects", len(outcomes))
+	sshExecutor, connectErr := connectTo(t, "")
+	if connectErr != nil {
+		slog.Error("failed to connect to server", "server", t.Server, "hostname", t.Hostname, "err", connectErr)
+		failed.Store(true)
+	} else {
+		defer sshExecutor.Close()
+	}
+
+	notDeployed := map[string]bool{}
+	for _, o := range outcomes {
+		name := o.project.projectConfig.Name
+		start := time.Now()
+		if connectErr != nil {
+			o.result, o.err = DeployFailed, connectErr
+			o.project.emitServerResult(o.target, start, nil, connectErr)
+			continue
+		}
+		if (c.failFast && failed.Load()) || project.DependsOnAny(o.project.projectConfig, c.byName, notDeployed) {
+			slog.Warn("skipping deploy of project", "name", name, "server", t.Server)
+			o.result = DeploySkipped
+			notDeployed[name] = true
+			events.Emit(&events.Event{Type: events.TypeServerResult, Status: events.StatusSkipped, Project: name, Server: o.target.Server, Hostname: o.target.Hostname})
+			continue
+		}
+
+		slog.Info("deploying project to server", "name", name, "server", t.Server)
+		o.changed, o.err = o.project.deployWith(sshExecutor, o.target, start)
+		if o.err != nil {
+			slog.Error("deploy of project to server failed", "name", name, "server", t.Server, "err", o.err)
+			o.result = DeployFailed
+			notDeployed[name] = true
+			failed.Store(true)
+		} else if len(o.changed) > 0 {
+			o.result = DeployChanged
+		} else {
+			o.result = DeployUnchanged
+		}
+	}
+}
+
+// Loads the projects of the workspace under root for the environment, in dependency order.
+// Unless -server is given, the server is that of the environment, which the projects must
+// agree on.
+func loadWorkspace(root string, env string, s *ServerConfigFlags) ([]*project.ProjectConfig, error) {
+	paths, err := project.FindProjectConfigs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	explicitServer := *s.Server != ""
+	configs := []*project.ProjectConfig{}
+	for _, path := range paths {
+		projectConfig, err := project.LoadProjectConfigForEnvironment(path, env)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load project %s: %w", path, err)
+		}
+		if !explicitServer && *s.Server != "" && projectConfig.EnvironmentServer != "" && projectConfig.EnvironmentServer != *s.Server {
+			return nil, fmt.Errorf("projects in workspace %s use different servers in environment '%s' (%s & %s); select one with -server", root, env, *s.Server, projectConfig.EnvironmentServer)
+		}
+		ApplyEnvironmentServer(s, projectConfig)
+		configs = append(configs, projectConfig)
+	}
+	return project.OrderByDependencies(configs)
+}
+
+// Runs the action on the service of each project of the workspace deployed to the server.
+func (c *ServiceCommand) invokeWorkspace(exec config.Executor, serverConfig *serverconfig.ServerConfig) error {
+	switch c.action {
+	case ListServices:
+		values := []map[string]string{}
+		for _, p := range c.workspace {
+			if path, prs := serverConfig.Services[p.Name]; prs {
+				values = append(values, map[string]string{
+					"NAME": p.Name,
+					"PATH": path,
+				})
+			}
+		}
+		if len(values) > 0 {
+			fmt.Println(utils.BuildTable([]string{"NAME", "PATH"}, values))
+		}
+		return nil
+	case GetServiceStatus:
+		return c.showWorkspaceStatus(exec, serverConfig)
+	case StartService, StopService, RestartService:
+		return c.runWorkspaceAction(exec, serverConfig)
+	default:
+		return fmt.Errorf("action not supported with -workspace")
+	}
+}
+
+func (c *ServiceCommand) showWorkspaceStatus(exec config.Executor, serverConfig *serverconfig.ServerConfig) error {
+	statuses := map[string][]*systemd.UnitStatus{}
+	for _, p := range c.workspace {
+		if _, prs := serverConfig.Services[p.Name]; !prs {
+			slog.Info("service not deployed to server; skipping", "name", p.Name)
+			continue
+		}
+		s, err := loadUnitStatuses(exec, serverConfig, p.Name)
+		if err != nil {
+			return err
+		}
+		statuses[p.Name] = s
+	}
+
+	if c.json {
+		statusesJson, err := json.MarshalIndent(statuses, "", "\t")
+		if err != nil {
+			return fmt.Errorf("failed to serialize unit states: %w", err)
+		}
+		fmt.Println(string(statusesJson))
+		return nil
+	}
+
+	for _, p := range c.workspace {
+		s, prs := statuses[p.Name]
+		if !prs {
+			continue
+		}
+		fmt.Printf("%s:\n", p.Name)
+		if len(s) == 0 {
+			fmt.Println("no systemd units deployed")
+			continue
+		}
+		printUnitStatuses(s)
+	}
+	return nil
+}
+
+// Starts, stops or restarts the workspace's services in dependency order, or the reverse of
+// it when stopping. A service is skipped if one it depends on (or, when stopping, one that
+// depends on it) failed or was skipped.
+func (c *ServiceCommand) runWorkspaceAction(exec config.Executor, serverConfig *serverconfig.ServerConfig) error {
+	ordered := slices.Clone(c.workspace)
+	if c.action == StopService {
+		slices.Reverse(ordered)
+	}
+	byName := map[string]*project.ProjectConfig{}
+	for _, p := range ordered {
+		byName[p.Name] = p
+	}
+	blocked := func(p *project.ProjectConfig, notDone map[string]bool) bool {
+		if c.action != StopService {
+			return project.DependsOnAny(p, byName, notDone)
+		}
+		for n := range notDone {
+			if project.DependsOnAny(byName[n], byName, map[string]bool{p.Name: true}) {
+				return true
+			}
+		}
+		return false
+	}
+
+	actionName := ActionNames[c.action]
+	values := []map[string]string{}
+	notDone := map[string]bool{}
+	failures := 0
+	for _, p := range ordered {
+		result, details := "succeeded", ""
+		if _, prs := serverConfig.Services[p.Name]; !prs {
+			result, details = "skipped", "not deployed to server"
+			notDone[p.Name] = true
+		} else if blocked(p, notDone) {
+			result, details = "skipped", "a service it depends on was not "+actionName+"ed"
+			if c.action == StopService {
+				details = "a service depending on it was not stopped"
+			}
+			notDone[p.Name] = true
+		} else if err := runServiceAction(exec, serverConfig, p.Name, c.action); err != nil {
+			slog.Error("service action failed", "name", p.Name, "action", actionName, "err", err)
+			result, details = "failed", err.Error()
+			notDone[p.Name] = true
+			failures += 1
+		}
+		values = append(values, map[string]string{
+			"SERVICE": p.Name,
+			"RESULT":  result,
+			"DETAILS": details,
+		})
+	}
+	fmt.Println(utils.BuildTable([]string{"SERVICE", "RESULT", "DETAILS"}, values))
+
+	if failures > 0 {
+		return fmt.Errorf("%s failed for %d of %d services", actionName, failures, len(ordered))
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 type ClientConfig struct {
 	DefaultServer string                              `json:"default_server"`
 	Servers       map[string]*ClientServerConfigEntry `json:"servers"`
+	Groups        map[string][]string                 `json:"groups,omitempty"`
 }
 
 type ClientServerConfigEntry struct {
@@ -19,8 +20,21 @@ type ClientServerConfigEntry struct {
 	SshKeyFilePath       string `json:"ssh_key_file_path"`
 	SshKeyFilePassphrase string `json:"ssh_key_file_passphrase"`
 	SshUsername          string `json:"ssh_username"`
+	Transport            string `json:"transport,omitempty"`
+	S3BaseUrl            string `json:"s3_base_url,omitempty"`
 }
 
+const (
+	TransportS3  string = "s3"
+	TransportScp string = "scp"
+
+	DefaultTransport string = TransportScp
+)
+
+var (
+	SupportedTransports []string = []string{TransportS3, TransportScp}
+)
+
 func GetDefaultClientConfigPath() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -43,7 +57,7 @@ func LoadClientConfig(path string, force bool) (*ClientConfig, error) {
 				return nil, fmt.Errorf("client config file does not exist at %s: %w", path, err)
 			}
 			slog.Debug("client config file does not exist; creating", "path", path)
-			defaultConfig := &ClientConfig{"", map[string]*ClientServerConfigEntry{}}
+			defaultConfig := &ClientConfig{"", map[string]*ClientServerConfigEntry{}, map[string][]string{}}
 			if err := SaveClientConfig(path, defaultConfig); err != nil {
 				return nil, fmt.Errorf("failed to initialize client config file: %w", err)
 			}
@@ -56,6 +70,9 @@ func LoadClientConfig(path string, force bool) (*ClientConfig, error) {
 	if err = json.Unmarshal(contents, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse client config file: %w", err)
 	}
+	if config.Groups == nil {
+		config.Groups = make(map[string][]string)
+	}
 
 	return config, nil
 }
@@ -13,6 +13,8 @@ import (
 
 type ServerConfig struct {
 	Services map[string]string `json:"services"`
+	// Service owning each nginx site, by site name
+	Sites map[string]string `json:"sites,omitempty"`
 }
 
 func LoadServerConfig(exec config.Executor, path string, force bool) (*ServerConfig, error) {
@@ -32,6 +34,9 @@ func LoadServerConfig(exec config.Executor, path string, force bool) (*ServerCon
 	if config.Services == nil {
 		config.Services = make(map[string]string)
 	}
+	if config.Sites == nil {
+		config.Sites = make(map[string]string)
+	}
 	return config, nil
 }
 
@@ -48,6 +53,21 @@ func SaveServerConfig(exec config.Executor, path string, c *ServerConfig) error
 	return nil
 }
 
+// Records the named service as owning exactly the given nginx sites.
+func (c *ServerConfig) SetServiceSites(name string, sites []string) {
+	if c.Sites == nil {
+		c.Sites = make(map[string]string)
+	}
+	for site, owner := range c.Sites {
+		if owner == name {
+			delete(c.Sites, site)
+		}
+	}
+	for _, site := range sites {
+		c.Sites[site] = name
+	}
+}
+
 func (c *ServerConfig) LoadServiceDefinition(exec config.Executor, name string, ignoreIfMissing bool) (*service.ServiceDefinition, error) {
 	servicePath, prs := c.Services[name]
 	if !prs {
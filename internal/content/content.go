@@ -0,0 +1,108 @@
+package content
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+)
+
+// Creates a provider that writes value to dstPath on the destination. Unlike the literal
+// provider, the existing file is compared against value first, so the sync result is only
+// created or updated when the contents actually change, and nothing is written on a dry run.
+func NewContentProvider(name string, value string, dstPath string) deploy.Provider {
+	return &contentProvider{
+		name:    name,
+		value:   value,
+		dstPath: dstPath,
+	}
+}
+
+type contentProvider struct {
+	name    string
+	value   string
+	dstPath string
+}
+
+func (p *contentProvider) Name() string { return p.name }
+
+func (p *contentProvider) Yaml(indent int) string {
+	propIndent := strings.Repeat(" ", indent+4)
+	valueLines := []string{}
+	for _, l := range strings.Split(p.value, "\n") {
+		valueLines = append(valueLines, strings.Repeat(" ", indent+8)+l)
+	}
+	return fmt.Sprintf(
+		`%scontent:
+%sname: %s
+%svalue: |
+%s
+%sdst_path: %s`,
+		strings.Repeat(" ", indent),
+		propIndent, p.name,
+		propIndent,
+		strings.Join(valueLines, "\n"),
+		propIndent, p.dstPath)
+}
+
+func (p *contentProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	dst := cfg.DstExecutor
+	result, err := CompareRemote(dst, p.dstPath, p.value)
+	if err != nil {
+		return deploy.SYNC_RESULT_NOCHANGE, err
+	}
+	if result == deploy.SYNC_RESULT_NOCHANGE {
+		slog.Debug("content unchanged", "name", p.Name(), "dst", dst.Name(), "path", p.dstPath)
+		return deploy.SYNC_RESULT_NOCHANGE, nil
+	}
+
+	if cfg.DryRun {
+		slog.Info("DRY RUN: writing content", "name", p.Name(), "dst", dst.Name(), "path", p.dstPath)
+		return result, nil
+	}
+
+	if err := WriteRemote(dst, p.dstPath, p.value); err != nil {
+		return deploy.SYNC_RESULT_NOCHANGE, err
+	}
+	return result, nil
+}
+
+func (p *contentProvider) Digest(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+	dstDigest, err := plan.HashRemoteFiles(dst, p.dstPath)
+	if err != nil {
+		return nil, err
+	}
+	return &plan.Digest{Src: plan.HashValues(p.value), Dst: dstDigest}, nil
+}
+
+// Compares the file at path on the executor against value, returning whether writing value
+// would create the file, update it or leave it unchanged.
+func CompareRemote(exec deploy.Executor, path string, value string) (deploy.SyncResult, error) {
+	stdoutRaw, _, err := exec.ExecuteShell(fmt.Sprintf("(test -e '%s' && sha256sum '%s') || echo 'not-exists'", path, path))
+	if err != nil {
+		return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("[%s] failed to check for existing target file '%s': %w", exec.Name(), path, err)
+	}
+
+	stdout := strings.Trim(stdoutRaw, " \n")
+	if stdout == "not-exists" {
+		return deploy.SYNC_RESULT_CREATED, nil
+	}
+	sum := sha256.Sum256([]byte(value))
+	if strings.Fields(stdout)[0] == hex.EncodeToString(sum[:]) {
+		return deploy.SYNC_RESULT_NOCHANGE, nil
+	}
+	return deploy.SYNC_RESULT_UPDATED, nil
+}
+
+func WriteRemote(exec deploy.Executor, path string, value string) error {
+	b64Value := base64.StdEncoding.EncodeToString([]byte(value))
+	if _, _, err := exec.ExecuteShell(fmt.Sprintf("echo '%s' | base64 -d > '%s'", b64Value, path)); err != nil {
+		return fmt.Errorf("[%s] failed to write value to %s: %w", exec.Name(), path, err)
+	}
+	return nil
+}
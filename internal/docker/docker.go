@@ -0,0 +1,110 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+)
+
+type Image struct {
+	Reference    string
+	ID           string
+	CompareValue string
+	Layers       []string
+}
+
+// Inspects the image with the given reference in the location pointed to by the executor.
+// Returns a nil pointer if the image does not exist. If compareLabel is provided, the value
+// of that label is returned as the image's CompareValue.
+func InspectImage(exec deploy.Executor, ref string, compareLabel string) (*Image, error) {
+	stdout, stderr, err := exec.ExecuteCommand("docker", "image", "ls", "--quiet", "--filter", fmt.Sprintf("reference=%s", ref))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to list image %s (stderr: %s): %w", exec.Name(), ref, stderr, err)
+	}
+	if strings.TrimSpace(stdout) == "" {
+		return nil, nil
+	}
+
+	compareLabelFormat := "{{ \"\" }}"
+	if compareLabel != "" {
+		// TODO: Make sure funky stuff can't happen here with a carefully-crafted label
+		compareLabelFormat = fmt.Sprintf("{{ index .Config.Labels \"%s\" }}", compareLabel)
+	}
+	format := fmt.Sprintf("{{ .Id }},{{ json .RootFS.Layers }},%s", compareLabelFormat)
+	stdout, stderr, err = exec.ExecuteCommand("docker", "image", "inspect", "--format", format, ref)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to inspect image %s (stderr: %s): %w", exec.Name(), ref, stderr, err)
+	}
+
+	comps := strings.SplitN(strings.TrimSpace(stdout), ",", 3)
+	if len(comps) != 3 {
+		return nil, fmt.Errorf("[%s] unexpected output inspecting image %s: %s", exec.Name(), ref, stdout)
+	}
+	var layers []string
+	if err := json.Unmarshal([]byte(comps[1]), &layers); err != nil {
+		return nil, fmt.Errorf("[%s] failed to parse layers of image %s: %w", exec.Name(), ref, err)
+	}
+
+	return &Image{
+		Reference:    ref,
+		ID:           comps[0],
+		CompareValue: comps[2],
+		Layers:       layers,
+	}, nil
+}
+
+// Lists the layers (as diff IDs) of every image in the location pointed to by the executor.
+func ListImageLayers(exec deploy.Executor) ([][]string, error) {
+	stdout, stderr, err := exec.ExecuteShell("docker image ls --quiet --no-trunc | sort -u | xargs -r docker image inspect --format '{{ json .RootFS.Layers }}'")
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to list image layers (stderr: %s): %w", exec.Name(), stderr, err)
+	}
+
+	layers := [][]string{}
+	for _, l := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		if l == "" {
+			continue
+		}
+		var imageLayers []string
+		if err := json.Unmarshal([]byte(l), &imageLayers); err != nil {
+			return nil, fmt.Errorf("[%s] failed to parse image layers: %w", exec.Name(), err)
+		}
+		layers = append(layers, imageLayers)
+	}
+	return layers, nil
+}
+
+// Returns the layers of the given image that are already present in some image in
+// existing. A layer is only considered present if all the layers beneath it match as
+// well, since Docker identifies stored layers by their whole chain.
+func SharedLayers(layers []string, existing [][]string) []string {
+	longest := 0
+	for _, e := range existing {
+		n := 0
+		for n < len(layers) && n < len(e) && layers[n] == e[n] {
+			n += 1
+		}
+		if n > longest {
+			longest = n
+		}
+	}
+	return layers[:longest]
+}
+
+// Whether the references name the same image, treating a missing tag as "latest".
+func SameImage(x string, y string) bool {
+	return withDefaultTag(x) == withDefaultTag(y)
+}
+
+func withDefaultTag(ref string) string {
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	idx := strings.LastIndex(ref, ":")
+	if idx < 0 || strings.Contains(ref[idx+1:], "/") {
+		return ref + ":latest"
+	}
+	return ref
+}
@@ -0,0 +1,30 @@
+package docker
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSharedLayers(t *testing.T) {
+	cases := []struct {
+		testName string
+		layers   []string
+		existing [][]string
+		expected []string
+	}{
+		{"no existing images", []string{"a", "b"}, [][]string{}, []string{}},
+		{"full match", []string{"a", "b"}, [][]string{{"a", "b", "c"}}, []string{"a", "b"}},
+		{"prefix match", []string{"a", "b", "c"}, [][]string{{"a", "b", "x"}}, []string{"a", "b"}},
+		{"longest of several", []string{"a", "b", "c"}, [][]string{{"a"}, {"a", "b"}, {"x", "b", "c"}}, []string{"a", "b"}},
+		{"matching layer on different base", []string{"a", "b"}, [][]string{{"x", "b"}}, []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testName, func(s *testing.T) {
+			actual := SharedLayers(c.layers, c.existing)
+			if !slices.Equal(actual, c.expected) {
+				s.Errorf("expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OutputText  string = "text"
+	OutputJsonl string = "jsonl"
+
+	TypeConnect       string = "connect"
+	TypeAssetDiff     string = "asset_diff"
+	TypeAssetTransfer string = "asset_transfer"
+	TypePostCommand   string = "post_command"
+	TypeServerResult  string = "server_result"
+	TypeFinished      string = "finished"
+
+	StatusStarted   string = "started"
+	StatusSucceeded string = "succeeded"
+	StatusFailed    string = "failed"
+	StatusSkipped   string = "skipped"
+)
+
+var (
+	SupportedOutputs []string = []string{OutputText, OutputJsonl}
+
+	mu      sync.Mutex
+	enabled bool
+	out     io.Writer = os.Stdout
+)
+
+// A single step of a deploy, written as one line of JSON when the output is jsonl.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Status     string    `json:"status,omitempty"`
+	Project    string    `json:"project,omitempty"`
+	Server     string    `json:"server,omitempty"`
+	Hostname   string    `json:"hostname,omitempty"`
+	Asset      string    `json:"asset,omitempty"`
+	Result     string    `json:"result,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	DurationMs *int64    `json:"duration_ms,omitempty"`
+	DryRun     bool      `json:"dry_run,omitempty"`
+	Changed    []string  `json:"changed,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Sets the output format of the process. With jsonl, events are written to stdout.
+func SetOutput(format string) error {
+	switch format {
+	case OutputText:
+		enabled = false
+	case OutputJsonl:
+		enabled = true
+	default:
+		return fmt.Errorf("invalid output format: '%s' (must be one of: %s)", format, strings.Join(SupportedOutputs, ", "))
+	}
+	return nil
+}
+
+// Whether events are being written, i.e. stdout is reserved for them.
+func Enabled() bool {
+	return enabled
+}
+
+// Writes the event if events are enabled, stamping it with the current time.
+func Emit(e *Event) {
+	if !enabled {
+		return
+	}
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		// Only unserializable values fail, and events contain none
+		panic(fmt.Sprintf("failed to serialize event: %v", err))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	out.Write(append(line, '\n'))
+}
+
+func DurationSince(start time.Time) *int64 {
+	ms := time.Since(start).Milliseconds()
+	return &ms
+}
+
+// Sets the status & error of the event from the outcome of its step.
+func (e *Event) Finish(err error) *Event {
+	if err != nil {
+		e.Status = StatusFailed
+		e.Error = err.Error()
+	} else {
+		e.Status = StatusSucceeded
+	}
+	return e
+}
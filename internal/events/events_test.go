@@ -0,0 +1,125 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+type fakeExecutor struct {
+	deploy.Executor
+	commands []string
+}
+
+func (e *fakeExecutor) ExecuteShell(cmd string) (string, string, error) {
+	e.commands = append(e.commands, cmd)
+	if cmd == "false" {
+		return "", "", errors.New("command failed")
+	}
+	return "", "", nil
+}
+
+type fakeProvider struct {
+	deploy.Provider
+}
+
+func (p *fakeProvider) Name() string { return "env-file" }
+
+func (p *fakeProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	// Commands run by the provider itself are not post-commands
+	cfg.DstExecutor.ExecuteShell("cat .env")
+	return deploy.SYNC_RESULT_UPDATED, nil
+}
+
+func captureEvents(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prevOut := out
+	out, enabled = &buf, true
+	t.Cleanup(func() {
+		out, enabled = prevOut, false
+	})
+	return &buf
+}
+
+func readEvents(t *testing.T, buf *bytes.Buffer) []*Event {
+	evts := []*Event{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e *Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("failed to parse event %q: %v", line, err)
+		}
+		evts = append(evts, e)
+	}
+	return evts
+}
+
+func TestEmitDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	prevOut := out
+	out = &buf
+	t.Cleanup(func() { out = prevOut })
+
+	Emit(&Event{Type: TypeFinished})
+	if buf.Len() > 0 {
+		t.Errorf("expected no output with events disabled, got %q", buf.String())
+	}
+}
+
+func TestObservedAssetAndPostCommands(t *testing.T) {
+	buf := captureEvents(t)
+	dst := &observedExecutor{Executor: &fakeExecutor{}, server: "prod"}
+	postCommands := []*deploy.PostCommand{
+		{Command: "true", Trigger: "on_changed"},
+		{Command: "false", Trigger: "always"},
+		{Command: "never", Trigger: "on_created"},
+	}
+	p := &observedProvider{Provider: &fakeProvider{}, server: "prod", postCommands: postCommands}
+
+	if _, err := p.Sync(deploy.SyncConfig{DstExecutor: dst}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dst.ExecuteShell("true")
+	dst.ExecuteShell("false")
+	// The runner validates the transport on the destination before syncing the next asset
+	dst.ExecuteShell("which scp")
+
+	evts := readEvents(t, buf)
+	if len(evts) != 4 {
+		t.Fatalf("expected 4 events, got %d: %s", len(evts), buf.String())
+	}
+	if evts[0].Type != TypeAssetTransfer || evts[0].Status != StatusStarted {
+		t.Errorf("expected asset transfer start, got %+v", evts[0])
+	}
+	if evts[1].Type != TypeAssetTransfer || evts[1].Status != StatusSucceeded || evts[1].Result != "changed" || evts[1].DurationMs == nil {
+		t.Errorf("expected changed asset transfer with duration, got %+v", evts[1])
+	}
+	if evts[2].Type != TypePostCommand || evts[2].Command != "true" || evts[2].Asset != "env-file" || evts[2].ExitCode == nil || *evts[2].ExitCode != 0 {
+		t.Errorf("expected successful post-command, got %+v", evts[2])
+	}
+	if evts[3].Status != StatusFailed || evts[3].Error != "command failed" {
+		t.Errorf("expected failed post-command, got %+v", evts[3])
+	}
+}
+
+func TestObservedValidateBeforePostCommands(t *testing.T) {
+	buf := captureEvents(t)
+	dst := &observedExecutor{Executor: &fakeExecutor{}, server: "prod"}
+	p := &observedProvider{Provider: &fakeProvider{}, server: "prod", postCommands: []*deploy.PostCommand{{Command: "true", Trigger: "always"}}}
+
+	if _, err := p.Sync(deploy.SyncConfig{DstExecutor: dst}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dst.ExecuteShell("which scp")
+	dst.ExecuteShell("true")
+	dst.ExecuteShell("true")
+
+	postCommands := utils.Filter(readEvents(t, buf), func(e *Event) bool { return e.Type == TypePostCommand })
+	if len(postCommands) != 1 || postCommands[0].Command != "true" {
+		t.Errorf("expected only the asset's post-command to be reported once, got %+v", postCommands)
+	}
+}
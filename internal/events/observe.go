@@ -0,0 +1,99 @@
+package events
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/deploy-assets/pkg/manifest"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+	"golang.org/x/crypto/ssh"
+)
+
+// Wraps the executors & providers of the manifest so that running it emits an event for
+// each asset's diff or transfer & for each post-command it triggers. Does nothing if events
+// are disabled.
+func ObserveManifest(m *manifest.Manifest, server string) {
+	if !enabled {
+		return
+	}
+	for name, e := range m.Executors {
+		m.Executors[name] = &observedExecutor{Executor: e, server: server}
+	}
+	for _, p := range m.Providers {
+		p.Provider = &observedProvider{Provider: p.Provider, server: server, postCommands: p.PostCommands}
+	}
+}
+
+type observedProvider struct {
+	deploy.Provider
+	server       string
+	postCommands []*deploy.PostCommand
+}
+
+// The runner executes an asset's post-commands on its destination, in order, right after
+// syncing it. Other commands also run on the destination before the next asset is synced
+// (e.g. validating the transport), so only the commands the asset's result fires are taken
+// as post-commands, as they come up.
+type observedExecutor struct {
+	deploy.Executor
+	server string
+	asset  string
+	// Post-commands of the asset that have yet to run
+	pending []string
+}
+
+func (p *observedProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	dst, _ := cfg.DstExecutor.(*observedExecutor)
+	if dst != nil {
+		dst.asset, dst.pending = "", nil
+	}
+
+	eventType := TypeAssetTransfer
+	if cfg.DryRun {
+		eventType = TypeAssetDiff
+	}
+	Emit(&Event{Type: eventType, Status: StatusStarted, Server: p.server, Asset: p.Name()})
+	start := time.Now()
+	result, err := p.Provider.Sync(cfg)
+	e := (&Event{Type: eventType, Server: p.server, Asset: p.Name(), DryRun: cfg.DryRun, DurationMs: DurationSince(start)}).Finish(err)
+	if err == nil {
+		e.Result = plan.ResultNames[result]
+		if dst != nil && !cfg.DryRun {
+			dst.asset, dst.pending = p.Name(), plan.FiringPostCommands(p.postCommands, result)
+		}
+	}
+	Emit(e)
+	return result, err
+}
+
+func (e *observedExecutor) ExecuteShell(cmd string) (string, string, error) {
+	if len(e.pending) == 0 || e.pending[0] != cmd {
+		return e.Executor.ExecuteShell(cmd)
+	}
+	e.pending = e.pending[1:]
+	start := time.Now()
+	stdout, stderr, err := e.Executor.ExecuteShell(cmd)
+	event := (&Event{Type: TypePostCommand, Server: e.server, Asset: e.asset, Command: cmd, DurationMs: DurationSince(start)}).Finish(err)
+	if exitCode, ok := getExitCode(err); ok {
+		event.ExitCode = &exitCode
+	}
+	Emit(event)
+	return stdout, stderr, err
+}
+
+func getExitCode(err error) (int, bool) {
+	if err == nil {
+		return 0, true
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus(), true
+	}
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		return execErr.ExitCode(), true
+	}
+	return 0, false
+}
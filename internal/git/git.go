@@ -0,0 +1,102 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A temporary checkout of a single commit of a repository, separate from its working tree.
+type Worktree struct {
+	RepoDir string
+	Dir     string
+	Sha     string
+}
+
+// Returns the SHA of the commit checked out in the repository containing dir.
+func HeadSha(dir string) (string, error) {
+	return run(dir, "rev-parse", "HEAD")
+}
+
+// Whether the working tree of the repository containing dir has uncommitted changes,
+// including untracked files.
+func IsDirty(dir string) (bool, error) {
+	status, err := run(dir, "status", "--porcelain")
+	if err != nil {
+		return false, err
+	}
+	return status != "", nil
+}
+
+// Returns the root of the working tree of the repository containing dir.
+func TopLevel(dir string) (string, error) {
+	return run(dir, "rev-parse", "--show-toplevel")
+}
+
+// Returns the SHA of the commit that ref (a branch, tag or commit) points to in the
+// repository containing dir.
+func ResolveRef(dir string, ref string) (string, error) {
+	if strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid git ref %s", ref)
+	}
+	sha, err := run(dir, "rev-parse", "--verify", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown git ref %s: %w", ref, err)
+	}
+	return sha, nil
+}
+
+// Checks ref out into a new worktree in a temporary directory, detached from any branch.
+// The worktree must be removed once it is no longer needed.
+func AddWorktree(dir string, ref string) (*Worktree, error) {
+	repoDir, err := TopLevel(dir)
+	if err != nil {
+		return nil, err
+	}
+	sha, err := ResolveRef(repoDir, ref)
+	if err != nil {
+		return nil, err
+	}
+	worktreeDir, err := os.MkdirTemp("", "smt-worktree-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create worktree directory: %w", err)
+	}
+	if _, err := run(repoDir, "worktree", "add", "--detach", worktreeDir, sha); err != nil {
+		os.RemoveAll(worktreeDir)
+		return nil, err
+	}
+	return &Worktree{RepoDir: repoDir, Dir: worktreeDir, Sha: sha}, nil
+}
+
+// Maps a path within the repository's working tree to the same path within the worktree.
+func (w *Worktree) Path(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path %s: %w", path, err)
+	}
+	rel, err := filepath.Rel(w.RepoDir, resolved)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is not within the git repository at %s", path, w.RepoDir)
+	}
+	return filepath.Join(w.Dir, rel), nil
+}
+
+func (w *Worktree) Remove() error {
+	_, err := run(w.RepoDir, "worktree", "remove", "--force", w.Dir)
+	return err
+}
+
+func run(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed in %s (stderr: %s): %w", strings.Join(args, " "), dir, strings.TrimSpace(stderr.String()), err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,64 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddWorktree(t *testing.T) {
+	repoDir := t.TempDir()
+	projectDir := filepath.Join(repoDir, "services", "foo")
+	if err := os.MkdirAll(projectDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(projectDir, "smt.json")
+	commit := func(contents string) {
+		if err := os.WriteFile(configPath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{
+			{"add", "-A"},
+			{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", contents},
+		} {
+			if _, err := run(repoDir, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := run(repoDir, "init", "-q"); err != nil {
+		t.Skipf("git unavailable: %v", err)
+	}
+	commit("v1")
+	if _, err := run(repoDir, "tag", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	commit("v2")
+	// Uncommitted edits in the working tree are not part of the worktree
+	os.WriteFile(configPath, []byte("dirty"), 0644)
+
+	w, err := AddWorktree(projectDir, "v1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Remove()
+
+	path, err := w.Path(configPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if contents, err := os.ReadFile(path); err != nil || string(contents) != "v1" {
+		t.Errorf("expected worktree to contain v1, got %q (err: %v)", contents, err)
+	}
+
+	if err := w.Remove(); err != nil {
+		t.Errorf("unexpected error removing worktree: %v", err)
+	}
+	if _, err := os.Stat(w.Dir); !os.IsNotExist(err) {
+		t.Errorf("expected worktree directory to be removed, got %v", err)
+	}
+
+	if _, err := AddWorktree(projectDir, "v3"); err == nil {
+		t.Errorf("expected error for unknown ref, got none")
+	}
+}
@@ -0,0 +1,110 @@
+package health
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	containerHealthy  string = "healthy"
+	containerNoHealth string = "none"
+)
+
+// Result of a single probe. A probe that returns an error cannot succeed by retrying
+// (e.g. the check is misconfigured), so polling stops immediately.
+type probe func(exec deploy.Executor) (bool, string, error)
+
+// Polls the health check against the service deployed at servicePath until it passes or
+// the check's timeout elapses. env is the project's env, used to resolve API_PORT for
+// HTTP checks. If composeProject is given, container & command checks target that compose
+// project (through COMPOSE_PROJECT_NAME) rather than the default one.
+func WaitForHealthy(exec deploy.Executor, servicePath string, composeProject string, check *project.HealthCheck, env map[string]string) error {
+	p, err := buildProbe(servicePath, composeProject, check, env)
+	if err != nil {
+		return err
+	}
+
+	timeout := check.Timeout()
+	deadline := time.Now().Add(timeout)
+	for {
+		healthy, detail, err := p(exec)
+		if err != nil {
+			return err
+		}
+		if healthy {
+			slog.Info("service is healthy", "path", servicePath, "server", exec.Name())
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("[%s] service did not become healthy within %s: %s", exec.Name(), timeout, detail)
+		}
+		slog.Debug("service not yet healthy", "path", servicePath, "server", exec.Name(), "detail", detail)
+		time.Sleep(check.Interval())
+	}
+}
+
+func buildProbe(servicePath string, composeProject string, check *project.HealthCheck, env map[string]string) (probe, error) {
+	scriptPrefix := ""
+	if composeProject != "" {
+		scriptPrefix = fmt.Sprintf("export COMPOSE_PROJECT_NAME=%s %s=%s; ",
+			utils.ShellQuote(composeProject), project.ApiPortEnvName, utils.ShellQuote(env[project.ApiPortEnvName]))
+	}
+
+	switch {
+	case check.HttpPath != "":
+		port, prs := env[project.ApiPortEnvName]
+		if !prs || port == "" {
+			return nil, fmt.Errorf("HTTP health check requires %s to be set in the project env", project.ApiPortEnvName)
+		}
+		path := check.HttpPath
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		url := fmt.Sprintf("http://localhost:%s%s", port, path)
+		return func(exec deploy.Executor) (bool, string, error) {
+			_, stderr, err := exec.ExecuteCommand("curl", "-fsS", "-o", "/dev/null", "--max-time", "5", url)
+			if err != nil {
+				return false, fmt.Sprintf("GET %s failed: %s", url, strings.TrimSpace(stderr)), nil
+			}
+			return true, "", nil
+		}, nil
+	case check.Container != "":
+		script := scriptPrefix + fmt.Sprintf(
+			"for id in $(docker compose ps -q %s); do docker inspect --format '{{if .State.Health}}{{.State.Health.Status}}{{else}}%s{{end}}' \"$id\"; done",
+			utils.ShellQuote(check.Container), containerNoHealth)
+		return func(exec deploy.Executor) (bool, string, error) {
+			stdout, stderr, err := exec.ExecuteShellInDir(servicePath, script)
+			if err != nil {
+				return false, fmt.Sprintf("failed to inspect container %s: %s", check.Container, strings.TrimSpace(stderr)), nil
+			}
+			statuses := strings.Fields(stdout)
+			if len(statuses) == 0 {
+				return false, fmt.Sprintf("container %s is not running", check.Container), nil
+			}
+			for _, s := range statuses {
+				if s == containerNoHealth {
+					return false, "", fmt.Errorf("[%s] container %s does not define a healthcheck", exec.Name(), check.Container)
+				}
+				if s != containerHealthy {
+					return false, fmt.Sprintf("container %s is %s", check.Container, s), nil
+				}
+			}
+			return true, "", nil
+		}, nil
+	case check.Command != "":
+		return func(exec deploy.Executor) (bool, string, error) {
+			stdout, stderr, err := exec.ExecuteShellInDir(servicePath, scriptPrefix+check.Command)
+			if err != nil {
+				return false, fmt.Sprintf("command failed (stdout: %s) (stderr: %s): %v", strings.TrimSpace(stdout), strings.TrimSpace(stderr), err), nil
+			}
+			return true, "", nil
+		}, nil
+	}
+	return nil, fmt.Errorf("health check has nothing to check")
+}
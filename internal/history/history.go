@@ -0,0 +1,101 @@
+package history
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	HistoryFileName string = "history.jsonl"
+
+	ResultSucceeded string = "succeeded"
+	ResultFailed    string = "failed"
+)
+
+// Record of a single change made to a service on the server.
+type Entry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Operation   string    `json:"operation"`
+	Operator    string    `json:"operator"`
+	Host        string    `json:"host"`
+	GitSha      string    `json:"git_sha,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	Release     string    `json:"release,omitempty"`
+	Changed     []string  `json:"changed"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func GetHistoryPath(servicePath string) string {
+	return filepath.Join(servicePath, HistoryFileName)
+}
+
+// Starts an entry for an operation run by the local user now.
+func NewEntry(operation string, gitSha string, environment string) *Entry {
+	operator, host := utils.GetOperator()
+	return &Entry{
+		Timestamp:   time.Now().UTC(),
+		Operation:   operation,
+		Operator:    operator,
+		Host:        host,
+		GitSha:      gitSha,
+		Environment: environment,
+		Changed:     []string{},
+	}
+}
+
+// Sets the result of the entry from the error the operation returned.
+func (e *Entry) Finish(err error) {
+	if err != nil {
+		e.Result = ResultFailed
+		e.Error = err.Error()
+	} else {
+		e.Result = ResultSucceeded
+	}
+}
+
+// Appends the entry to the history file of the service at servicePath on the server.
+func Append(exec deploy.Executor, servicePath string, entry *Entry) error {
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize history entry: %w", err)
+	}
+	historyPath := GetHistoryPath(servicePath)
+	b64Contents := base64.StdEncoding.EncodeToString(append(contents, '\n'))
+	if _, _, err := exec.ExecuteShell(fmt.Sprintf("mkdir -p '%s' && echo '%s' | base64 -d >> '%s'", filepath.Dir(historyPath), b64Contents, historyPath)); err != nil {
+		return fmt.Errorf("[%s] failed to append to history %s: %w", exec.Name(), historyPath, err)
+	}
+	return nil
+}
+
+// Reads the history of the service at servicePath from the server, oldest first.
+func Load(exec deploy.Executor, servicePath string) ([]*Entry, error) {
+	historyPath := GetHistoryPath(servicePath)
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("test -f '%s' && cat '%s'; true", historyPath, historyPath))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to read history %s: %w", exec.Name(), historyPath, err)
+	}
+
+	entries := []*Entry{}
+	decoder := json.NewDecoder(strings.NewReader(stdout))
+	for {
+		var entry *Entry
+		if err := decoder.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("[%s] failed to parse history %s: %w", exec.Name(), historyPath, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,81 @@
+package hooks
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+// Describes the deploy a hook runs for. Exposed to hook commands as SMT_* variables.
+type Context struct {
+	Name        string
+	Server      string
+	Hostname    string
+	ServiceDir  string
+	Environment string
+	// Assets changed by the deploy; only known for post-deploy hooks
+	Changed []string
+}
+
+// Runs the hooks of the given stage in order. Hooks whose on_changed assets did not change
+// are skipped. Returns an error for the first failing hook that does not ignore failures.
+func Run(hooks []*project.Hook, stage string, remote deploy.Executor, projectDir string, ctx *Context, dryRun bool) error {
+	for _, h := range hooks {
+		if h.Stage != stage {
+			continue
+		}
+		if len(h.OnChanged) > 0 && !slices.ContainsFunc(h.OnChanged, func(a string) bool { return slices.Contains(ctx.Changed, a) }) {
+			slog.Debug("skipping hook; none of its assets changed", "hook", h.Name, "on-changed", h.OnChanged)
+			continue
+		}
+
+		location := h.GetLocation()
+		if dryRun {
+			slog.Info("DRY RUN: running hook", "hook", h.Name, "stage", stage, "location", location, "command", h.Command)
+			continue
+		}
+
+		slog.Info("running hook", "hook", h.Name, "stage", stage, "location", location, "server", ctx.Server)
+		script := ctx.exports() + h.Command
+		var stdout, stderr string
+		var err error
+		if location == project.HookLocationLocal {
+			stdout, stderr, err = utils.ExecuteCommandInDir(projectDir, "bash", "-c", script)
+		} else {
+			// The service directory does not exist yet before the first deploy
+			script = fmt.Sprintf("cd %s 2>/dev/null || cd /\n%s", utils.ShellQuote(ctx.ServiceDir), script)
+			stdout, stderr, err = remote.ExecuteShell(script)
+		}
+		if err != nil {
+			hookErr := fmt.Errorf("%s hook %s failed (stdout: %s) (stderr: %s): %w", stage, h.Name, strings.TrimSpace(stdout), strings.TrimSpace(stderr), err)
+			if h.IgnoreFailure {
+				slog.Warn("hook failed; ignoring", "hook", h.Name, "err", hookErr)
+				continue
+			}
+			return hookErr
+		}
+		slog.Debug("hook succeeded", "hook", h.Name, "stdout", stdout)
+	}
+	return nil
+}
+
+func (c *Context) exports() string {
+	vars := [][2]string{
+		{"SMT_NAME", c.Name},
+		{"SMT_SERVER", c.Server},
+		{"SMT_HOSTNAME", c.Hostname},
+		{"SMT_SERVICE_DIR", c.ServiceDir},
+		{"SMT_ENV", c.Environment},
+		{"SMT_CHANGED", strings.Join(c.Changed, " ")},
+	}
+	builder := strings.Builder{}
+	for _, v := range vars {
+		builder.WriteString(fmt.Sprintf("export %s=%s\n", v[0], utils.ShellQuote(v[1])))
+	}
+	return builder.String()
+}
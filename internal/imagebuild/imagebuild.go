@@ -0,0 +1,69 @@
+package imagebuild
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/mrshanahan/deploy-assets/pkg/executor"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/docker"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	GitShaBuildArg string = "GIT_SHA"
+
+	defaultDockerfile string = "Dockerfile"
+)
+
+// Builds each of the project's images, passing compareValue as the GIT_SHA build arg &
+// setting it as the value of the project's image compare label, then verifies that every
+// built image carries the label. Images without an entry in image_builds are built from
+// the Dockerfile at the root of the project.
+func BuildImages(c *project.ProjectConfig, compareValue string) error {
+	if c.ImageCompareLabel == "" {
+		return fmt.Errorf("building images requires an image_compare_label in %s", c.ProjectConfigPath)
+	}
+
+	for _, image := range c.ImageNames {
+		contextDir, dockerfile := c.ProjectDir, filepath.Join(c.ProjectDir, defaultDockerfile)
+		if b, prs := c.ImageBuilds[image]; prs {
+			if b.Context != "" {
+				contextDir = filepath.Join(c.ProjectDir, b.Context)
+			}
+			if b.Dockerfile != "" {
+				dockerfile = filepath.Join(c.ProjectDir, b.Dockerfile)
+			} else {
+				dockerfile = filepath.Join(contextDir, defaultDockerfile)
+			}
+		}
+
+		slog.Info("building image", "image", image, "context", contextDir, "dockerfile", dockerfile, "git-sha", compareValue)
+		_, stderr, err := utils.ExecuteCommandInDir(contextDir, "docker", "build",
+			"--build-arg", fmt.Sprintf("%s=%s", GitShaBuildArg, compareValue),
+			"--label", fmt.Sprintf("%s=%s", c.ImageCompareLabel, compareValue),
+			"-f", dockerfile,
+			"-t", image,
+			".")
+		if err != nil {
+			return fmt.Errorf("failed to build image %s (stderr: %s): %w", image, stderr, err)
+		}
+	}
+
+	local := executor.NewLocalExecutor("local")
+	defer local.Close()
+	for _, image := range c.ImageNames {
+		built, err := docker.InspectImage(local, image, c.ImageCompareLabel)
+		if err != nil {
+			return err
+		}
+		if built == nil {
+			return fmt.Errorf("image %s does not exist after building it", image)
+		}
+		if built.CompareValue != compareValue {
+			return fmt.Errorf("built image %s has %s=%s, expected %s", image, c.ImageCompareLabel, built.CompareValue, compareValue)
+		}
+	}
+	return nil
+}
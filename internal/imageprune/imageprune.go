@@ -0,0 +1,162 @@
+package imageprune
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/docker"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/release"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+// An image on the server carrying the compare label of one of a service's image names.
+type Image struct {
+	Repository string    `json:"repository"`
+	ID         string    `json:"id"`
+	Tags       []string  `json:"tags"`
+	Created    time.Time `json:"created"`
+	Size       int64     `json:"size"`
+}
+
+// Finds the images of each of imageNames that fall outside the retention policy & removes
+// them unless dryRun is set. Images are found by the compare label; the newest keep images of
+// each name are retained, as are the image currently tagged with the name, any image used by
+// a container & any image whose ID is in retained. Returns the images that were (or would be)
+// removed.
+//
+// Removing an image also removes its release tags, so retained should hold the images of every
+// release that is kept (see release.Prune) for them to stay possible to roll back to.
+func Prune(exec deploy.Executor, imageNames []string, compareLabel string, keep int, retained []string, dryRun bool) ([]*Image, error) {
+	if compareLabel == "" {
+		return nil, fmt.Errorf("images can only be pruned with an image compare label")
+	}
+	if keep < 1 {
+		return nil, fmt.Errorf("invalid number of images to keep: %d (must be at least 1)", keep)
+	}
+
+	inUse, err := listImagesInUse(exec)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []*Image{}
+	for _, name := range imageNames {
+		repository, _ := release.SplitImageReference(name)
+		images, err := listImages(exec, repository, compareLabel)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range SelectPrunable(images, name, keep, slices.Concat(inUse, retained)) {
+			if dryRun {
+				slog.Info("DRY RUN: removing image", "dst", exec.Name(), "image", i.ID, "tags", i.Tags)
+			} else {
+				// Images pulled by digest have no tags, so they can only be removed by ID
+				refs := i.Tags
+				if len(refs) == 0 {
+					refs = []string{i.ID}
+				}
+				if _, stderr, err := exec.ExecuteCommand("docker", append([]string{"image", "rm"}, refs...)...); err != nil {
+					return pruned, fmt.Errorf("[%s] failed to remove image %s (stderr: %s): %w", exec.Name(), i.ID, strings.TrimSpace(stderr), err)
+				}
+				slog.Info("removed image", "dst", exec.Name(), "image", i.ID, "tags", i.Tags)
+			}
+			pruned = append(pruned, i)
+		}
+	}
+	return pruned, nil
+}
+
+// Selects the images that fall outside the retention policy: all but the newest keep images,
+// excluding the image tagged as current & any whose ID is in inUse.
+func SelectPrunable(images []*Image, current string, keep int, inUse []string) []*Image {
+	sorted := slices.Clone(images)
+	slices.SortStableFunc(sorted, func(x, y *Image) int { return y.Created.Compare(x.Created) })
+
+	prunable := []*Image{}
+	for idx, i := range sorted {
+		isCurrent := slices.ContainsFunc(i.Tags, func(tag string) bool { return docker.SameImage(tag, current) })
+		if idx < keep || isCurrent || slices.Contains(inUse, i.ID) {
+			continue
+		}
+		prunable = append(prunable, i)
+	}
+	return prunable
+}
+
+// Sums the sizes of the given images. Images can share layers, so this is an upper bound on
+// the space that removing them frees.
+func TotalSize(images []*Image) int64 {
+	var total int64
+	for _, i := range images {
+		total += i.Size
+	}
+	return total
+}
+
+func listImages(exec deploy.Executor, repository string, compareLabel string) ([]*Image, error) {
+	stdout, stderr, err := exec.ExecuteCommand("docker", "image", "ls", "--no-trunc",
+		"--filter", fmt.Sprintf("reference=%s", repository),
+		"--filter", fmt.Sprintf("label=%s", compareLabel),
+		"--format", "{{ .ID }} {{ .Repository }}:{{ .Tag }}")
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to list images of %s (stderr: %s): %w", exec.Name(), repository, strings.TrimSpace(stderr), err)
+	}
+
+	byId := map[string]*Image{}
+	ids := []string{}
+	for _, l := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		id, tag, found := strings.Cut(strings.TrimSpace(l), " ")
+		if !found {
+			continue
+		}
+		image, prs := byId[id]
+		if !prs {
+			image = &Image{Repository: repository, ID: id, Tags: []string{}}
+			byId[id] = image
+			ids = append(ids, id)
+		}
+		if !strings.HasSuffix(tag, ":<none>") {
+			image.Tags = append(image.Tags, tag)
+		}
+	}
+	if len(ids) == 0 {
+		return []*Image{}, nil
+	}
+
+	stdout, stderr, err = exec.ExecuteCommand("docker", append([]string{"image", "inspect", "--format", "{{ .Id }} {{ .Created }} {{ .Size }}"}, ids...)...)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to inspect images of %s (stderr: %s): %w", exec.Name(), repository, strings.TrimSpace(stderr), err)
+	}
+	for _, l := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		comps := strings.Fields(l)
+		if len(comps) != 3 {
+			return nil, fmt.Errorf("[%s] unexpected output inspecting images of %s: %s", exec.Name(), repository, l)
+		}
+		image, prs := byId[comps[0]]
+		if !prs {
+			continue
+		}
+		if image.Created, err = time.Parse(time.RFC3339Nano, comps[1]); err != nil {
+			return nil, fmt.Errorf("[%s] failed to parse creation time of image %s: %w", exec.Name(), image.ID, err)
+		}
+		if image.Size, err = strconv.ParseInt(comps[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("[%s] failed to parse size of image %s: %w", exec.Name(), image.ID, err)
+		}
+	}
+
+	return utils.Map(ids, func(id string) *Image { return byId[id] }), nil
+}
+
+// Lists the IDs of the images used by any container, running or not.
+func listImagesInUse(exec deploy.Executor) ([]string, error) {
+	stdout, stderr, err := exec.ExecuteShell("docker container ls --all --quiet | xargs -r docker container inspect --format '{{ .Image }}'")
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to list images used by containers (stderr: %s): %w", exec.Name(), strings.TrimSpace(stderr), err)
+	}
+	return strings.Fields(stdout), nil
+}
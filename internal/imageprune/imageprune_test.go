@@ -0,0 +1,101 @@
+package imageprune
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+func TestSelectPrunable(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	image := func(id string, daysOld int, tags ...string) *Image {
+		return &Image{ID: id, Tags: tags, Created: base.AddDate(0, 0, -daysOld)}
+	}
+	images := []*Image{
+		image("a", 5, "app:smt-release-a"),
+		image("b", 0, "app:latest"),
+		image("c", 3, "app:smt-release-c"),
+		image("d", 1, "app:smt-release-d"),
+		image("e", 4, "app:smt-release-e"),
+	}
+
+	cases := []struct {
+		testName string
+		current  string
+		keep     int
+		inUse    []string
+		expected []string
+	}{
+		{"keeps newest", "app:latest", 2, []string{}, []string{"c", "e", "a"}},
+		{"keeps all", "app:latest", 5, []string{}, []string{}},
+		{"keeps current", "app:smt-release-a", 1, []string{}, []string{"d", "c", "e"}},
+		{"keeps in use", "app:latest", 2, []string{"e"}, []string{"c", "a"}},
+		{"keeps current without tag", "app", 1, []string{}, []string{"d", "c", "e", "a"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testName, func(s *testing.T) {
+			actual := utils.Map(SelectPrunable(images, c.current, c.keep, c.inUse), func(i *Image) string { return i.ID })
+			if !slices.Equal(actual, c.expected) {
+				s.Errorf("expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+
+	// After a rollback the current image is older than the newest release
+	rolledBack := []*Image{
+		image("new", 0, "app:smt-release-new"),
+		image("old", 3, "app:latest", "app:smt-release-old"),
+	}
+	if actual := SelectPrunable(rolledBack, "app", 1, []string{}); len(actual) != 0 {
+		t.Errorf("expected current image to be kept after rollback, got %v", utils.Map(actual, func(i *Image) string { return i.ID }))
+	}
+}
+
+type fakeExecutor struct {
+	replies map[string]string
+	ran     []string
+}
+
+func (e *fakeExecutor) Name() string          { return "fake" }
+func (e *fakeExecutor) Yaml(depth int) string { return "" }
+func (e *fakeExecutor) ExecuteCommand(name string, args ...string) (string, string, error) {
+	return e.ExecuteShell(name + " " + strings.Join(args, " "))
+}
+func (e *fakeExecutor) ExecuteCommandInDir(workingDir string, name string, args ...string) (string, string, error) {
+	return e.ExecuteCommand(name, args...)
+}
+func (e *fakeExecutor) ExecuteShell(cmd string) (string, string, error) {
+	e.ran = append(e.ran, cmd)
+	for prefix, reply := range e.replies {
+		if strings.HasPrefix(cmd, prefix) {
+			return reply, "", nil
+		}
+	}
+	return "", "", nil
+}
+func (e *fakeExecutor) ExecuteShellInDir(workingDir string, cmd string) (string, string, error) {
+	return e.ExecuteShell(cmd)
+}
+func (e *fakeExecutor) Close() {}
+
+func TestPruneUntaggedImages(t *testing.T) {
+	exec := &fakeExecutor{replies: map[string]string{
+		"docker image ls":      "sha256:new app:latest\nsha256:old app:<none>\n",
+		"docker image inspect": "sha256:new 2026-01-02T00:00:00Z 100\nsha256:old 2026-01-01T00:00:00Z 100\n",
+	}}
+
+	pruned, err := Prune(exec, []string{"app:latest"}, "app.version", 1, []string{}, false)
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if len(pruned) != 1 || pruned[0].ID != "sha256:old" || len(pruned[0].Tags) != 0 {
+		t.Fatalf("expected the untagged image to be pruned, got %+v", pruned)
+	}
+	if !slices.Contains(exec.ran, "docker image rm sha256:old") {
+		t.Errorf("expected the untagged image to be removed by ID, ran %v", exec.ran)
+	}
+}
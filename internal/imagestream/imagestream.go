@@ -0,0 +1,259 @@
+package imagestream
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/docker"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/sshclient"
+)
+
+const (
+	remoteLoadCommand string = "bash -c 'set -o pipefail; gunzip | sudo docker load'"
+	layerBlobPrefix   string = "blobs/sha256/"
+)
+
+// Creates a provider that syncs Docker images by piping `docker save` on the local machine
+// directly into `docker load` on the remote server over SSH, rather than staging the image
+// through the manifest's transport. Layers that the remote daemon already has are omitted
+// from the stream where the archive format allows it.
+func NewDockerStreamProvider(name string, repositories []string, compareLabel string, addr string, user string, keyPath string, keyPassphrase string) deploy.Provider {
+	return &dockerStreamProvider{
+		name:          name,
+		repositories:  repositories,
+		compareLabel:  compareLabel,
+		addr:          addr,
+		user:          user,
+		keyPath:       keyPath,
+		keyPassphrase: keyPassphrase,
+	}
+}
+
+type dockerStreamProvider struct {
+	name          string
+	repositories  []string
+	compareLabel  string
+	addr          string
+	user          string
+	keyPath       string
+	keyPassphrase string
+}
+
+func (p *dockerStreamProvider) Name() string { return p.name }
+
+func (p *dockerStreamProvider) Yaml(indent int) string {
+	propIndent := strings.Repeat(" ", indent+4)
+	repositoryLines := []string{}
+	for _, r := range p.repositories {
+		repositoryLines = append(repositoryLines, fmt.Sprintf("%s- %s", strings.Repeat(" ", indent+8), r))
+	}
+	return fmt.Sprintf(
+		`%sdocker_stream:
+%sname: %s
+%srepositories:
+%s
+%scompare_label: %s
+%saddr: %s
+%suser: %s`,
+		strings.Repeat(" ", indent),
+		propIndent, p.name,
+		propIndent,
+		strings.Join(repositoryLines, "\n"),
+		propIndent, p.compareLabel,
+		propIndent, p.addr,
+		propIndent, p.user)
+}
+
+func (p *dockerStreamProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	srcName, dstName := cfg.SrcExecutor.Name(), cfg.DstExecutor.Name()
+
+	toTransfer := []*docker.Image{}
+	result := deploy.SYNC_RESULT_NOCHANGE
+	for _, r := range p.repositories {
+		srcImage, err := docker.InspectImage(cfg.SrcExecutor, r, p.compareLabel)
+		if err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+		if srcImage == nil {
+			return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("missing image %s in %s", r, srcName)
+		}
+		dstImage, err := docker.InspectImage(cfg.DstExecutor, r, p.compareLabel)
+		if err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+
+		if dstImage == nil {
+			result = deploy.SYNC_RESULT_CREATED
+		} else if imagesMatch(srcImage, dstImage) {
+			slog.Debug("image up to date", "name", p.Name(), "image", r, "src", srcName, "dst", dstName)
+			continue
+		} else if result == deploy.SYNC_RESULT_NOCHANGE {
+			result = deploy.SYNC_RESULT_UPDATED
+		}
+		toTransfer = append(toTransfer, srcImage)
+	}
+
+	if len(toTransfer) == 0 {
+		slog.Info("no images to transfer", "name", p.Name(), "src", srcName, "dst", dstName)
+		return deploy.SYNC_RESULT_NOCHANGE, nil
+	}
+
+	if cfg.DryRun {
+		slog.Info("DRY RUN: streaming images", "src", srcName, "dst", dstName)
+		for _, i := range toTransfer {
+			slog.Info("DRY RUN: stream", "image", i.Reference)
+		}
+		return result, nil
+	}
+
+	dstLayers, err := docker.ListImageLayers(cfg.DstExecutor)
+	if err != nil {
+		return deploy.SYNC_RESULT_NOCHANGE, err
+	}
+	skip := map[string]bool{}
+	refs := []string{}
+	for _, i := range toTransfer {
+		for _, l := range docker.SharedLayers(i.Layers, dstLayers) {
+			skip[l] = true
+		}
+		refs = append(refs, i.Reference)
+	}
+
+	slog.Info("streaming docker images", "src", srcName, "dst", dstName, "images", refs, "skipped-layers", len(skip))
+	if err := p.stream(refs, skip); err != nil {
+		if len(skip) == 0 {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+		slog.Warn("failed to stream images with existing layers omitted; retrying with all layers", "dst", dstName, "err", err)
+		if err := p.stream(refs, map[string]bool{}); err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+	}
+
+	return result, nil
+}
+
+func (p *dockerStreamProvider) Digest(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+	srcDigest, err := plan.HashImages(src, p.repositories)
+	if err != nil {
+		return nil, err
+	}
+	dstDigest, err := plan.HashImages(dst, p.repositories)
+	if err != nil {
+		return nil, err
+	}
+	return &plan.Digest{Src: srcDigest, Dst: dstDigest}, nil
+}
+
+func imagesMatch(src *docker.Image, dst *docker.Image) bool {
+	if src.CompareValue != "" || dst.CompareValue != "" {
+		return src.CompareValue == dst.CompareValue
+	}
+	return src.ID == dst.ID
+}
+
+func (p *dockerStreamProvider) stream(refs []string, skip map[string]bool) error {
+	client, err := sshclient.CreateSshClient(p.addr, p.user, p.keyPath, p.keyPassphrase)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create ssh session: %w", err)
+	}
+	defer session.Close()
+
+	stdinReader, stdinWriter := io.Pipe()
+	var loadStdout, loadStderr bytes.Buffer
+	session.Stdin = stdinReader
+	session.Stdout = &loadStdout
+	session.Stderr = &loadStderr
+
+	save := exec.Command("docker", append([]string{"save"}, refs...)...)
+	var saveStderr bytes.Buffer
+	save.Stderr = &saveStderr
+	saveStdout, err := save.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open docker save output: %w", err)
+	}
+	if err := save.Start(); err != nil {
+		return fmt.Errorf("failed to start docker save: %w", err)
+	}
+
+	filterDone := make(chan error, 1)
+	go func() {
+		gz := gzip.NewWriter(stdinWriter)
+		err := filterImageArchive(saveStdout, gz, skip)
+		if err == nil {
+			err = gz.Close()
+		}
+		stdinWriter.CloseWithError(err)
+		filterDone <- err
+	}()
+
+	loadErr := session.Run(remoteLoadCommand)
+	// Unblock the filter if the remote side exited before consuming everything
+	stdinReader.CloseWithError(io.ErrClosedPipe)
+	if loadErr != nil {
+		save.Process.Kill()
+	}
+	filterErr := <-filterDone
+	saveErr := save.Wait()
+
+	if loadErr != nil {
+		return fmt.Errorf("failed to load images on remote (stdout: %s) (stderr: %s): %w", loadStdout.String(), loadStderr.String(), loadErr)
+	}
+	if saveErr != nil {
+		return fmt.Errorf("failed to export images (stderr: %s): %w", saveStderr.String(), saveErr)
+	}
+	if filterErr != nil && !errors.Is(filterErr, io.ErrClosedPipe) {
+		return fmt.Errorf("failed to stream images: %w", filterErr)
+	}
+
+	slog.Debug("streamed docker images", "images", refs, "stdout", loadStdout.String())
+	return nil
+}
+
+// Copies the `docker save` archive from r to w, dropping layer blobs whose diff IDs are
+// in skip. Only OCI-layout archives name their blobs by digest; archives in the legacy
+// format are copied in full.
+func filterImageArchive(r io.Reader, w io.Writer, skip map[string]bool) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("failed to read image archive: %w", err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg && strings.HasPrefix(hdr.Name, layerBlobPrefix) {
+			diffId := "sha256:" + strings.TrimPrefix(hdr.Name, layerBlobPrefix)
+			if skip[diffId] {
+				slog.Debug("omitting layer already present on remote", "layer", diffId)
+				continue
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write image archive: %w", err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("failed to write image archive: %w", err)
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,65 @@
+package imagestream
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestFilterImageArchive(t *testing.T) {
+	entries := []string{
+		"blobs/sha256/aaa",
+		"blobs/sha256/bbb",
+		"blobs/sha256/ccc",
+		"index.json",
+		"manifest.json",
+	}
+
+	var input bytes.Buffer
+	tw := tar.NewWriter(&input)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e))}); err != nil {
+			t.Fatalf("failed to write test archive header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e)); err != nil {
+			t.Fatalf("failed to write test archive entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close test archive: %v", err)
+	}
+
+	var output bytes.Buffer
+	skip := map[string]bool{"sha256:aaa": true, "sha256:ccc": true}
+	if err := filterImageArchive(&input, &output, skip); err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+
+	actual := []string{}
+	tr := tar.NewReader(&output)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read filtered archive: %v", err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read filtered archive entry: %v", err)
+		}
+		if string(contents) != hdr.Name {
+			t.Errorf("entry %s has wrong contents: %s", hdr.Name, contents)
+		}
+		actual = append(actual, hdr.Name)
+	}
+
+	expected := []string{"blobs/sha256/bbb", "index.json", "manifest.json"}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("expected entries %v, got %v", expected, actual)
+	}
+}
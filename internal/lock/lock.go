@@ -0,0 +1,217 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/install"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	LocksDirName string = "locks"
+
+	// Locks older than this are assumed to have been left behind by a crashed or
+	// interrupted command and are taken over.
+	DefaultLockExpiry time.Duration = 2 * time.Hour
+
+	// Name of the lock held while the server config is re-read & saved. Names of services
+	// created by `smt new` cannot start with a dot, so it does not collide with their locks.
+	ServerConfigLockName string = ".smt-config"
+	// The server config lock is only held for a read & a write, so it is waited for rather
+	// than failing, & taken over once it is older than its expiry
+	ServerConfigLockWait   time.Duration = 30 * time.Second
+	ServerConfigLockExpiry time.Duration = time.Minute
+)
+
+// Lock on a service held while a command changes it on the server.
+type Lock struct {
+	ID        string    `json:"id"`
+	Service   string    `json:"service"`
+	Operation string    `json:"operation"`
+	Holder    string    `json:"holder"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func GetLockPath(name string) string {
+	return filepath.Join(install.DefaultServicesDir, LocksDirName, fmt.Sprintf("%s.lock", name))
+}
+
+// Takes the lock on the named service on the server. If another command holds the lock, an
+// error naming the holder is returned, unless the lock has expired or breakLock is set, in
+// which case the existing lock is replaced.
+func Acquire(exec deploy.Executor, name string, operation string, breakLock bool) (*Lock, error) {
+	lock, err := newLock(name, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	acquired, err := tryAcquire(exec, lock)
+	if err != nil {
+		return nil, err
+	}
+	if acquired {
+		slog.Debug("acquired service lock", "name", name, "server", exec.Name(), "id", lock.ID)
+		return lock, nil
+	}
+
+	existing, err := readLock(exec, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		age := time.Since(existing.StartedAt)
+		switch {
+		case breakLock:
+			slog.Warn("breaking service lock", "name", name, "server", exec.Name(), "holder", existing.Holder, "host", existing.Host, "operation", existing.Operation, "started-at", existing.StartedAt)
+		case age > DefaultLockExpiry:
+			slog.Warn("service lock has expired; taking it over", "name", name, "server", exec.Name(), "holder", existing.Holder, "host", existing.Host, "started-at", existing.StartedAt)
+		default:
+			return nil, fmt.Errorf("[%s] service %s is locked by %s@%s (%s, started %s ago at %s); wait for it to finish or re-run with -break-lock",
+				exec.Name(), name, existing.Holder, existing.Host, existing.Operation, age.Round(time.Second), existing.StartedAt.Local().Format(time.RFC3339))
+		}
+	}
+
+	lockPath := GetLockPath(name)
+	if _, _, err := exec.ExecuteCommand("rm", "-f", lockPath); err != nil {
+		return nil, fmt.Errorf("[%s] failed to remove lock %s: %w", exec.Name(), lockPath, err)
+	}
+	acquired, err = tryAcquire(exec, lock)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, fmt.Errorf("[%s] service %s was locked by another command while replacing its lock; try again", exec.Name(), name)
+	}
+	return lock, nil
+}
+
+// Takes the lock on the server config, waiting for another command holding it to finish.
+// Every command changing the server config must hold it while re-reading & saving it, so
+// that commands changing different services at the same time keep each other's entries.
+func AcquireServerConfig(exec deploy.Executor, operation string) (*Lock, error) {
+	lock, err := newLock(ServerConfigLockName, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(ServerConfigLockWait)
+	for {
+		acquired, err := tryAcquire(exec, lock)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			slog.Debug("acquired server config lock", "server", exec.Name(), "id", lock.ID)
+			return lock, nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	existing, err := readLock(exec, ServerConfigLockName)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && time.Since(existing.StartedAt) <= ServerConfigLockExpiry {
+		return nil, fmt.Errorf("[%s] server config is locked by %s@%s (%s) & was not released within %s; try again",
+			exec.Name(), existing.Holder, existing.Host, existing.Operation, ServerConfigLockWait)
+	}
+	slog.Warn("server config lock has expired; taking it over", "server", exec.Name())
+	lockPath := GetLockPath(ServerConfigLockName)
+	if _, _, err := exec.ExecuteCommand("rm", "-f", lockPath); err != nil {
+		return nil, fmt.Errorf("[%s] failed to remove lock %s: %w", exec.Name(), lockPath, err)
+	}
+	acquired, err := tryAcquire(exec, lock)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, fmt.Errorf("[%s] server config was locked by another command while replacing its lock; try again", exec.Name())
+	}
+	return lock, nil
+}
+
+// Releases the lock, unless it has since been broken & taken by another command.
+func (l *Lock) Release(exec deploy.Executor) error {
+	existing, err := readLock(exec, l.Service)
+	if err != nil {
+		return err
+	}
+	if existing == nil || existing.ID != l.ID {
+		slog.Warn("service lock was taken over by another command; not releasing", "name", l.Service, "server", exec.Name())
+		return nil
+	}
+
+	lockPath := GetLockPath(l.Service)
+	if _, _, err := exec.ExecuteCommand("rm", "-f", lockPath); err != nil {
+		return fmt.Errorf("[%s] failed to release lock %s: %w", exec.Name(), lockPath, err)
+	}
+	slog.Debug("released service lock", "name", l.Service, "server", exec.Name(), "id", l.ID)
+	return nil
+}
+
+func newLock(name string, operation string) (*Lock, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate lock ID: %w", err)
+	}
+
+	holder, host := utils.GetOperator()
+	return &Lock{
+		ID:        hex.EncodeToString(idBytes),
+		Service:   name,
+		Operation: operation,
+		Holder:    holder,
+		Host:      host,
+		StartedAt: time.Now().UTC(),
+	}, nil
+}
+
+// Writes the lock to a temporary file & hard-links it into place, which fails without
+// side-effects if the lock file already exists.
+func tryAcquire(exec deploy.Executor, lock *Lock) (bool, error) {
+	contents, err := json.Marshal(lock)
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize lock: %w", err)
+	}
+	lockPath := GetLockPath(lock.Service)
+	tmpPath := fmt.Sprintf("%s.%s", lockPath, lock.ID)
+	b64Contents := base64.StdEncoding.EncodeToString(contents)
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf(
+		"mkdir -p '%s' && echo '%s' | base64 -d > '%s' && ((ln '%s' '%s' 2>/dev/null && echo 'acquired') || echo 'held'); rm -f '%s'",
+		filepath.Dir(lockPath), b64Contents, tmpPath, tmpPath, lockPath, tmpPath))
+	if err != nil {
+		return false, fmt.Errorf("[%s] failed to write lock %s: %w", exec.Name(), lockPath, err)
+	}
+	return strings.Trim(stdout, " \n") == "acquired", nil
+}
+
+// Reads the lock on the named service, or nil if there is none.
+func readLock(exec deploy.Executor, name string) (*Lock, error) {
+	lockPath := GetLockPath(name)
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("test -f '%s' && cat '%s'; true", lockPath, lockPath))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to read lock %s: %w", exec.Name(), lockPath, err)
+	}
+	if strings.TrimSpace(stdout) == "" {
+		return nil, nil
+	}
+	var lock *Lock
+	if err := json.Unmarshal([]byte(stdout), &lock); err != nil {
+		slog.Warn("failed to parse existing lock; treating it as expired", "path", lockPath, "server", exec.Name(), "err", err)
+		return &Lock{Service: name, Holder: "unknown", Host: "unknown", Operation: "unknown"}, nil
+	}
+	return lock, nil
+}
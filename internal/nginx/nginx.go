@@ -0,0 +1,290 @@
+package nginx
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/content"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	SitesAvailableDir string = "/etc/nginx/sites-available"
+	SitesEnabledDir   string = "/etc/nginx/sites-enabled"
+
+	ReloadCommand string = "nginx -s reload"
+)
+
+// An nginx site config file, named by its file name on the server.
+type Site struct {
+	Name     string
+	Contents string
+}
+
+func GetAvailablePath(name string) string {
+	return filepath.Join(SitesAvailableDir, name)
+}
+
+func GetEnabledPath(name string) string {
+	return filepath.Join(SitesEnabledDir, name)
+}
+
+// Creates a provider that installs & enables the given sites, and disables & removes any
+// site in previousSites that is no longer among them. The existing copies of every site it
+// touches are saved in backupDir first; if `nginx -t` rejects the result, they are put back
+// and the sync fails, leaving the running config untouched. nginx is not reloaded.
+func NewSitesProvider(name string, sites []*Site, previousSites []string, backupDir string) deploy.Provider {
+	return &sitesProvider{
+		name:          name,
+		sites:         sites,
+		previousSites: previousSites,
+		backupDir:     backupDir,
+	}
+}
+
+type sitesProvider struct {
+	name          string
+	sites         []*Site
+	previousSites []string
+	backupDir     string
+}
+
+func (p *sitesProvider) Name() string { return p.name }
+
+func (p *sitesProvider) Yaml(indent int) string {
+	propIndent := strings.Repeat(" ", indent+4)
+	listLines := func(xs []string) string {
+		lines := []string{}
+		for _, x := range xs {
+			lines = append(lines, fmt.Sprintf("%s- %s", strings.Repeat(" ", indent+8), x))
+		}
+		return strings.Join(lines, "\n")
+	}
+	return fmt.Sprintf(
+		`%snginx_sites:
+%sname: %s
+%ssites:
+%s
+%sprevious_sites:
+%s
+%sbackup_dir: %s`,
+		strings.Repeat(" ", indent),
+		propIndent, p.name,
+		propIndent,
+		listLines(siteNames(p.sites)),
+		propIndent,
+		listLines(p.previousSites),
+		propIndent, p.backupDir)
+}
+
+func (p *sitesProvider) Digest(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+	values, paths := []string{}, []string{}
+	for _, s := range p.sites {
+		values = append(values, s.Name, s.Contents)
+	}
+	names := siteNames(p.sites)
+	names = append(names, utils.Filter(p.previousSites, func(n string) bool { return !slices.Contains(names, n) })...)
+	for _, n := range names {
+		// The enabled path is a link, so this tells whether the site is enabled
+		paths = append(paths, GetAvailablePath(n), GetEnabledPath(n))
+	}
+	dstDigest, err := plan.HashRemoteFiles(dst, paths...)
+	if err != nil {
+		return nil, err
+	}
+	return &plan.Digest{Src: plan.HashValues(values...), Dst: dstDigest}, nil
+}
+
+func (p *sitesProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	dst := cfg.DstExecutor
+
+	result := deploy.SYNC_RESULT_NOCHANGE
+	changed := []*Site{}
+	for _, s := range p.sites {
+		siteResult, err := content.CompareRemote(dst, GetAvailablePath(s.Name), s.Contents)
+		if err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+		if siteResult == deploy.SYNC_RESULT_NOCHANGE {
+			enabled, err := isEnabled(dst, s.Name)
+			if err != nil {
+				return deploy.SYNC_RESULT_NOCHANGE, err
+			}
+			if enabled {
+				continue
+			}
+			siteResult = deploy.SYNC_RESULT_UPDATED
+		}
+		changed = append(changed, s)
+		result = combineResults(result, siteResult)
+	}
+
+	names := siteNames(p.sites)
+	orphans := utils.Filter(p.previousSites, func(n string) bool { return !slices.Contains(names, n) })
+	if len(orphans) > 0 {
+		result = combineResults(result, deploy.SYNC_RESULT_UPDATED)
+	}
+
+	if result == deploy.SYNC_RESULT_NOCHANGE {
+		slog.Debug("nginx sites unchanged", "name", p.Name(), "dst", dst.Name())
+		return result, nil
+	}
+
+	if cfg.DryRun {
+		for _, s := range changed {
+			slog.Info("DRY RUN: installing nginx site", "name", p.Name(), "dst", dst.Name(), "site", s.Name)
+		}
+		for _, o := range orphans {
+			slog.Info("DRY RUN: removing nginx site", "name", p.Name(), "dst", dst.Name(), "site", o)
+		}
+		return result, nil
+	}
+
+	touched := append(siteNames(changed), orphans...)
+	if err := p.backup(dst, touched); err != nil {
+		return deploy.SYNC_RESULT_NOCHANGE, err
+	}
+
+	applyErr := p.apply(dst, changed, orphans)
+	if applyErr == nil {
+		_, stderr, err := dst.ExecuteCommand("nginx", "-t")
+		if err != nil {
+			applyErr = fmt.Errorf("[%s] nginx rejected the new site config (stderr: %s): %w", dst.Name(), strings.TrimSpace(stderr), err)
+		}
+	}
+	if applyErr != nil {
+		slog.Warn("restoring previous nginx sites", "name", p.Name(), "dst", dst.Name(), "sites", touched)
+		if err := p.restore(dst, touched); err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("%w; restoring previous nginx sites also failed: %w", applyErr, err)
+		}
+		return deploy.SYNC_RESULT_NOCHANGE, applyErr
+	}
+
+	for _, o := range orphans {
+		slog.Info("removed nginx site no longer in project", "name", p.Name(), "dst", dst.Name(), "site", o)
+	}
+	return result, nil
+}
+
+func (p *sitesProvider) backup(exec deploy.Executor, names []string) error {
+	availableBackup, enabledBackup := filepath.Join(p.backupDir, "available"), filepath.Join(p.backupDir, "enabled")
+	script := []string{
+		fmt.Sprintf("rm -rf %s", utils.ShellQuote(p.backupDir)),
+		fmt.Sprintf("mkdir -p %s %s", utils.ShellQuote(availableBackup), utils.ShellQuote(enabledBackup)),
+	}
+	for _, n := range names {
+		script = append(script,
+			fmt.Sprintf("if test -e %s; then cp -a %s %s; fi", utils.ShellQuote(GetAvailablePath(n)), utils.ShellQuote(GetAvailablePath(n)), utils.ShellQuote(availableBackup)),
+			fmt.Sprintf("if test -L %s; then cp -P %s %s; fi", utils.ShellQuote(GetEnabledPath(n)), utils.ShellQuote(GetEnabledPath(n)), utils.ShellQuote(enabledBackup)))
+	}
+	if _, stderr, err := exec.ExecuteShell(strings.Join(script, " && ")); err != nil {
+		return fmt.Errorf("[%s] failed to back up nginx sites to %s (stderr: %s): %w", exec.Name(), p.backupDir, stderr, err)
+	}
+	return nil
+}
+
+func (p *sitesProvider) apply(exec deploy.Executor, changed []*Site, orphans []string) error {
+	for _, s := range changed {
+		if err := content.WriteRemote(exec, GetAvailablePath(s.Name), s.Contents); err != nil {
+			return err
+		}
+		if _, stderr, err := exec.ExecuteShell(fmt.Sprintf("ln -sfn %s %s", utils.ShellQuote(GetAvailablePath(s.Name)), utils.ShellQuote(GetEnabledPath(s.Name)))); err != nil {
+			return fmt.Errorf("[%s] failed to enable nginx site %s (stderr: %s): %w", exec.Name(), s.Name, stderr, err)
+		}
+	}
+	for _, o := range orphans {
+		if _, stderr, err := exec.ExecuteShell(fmt.Sprintf("rm -f %s %s", utils.ShellQuote(GetEnabledPath(o)), utils.ShellQuote(GetAvailablePath(o)))); err != nil {
+			return fmt.Errorf("[%s] failed to remove nginx site %s (stderr: %s): %w", exec.Name(), o, stderr, err)
+		}
+	}
+	return nil
+}
+
+// Puts the backed-up copies of the named sites back, removing any that did not exist.
+func (p *sitesProvider) restore(exec deploy.Executor, names []string) error {
+	availableBackup, enabledBackup := filepath.Join(p.backupDir, "available"), filepath.Join(p.backupDir, "enabled")
+	script := []string{}
+	for _, n := range names {
+		script = append(script,
+			fmt.Sprintf("rm -f %s %s", utils.ShellQuote(GetAvailablePath(n)), utils.ShellQuote(GetEnabledPath(n))),
+			fmt.Sprintf("if test -e %s; then cp -a %s %s; fi", utils.ShellQuote(filepath.Join(availableBackup, n)), utils.ShellQuote(filepath.Join(availableBackup, n)), utils.ShellQuote(SitesAvailableDir)),
+			fmt.Sprintf("if test -L %s; then cp -P %s %s; fi", utils.ShellQuote(filepath.Join(enabledBackup, n)), utils.ShellQuote(filepath.Join(enabledBackup, n)), utils.ShellQuote(SitesEnabledDir)))
+	}
+	if _, stderr, err := exec.ExecuteShell(strings.Join(script, " && ")); err != nil {
+		return fmt.Errorf("[%s] failed to restore nginx sites from %s (stderr: %s): %w", exec.Name(), p.backupDir, stderr, err)
+	}
+	return nil
+}
+
+// Checks that the named sites can be deployed by service without taking over a site of
+// another service. owners maps each site to the service owning it; a site with no owner is
+// only taken over if it is among the service's previousSites or does not exist yet, since
+// it may have been written before owners were recorded or by hand.
+func CheckOwnership(exec deploy.Executor, service string, names []string, previousSites []string, owners map[string]string) error {
+	for _, n := range names {
+		if owner, prs := owners[n]; prs {
+			if owner != service {
+				return fmt.Errorf("[%s] nginx site %s belongs to service %s; rename the site or remove it from that service first", exec.Name(), n, owner)
+			}
+			continue
+		}
+		if slices.Contains(previousSites, n) {
+			continue
+		}
+		stdout, _, err := exec.ExecuteShell(fmt.Sprintf("(test -e %s && echo 'exists') || echo 'not-exists'", utils.ShellQuote(GetAvailablePath(n))))
+		if err != nil {
+			return fmt.Errorf("[%s] failed to check for existing site %s: %w", exec.Name(), n, err)
+		}
+		if strings.TrimSpace(stdout) == "exists" {
+			return fmt.Errorf("[%s] nginx site %s already exists & does not belong to service %s; rename the site or remove the existing one first", exec.Name(), n, service)
+		}
+	}
+	return nil
+}
+
+// Installs & enables the site from the file at srcPath on the executor, e.g. when restoring
+// a release. Does not reload nginx.
+func InstallSite(exec deploy.Executor, name string, srcPath string) error {
+	script := fmt.Sprintf("cp %s %s && ln -sfn %s %s",
+		utils.ShellQuote(srcPath), utils.ShellQuote(GetAvailablePath(name)),
+		utils.ShellQuote(GetAvailablePath(name)), utils.ShellQuote(GetEnabledPath(name)))
+	if _, stderr, err := exec.ExecuteShell(script); err != nil {
+		return fmt.Errorf("[%s] failed to install nginx site %s (stderr: %s): %w", exec.Name(), name, stderr, err)
+	}
+	return nil
+}
+
+// Disables & removes the named sites, e.g. when their service is removed. Does not reload nginx.
+func RemoveSites(exec deploy.Executor, names []string) error {
+	for _, n := range names {
+		if _, stderr, err := exec.ExecuteShell(fmt.Sprintf("rm -f %s %s", utils.ShellQuote(GetEnabledPath(n)), utils.ShellQuote(GetAvailablePath(n)))); err != nil {
+			return fmt.Errorf("[%s] failed to remove nginx site %s (stderr: %s): %w", exec.Name(), n, stderr, err)
+		}
+	}
+	return nil
+}
+
+func isEnabled(exec deploy.Executor, name string) (bool, error) {
+	enabledPath := GetEnabledPath(name)
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("(test -L %s && echo 'exists') || echo 'not-exists'", utils.ShellQuote(enabledPath)))
+	if err != nil {
+		return false, fmt.Errorf("[%s] failed to check for enabled site %s: %w", exec.Name(), enabledPath, err)
+	}
+	return strings.Trim(stdout, " \n") == "exists", nil
+}
+
+func combineResults(x deploy.SyncResult, y deploy.SyncResult) deploy.SyncResult {
+	if x == deploy.SYNC_RESULT_NOCHANGE {
+		return y
+	}
+	return x
+}
+
+func siteNames(sites []*Site) []string {
+	return utils.Map(sites, func(s *Site) string { return s.Name })
+}
@@ -0,0 +1,61 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+)
+
+// Executor on which only the given paths exist
+type fakeExecutor struct {
+	existing []string
+}
+
+func (e *fakeExecutor) Name() string          { return "fake" }
+func (e *fakeExecutor) Yaml(depth int) string { return "" }
+func (e *fakeExecutor) ExecuteCommand(name string, args ...string) (string, string, error) {
+	return e.ExecuteShell(name + " " + strings.Join(args, " "))
+}
+func (e *fakeExecutor) ExecuteCommandInDir(workingDir string, name string, args ...string) (string, string, error) {
+	return e.ExecuteCommand(name, args...)
+}
+func (e *fakeExecutor) ExecuteShell(cmd string) (string, string, error) {
+	for _, p := range e.existing {
+		if strings.Contains(cmd, p) {
+			return "exists", "", nil
+		}
+	}
+	return "not-exists", "", nil
+}
+func (e *fakeExecutor) ExecuteShellInDir(workingDir string, cmd string) (string, string, error) {
+	return e.ExecuteShell(cmd)
+}
+func (e *fakeExecutor) Close() {}
+
+func TestCheckOwnership(t *testing.T) {
+	exec := &fakeExecutor{existing: []string{GetAvailablePath("default"), GetAvailablePath("legacy.conf")}}
+	owners := map[string]string{"foo.conf": "foo", "bar.conf": "bar"}
+
+	cases := []struct {
+		testName      string
+		names         []string
+		previousSites []string
+		isError       bool
+	}{
+		{"owned by service", []string{"foo.conf"}, []string{}, false},
+		{"owned by other service", []string{"bar.conf"}, []string{}, true},
+		{"new site", []string{"new.conf"}, []string{}, false},
+		{"existing unowned site", []string{"default"}, []string{}, true},
+		{"previous unowned site", []string{"legacy.conf"}, []string{"legacy.conf"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testName, func(s *testing.T) {
+			err := CheckOwnership(exec, "foo", c.names, c.previousSites, owners)
+			if c.isError && err == nil {
+				s.Errorf("expected error, got none")
+			} else if !c.isError && err != nil {
+				s.Errorf("expected no error, got '%v'", err)
+			}
+		})
+	}
+}
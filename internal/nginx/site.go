@@ -0,0 +1,92 @@
+package nginx
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/certs"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+)
+
+// An upstream whose servers are read from a file on the server, so that traffic can be moved
+// by rewriting the file & reloading nginx without touching the site.
+type Upstream struct {
+	Name        string
+	IncludePath string
+}
+
+// Renders the site file for the project's nginx routes. Routes without a port are proxied
+// to the project's API_PORT, or to upstream if it is given.
+func GenerateSite(cfg *project.NginxConfig, env map[string]string, upstream *Upstream) (string, error) {
+	serverNames := strings.Join(cfg.ServerNames, " ")
+	lines := []string{}
+	if upstream != nil {
+		lines = append(lines,
+			fmt.Sprintf("upstream %s {", upstream.Name),
+			fmt.Sprintf("\tinclude %s;", upstream.IncludePath),
+			"}",
+			"")
+	}
+	lines = append(lines, "server {", fmt.Sprintf("\tserver_name %s;", serverNames))
+	if cfg.Tls {
+		certDir := filepath.Join(certs.LiveDir, cfg.GetCertificateName())
+		lines = append(lines,
+			"\tlisten 443 ssl;",
+			"\tlisten [::]:443 ssl;",
+			fmt.Sprintf("\tssl_certificate %s;", filepath.Join(certDir, "fullchain.pem")),
+			fmt.Sprintf("\tssl_certificate_key %s;", filepath.Join(certDir, "privkey.pem")),
+			"\tinclude /etc/letsencrypt/options-ssl-nginx.conf;",
+			"\tssl_dhparam /etc/letsencrypt/ssl-dhparams.pem;")
+	}
+	if !cfg.RedirectToHttps {
+		lines = append(lines,
+			"\tlisten 80;",
+			"\tlisten [::]:80;")
+	}
+	if cfg.MaxBodySize != "" {
+		lines = append(lines, fmt.Sprintf("\tclient_max_body_size %s;", cfg.MaxBodySize))
+	}
+
+	for _, r := range cfg.Routes {
+		target := fmt.Sprintf("localhost:%d", r.Port)
+		if r.Port == 0 && upstream != nil {
+			target = upstream.Name
+		} else if r.Port == 0 {
+			apiPort, prs := env[project.ApiPortEnvName]
+			if !prs || apiPort == "" {
+				return "", fmt.Errorf("nginx route %s has no port and %s is not set in the project env", r.Path, project.ApiPortEnvName)
+			}
+			target = fmt.Sprintf("localhost:%s", apiPort)
+		}
+		lines = append(lines,
+			"",
+			fmt.Sprintf("\tlocation %s {", r.Path),
+			fmt.Sprintf("\t\tproxy_pass http://%s;", target),
+			"\t\tproxy_set_header Host $host;",
+			"\t\tproxy_set_header X-Forwarded-For $remote_addr;",
+			"\t\tproxy_set_header X-Forwarded-Host $host;",
+			"\t\tproxy_set_header X-Forwarded-Proto $scheme;")
+		if r.Websocket {
+			lines = append(lines,
+				"\t\tproxy_http_version 1.1;",
+				"\t\tproxy_set_header Upgrade $http_upgrade;",
+				"\t\tproxy_set_header Connection \"upgrade\";")
+		}
+		lines = append(lines, "\t}")
+	}
+	lines = append(lines, "}")
+
+	if cfg.RedirectToHttps {
+		lines = append(lines,
+			"",
+			"server {",
+			fmt.Sprintf("\tserver_name %s;", serverNames),
+			"\tlisten 80;",
+			"\tlisten [::]:80;",
+			"\treturn 301 https://$host$request_uri;",
+			"}")
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
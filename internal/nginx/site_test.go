@@ -0,0 +1,78 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+)
+
+func TestGenerateSite(t *testing.T) {
+	cfg := &project.NginxConfig{
+		ServerNames: []string{"foo.example.com"},
+		Routes: []*project.NginxRoute{
+			{Path: "/"},
+			{Path: "/ws", Port: 9000, Websocket: true},
+		},
+		MaxBodySize:     "10m",
+		Tls:             true,
+		RedirectToHttps: true,
+	}
+	site, err := GenerateSite(cfg, map[string]string{"API_PORT": "8080"}, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+
+	expected := []string{
+		"ssl_certificate /etc/letsencrypt/live/foo.example.com/fullchain.pem;",
+		"client_max_body_size 10m;",
+		"proxy_pass http://localhost:8080;",
+		"proxy_pass http://localhost:9000;",
+		"proxy_set_header Upgrade $http_upgrade;",
+		"return 301 https://$host$request_uri;",
+	}
+	for _, e := range expected {
+		if !strings.Contains(site, e) {
+			t.Errorf("expected generated site to contain '%s', got:\n%s", e, site)
+		}
+	}
+	if strings.Count(site, "Upgrade $http_upgrade") != 1 {
+		t.Errorf("expected only the websocket route to upgrade connections, got:\n%s", site)
+	}
+}
+
+func TestGenerateSiteMissingApiPort(t *testing.T) {
+	cfg := &project.NginxConfig{
+		ServerNames: []string{"foo.example.com"},
+		Routes:      []*project.NginxRoute{{Path: "/"}},
+	}
+	if _, err := GenerateSite(cfg, map[string]string{}, nil); err == nil {
+		t.Errorf("expected error for route without port or API_PORT, got none")
+	}
+}
+
+func TestGenerateSiteWithUpstream(t *testing.T) {
+	cfg := &project.NginxConfig{
+		ServerNames: []string{"foo.example.com"},
+		Routes: []*project.NginxRoute{
+			{Path: "/"},
+			{Path: "/metrics", Port: 9100},
+		},
+	}
+	upstream := &Upstream{Name: "smt_foo", IncludePath: "/etc/smt/foo/nginx-upstream.conf"}
+	site, err := GenerateSite(cfg, map[string]string{}, upstream)
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+
+	expected := []string{
+		"upstream smt_foo {\n\tinclude /etc/smt/foo/nginx-upstream.conf;\n}",
+		"proxy_pass http://smt_foo;",
+		"proxy_pass http://localhost:9100;",
+	}
+	for _, e := range expected {
+		if !strings.Contains(site, e) {
+			t.Errorf("expected generated site to contain '%s', got:\n%s", e, site)
+		}
+	}
+}
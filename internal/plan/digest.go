@@ -0,0 +1,102 @@
+package plan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/docker"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+// Digests of the content an asset syncs from its source & finds at its destination, so
+// that a plan notices either changing even when the asset's result does not.
+type Digest struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+// Implemented by providers that can digest the content on either side of their sync.
+type Digester interface {
+	Digest(src deploy.Executor, dst deploy.Executor) (*Digest, error)
+}
+
+// Hashes the given values in order.
+func HashValues(values ...string) string {
+	h := sha256.New()
+	for _, v := range values {
+		// Length-prefixed so that moving bytes between values changes the hash
+		fmt.Fprintf(h, "%d:%s", len(v), v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Hashes the regular files at or beneath the given paths on the local machine. Files are
+// named by their path relative to the path they were found under, so that the same files in
+// another checkout hash the same. Paths that do not exist are hashed as missing.
+func HashLocalFiles(paths ...string) (string, error) {
+	values := []string{}
+	for _, root := range paths {
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			values = append(values, "not-exists")
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			values = append(values, filepath.ToSlash(rel), HashValues(string(contents)))
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", root, err)
+		}
+	}
+	return HashValues(values...), nil
+}
+
+// Hashes the regular files at or beneath the given paths on the executor. Paths that do not
+// exist are hashed as missing.
+func HashRemoteFiles(exec deploy.Executor, paths ...string) (string, error) {
+	values := []string{}
+	for _, path := range paths {
+		stdout, stderr, err := exec.ExecuteShell(fmt.Sprintf("(test -e %s && find %s -type f -exec sha256sum {} + | sort) || echo 'not-exists'", utils.ShellQuote(path), utils.ShellQuote(path)))
+		if err != nil {
+			return "", fmt.Errorf("[%s] failed to hash %s (stderr: %s): %w", exec.Name(), path, stderr, err)
+		}
+		values = append(values, path, strings.TrimSpace(stdout))
+	}
+	return HashValues(values...), nil
+}
+
+// Hashes the IDs of the named images on the executor. Images that do not exist are hashed
+// as missing.
+func HashImages(exec deploy.Executor, names []string) (string, error) {
+	values := []string{}
+	for _, name := range slices.Sorted(slices.Values(names)) {
+		image, err := docker.InspectImage(exec, name, "")
+		if err != nil {
+			return "", err
+		}
+		id := "not-exists"
+		if image != nil {
+			id = image.ID
+		}
+		values = append(values, name, id)
+	}
+	return HashValues(values...), nil
+}
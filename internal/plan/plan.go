@@ -0,0 +1,157 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+)
+
+const (
+	ResultCreated   string = "created"
+	ResultChanged   string = "changed"
+	ResultUnchanged string = "unchanged"
+)
+
+var (
+	ResultNames map[deploy.SyncResult]string = map[deploy.SyncResult]string{
+		deploy.SYNC_RESULT_CREATED:  ResultCreated,
+		deploy.SYNC_RESULT_UPDATED:  ResultChanged,
+		deploy.SYNC_RESULT_NOCHANGE: ResultUnchanged,
+	}
+)
+
+// What a deploy of a project would do, as calculated by a dry run against each server.
+type Plan struct {
+	Project     string        `json:"project"`
+	Environment string        `json:"environment,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	Servers     []*ServerPlan `json:"servers"`
+}
+
+type ServerPlan struct {
+	Server   string       `json:"server"`
+	Hostname string       `json:"hostname"`
+	Assets   []*AssetPlan `json:"assets"`
+}
+
+type AssetPlan struct {
+	Provider     string   `json:"provider"`
+	Src          string   `json:"src"`
+	Dst          string   `json:"dst"`
+	Result       string   `json:"result"`
+	PostCommands []string `json:"post_commands"`
+	// Unset for assets whose provider cannot digest its content
+	Digest *Digest `json:"digest,omitempty"`
+}
+
+func LoadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan file %s: %w", path, err)
+	}
+	var plan *Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan file %s: %w", path, err)
+	}
+	return plan, nil
+}
+
+func SavePlan(path string, plan *Plan) error {
+	jsonStr, err := json.MarshalIndent(plan, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to serialize plan: %w", err)
+	}
+	if err := os.WriteFile(path, jsonStr, 0644); err != nil {
+		return fmt.Errorf("failed to write plan file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (p *Plan) FindServer(server string) *ServerPlan {
+	idx := slices.IndexFunc(p.Servers, func(s *ServerPlan) bool { return s.Server == server })
+	if idx < 0 {
+		return nil
+	}
+	return p.Servers[idx]
+}
+
+// Builds the plan for a single asset given the result its provider reported & the digest of
+// its content, if any.
+func NewAssetPlan(asset *deploy.ProviderConfig, src string, dst string, result deploy.SyncResult, digest *Digest) *AssetPlan {
+	return &AssetPlan{
+		Provider:     asset.Provider.Name(),
+		Src:          src,
+		Dst:          dst,
+		Result:       ResultNames[result],
+		PostCommands: FiringPostCommands(asset.PostCommands, result),
+		Digest:       digest,
+	}
+}
+
+// Returns the post-commands that the runner would execute for the given sync result.
+func FiringPostCommands(postCommands []*deploy.PostCommand, result deploy.SyncResult) []string {
+	commands := []string{}
+	for _, c := range postCommands {
+		if c.Trigger == "always" ||
+			(result != deploy.SYNC_RESULT_NOCHANGE && c.Trigger == "on_changed") ||
+			(result == deploy.SYNC_RESULT_CREATED && c.Trigger == "on_created") ||
+			(result == deploy.SYNC_RESULT_UPDATED && c.Trigger == "on_updated") {
+			commands = append(commands, c.Command)
+		}
+	}
+	return commands
+}
+
+// Describes each difference between a saved plan & a freshly-calculated one for the same
+// server. An empty result means the remote state has not drifted.
+func Diff(saved *ServerPlan, current *ServerPlan) []string {
+	diffs := []string{}
+	savedAssets := map[string]*AssetPlan{}
+	for _, a := range saved.Assets {
+		savedAssets[a.Provider] = a
+	}
+
+	for _, a := range current.Assets {
+		s, prs := savedAssets[a.Provider]
+		if !prs {
+			diffs = append(diffs, fmt.Sprintf("%s: not in saved plan", a.Provider))
+			continue
+		}
+		delete(savedAssets, a.Provider)
+
+		if s.Src != a.Src || s.Dst != a.Dst {
+			diffs = append(diffs, fmt.Sprintf("%s: planned %s -> %s, now %s -> %s", a.Provider, s.Src, s.Dst, a.Src, a.Dst))
+		}
+		if s.Result != a.Result {
+			diffs = append(diffs, fmt.Sprintf("%s: planned %s, now %s", a.Provider, s.Result, a.Result))
+		}
+		if !slices.Equal(s.PostCommands, a.PostCommands) {
+			diffs = append(diffs, fmt.Sprintf("%s: planned post-commands [%s], now [%s]", a.Provider, strings.Join(s.PostCommands, "; "), strings.Join(a.PostCommands, "; ")))
+		}
+		// An update planned from one version of the content may be applied to another without
+		// changing the result, so the content itself is compared too
+		if s.Digest != nil && a.Digest != nil {
+			if s.Digest.Src != a.Digest.Src {
+				diffs = append(diffs, fmt.Sprintf("%s: source content changed since the plan was made", a.Provider))
+			}
+			if s.Digest.Dst != a.Digest.Dst {
+				diffs = append(diffs, fmt.Sprintf("%s: destination content changed since the plan was made", a.Provider))
+			}
+		} else if s.Digest != nil {
+			diffs = append(diffs, fmt.Sprintf("%s: content digested in saved plan but not now", a.Provider))
+		}
+	}
+
+	for _, a := range saved.Assets {
+		if _, prs := savedAssets[a.Provider]; prs {
+			diffs = append(diffs, fmt.Sprintf("%s: in saved plan but no longer deployed", a.Provider))
+		}
+	}
+
+	return diffs
+}
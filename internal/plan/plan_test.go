@@ -0,0 +1,132 @@
+package plan
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+)
+
+func TestFiringPostCommands(t *testing.T) {
+	postCommands := []*deploy.PostCommand{
+		{Command: "a", Trigger: "always"},
+		{Command: "b", Trigger: "on_changed"},
+		{Command: "c", Trigger: "on_created"},
+		{Command: "d", Trigger: "on_updated"},
+	}
+	cases := map[deploy.SyncResult][]string{
+		deploy.SYNC_RESULT_NOCHANGE: {"a"},
+		deploy.SYNC_RESULT_CREATED:  {"a", "b", "c"},
+		deploy.SYNC_RESULT_UPDATED:  {"a", "b", "d"},
+	}
+	for result, expected := range cases {
+		actual := FiringPostCommands(postCommands, result)
+		if !slices.Equal(expected, actual) {
+			t.Errorf("result %d: expected %v, got %v", result, expected, actual)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	saved := &ServerPlan{
+		Server: "prod",
+		Assets: []*AssetPlan{
+			{Provider: "docker-images", Src: "local", Dst: "prod", Result: ResultChanged, PostCommands: []string{"restart"}},
+			{Provider: "env-file", Src: "local", Dst: "prod", Result: ResultUnchanged, PostCommands: []string{}},
+			{Provider: "old-asset", Src: "local", Dst: "prod", Result: ResultUnchanged, PostCommands: []string{}},
+		},
+	}
+
+	if diffs := Diff(saved, saved); len(diffs) != 0 {
+		t.Errorf("expected no differences against itself, got %v", diffs)
+	}
+
+	current := &ServerPlan{
+		Server: "prod",
+		Assets: []*AssetPlan{
+			{Provider: "docker-images", Src: "local", Dst: "prod", Result: ResultChanged, PostCommands: []string{"restart"}},
+			{Provider: "env-file", Src: "local", Dst: "prod", Result: ResultChanged, PostCommands: []string{"restart"}},
+			{Provider: "new-asset", Src: "local", Dst: "prod", Result: ResultCreated, PostCommands: []string{}},
+		},
+	}
+	diffs := Diff(saved, current)
+	// env-file result & post-commands, new-asset, old-asset
+	if len(diffs) != 4 {
+		t.Errorf("expected 4 differences, got %d: %v", len(diffs), diffs)
+	}
+}
+
+func TestDiffDigests(t *testing.T) {
+	asset := func(digest *Digest) *ServerPlan {
+		return &ServerPlan{
+			Server: "prod",
+			Assets: []*AssetPlan{
+				{Provider: "env-file", Src: "local", Dst: "prod", Result: ResultChanged, PostCommands: []string{"restart"}, Digest: digest},
+			},
+		}
+	}
+	saved := asset(&Digest{Src: "a", Dst: "b"})
+
+	cases := []struct {
+		name     string
+		current  *Digest
+		expected int
+	}{
+		{"unchanged", &Digest{Src: "a", Dst: "b"}, 0},
+		{"source changed", &Digest{Src: "c", Dst: "b"}, 1},
+		{"destination changed", &Digest{Src: "a", Dst: "c"}, 1},
+		{"both changed", &Digest{Src: "c", Dst: "d"}, 2},
+		{"not digested", nil, 1},
+	}
+	for _, c := range cases {
+		if diffs := Diff(saved, asset(c.current)); len(diffs) != c.expected {
+			t.Errorf("%s: expected %d differences, got %d: %v", c.name, c.expected, len(diffs), diffs)
+		}
+	}
+
+	// Plans made before digests were recorded are compared as before
+	if diffs := Diff(asset(nil), asset(&Digest{Src: "a", Dst: "b"})); len(diffs) != 0 {
+		t.Errorf("expected no differences against a plan without digests, got %v", diffs)
+	}
+}
+
+func TestHashLocalFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.conf")
+	if err := os.WriteFile(path, []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := HashLocalFiles(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if again, _ := HashLocalFiles(dir); again != before {
+		t.Errorf("expected the same digest for the same files")
+	}
+
+	// The same files in another checkout hash the same
+	otherDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(otherDir, "a.conf"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := HashLocalFiles(otherDir); other != before {
+		t.Errorf("expected the same digest for the same files in another directory")
+	}
+
+	if err := os.WriteFile(path, []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := HashLocalFiles(dir); after == before {
+		t.Errorf("expected digest to change with file contents")
+	}
+
+	missing, err := HashLocalFiles(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatalf("expected no error for missing path, got '%v'", err)
+	}
+	if missing == HashValues() {
+		t.Errorf("expected a missing path to be hashed as missing")
+	}
+}
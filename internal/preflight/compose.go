@@ -0,0 +1,188 @@
+package preflight
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// Matches $$, ${VAR}, ${VAR<op><arg>} & $VAR, as interpolated by docker compose
+	variablePattern *regexp.Regexp = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?[-?+])([^}]*))?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// The parts of a docker-compose file that are checked against the project config.
+type composeFile struct {
+	Services map[string]*composeService `yaml:"services"`
+	Volumes  map[string]*composeVolume  `yaml:"volumes"`
+}
+
+type composeService struct {
+	Image string      `yaml:"image"`
+	Ports []yaml.Node `yaml:"ports"`
+}
+
+type composeVolume struct {
+	External yaml.Node `yaml:"external"`
+	Name     string    `yaml:"name"`
+}
+
+// A variable referenced by a docker-compose file that cannot be resolved.
+type unresolvedVariable struct {
+	Name    string
+	Message string
+}
+
+// Parses the docker-compose file, interpolating variables in its values from env. Variables
+// that are neither in env nor have a default are returned, & interpolate as empty.
+func parseCompose(contents []byte, env map[string]string) (*composeFile, []*unresolvedVariable, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(contents, &root); err != nil {
+		return nil, nil, err
+	}
+	unresolved := []*unresolvedVariable{}
+	interpolateNode(&root, env, &unresolved)
+
+	compose := &composeFile{}
+	if err := root.Decode(compose); err != nil {
+		return nil, nil, err
+	}
+	return compose, unresolved, nil
+}
+
+func interpolateNode(n *yaml.Node, env map[string]string, unresolved *[]*unresolvedVariable) {
+	if n.Kind == yaml.ScalarNode {
+		n.Value = interpolate(n.Value, env, unresolved)
+		return
+	}
+	for _, c := range n.Content {
+		interpolateNode(c, env, unresolved)
+	}
+}
+
+// Interpolates variables in s the way docker compose does, recording those that cannot be
+// resolved.
+func interpolate(s string, env map[string]string, unresolved *[]*unresolvedVariable) string {
+	return variablePattern.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		groups := variablePattern.FindStringSubmatch(m)
+		name, op, arg := groups[1], groups[2], groups[3]
+		if name == "" {
+			name = groups[4]
+		}
+		value, set := env[name]
+		nonEmpty := set && value != ""
+
+		switch op {
+		case ":-":
+			if !nonEmpty {
+				return arg
+			}
+		case "-":
+			if !set {
+				return arg
+			}
+		case ":+":
+			if nonEmpty {
+				return arg
+			}
+			return ""
+		case "+":
+			if set {
+				return arg
+			}
+			return ""
+		case ":?", "?":
+			if (op == ":?" && !nonEmpty) || !set {
+				*unresolved = append(*unresolved, &unresolvedVariable{Name: name, Message: arg})
+			}
+		default:
+			if !set {
+				*unresolved = append(*unresolved, &unresolvedVariable{Name: name})
+			}
+		}
+		return value
+	})
+}
+
+// Gets the name of the volume on the server if the volume is external, or empty otherwise.
+func (v *composeVolume) externalName(key string) string {
+	if v == nil {
+		return ""
+	}
+	switch v.External.Kind {
+	case yaml.ScalarNode:
+		if external, err := strconv.ParseBool(v.External.Value); err != nil || !external {
+			return ""
+		}
+	case yaml.MappingNode:
+		// Legacy syntax: external: { name: ... }
+		var legacy struct {
+			Name string `yaml:"name"`
+		}
+		if err := v.External.Decode(&legacy); err == nil && legacy.Name != "" {
+			return legacy.Name
+		}
+	default:
+		return ""
+	}
+	if v.Name != "" {
+		return v.Name
+	}
+	return key
+}
+
+// Gets the ports on the host published by the service. Container ports that are not
+// published, or published to a random port, are omitted.
+func (s *composeService) publishedPorts() ([]int, error) {
+	ports := []int{}
+	for _, n := range s.Ports {
+		var published string
+		switch n.Kind {
+		case yaml.ScalarNode:
+			published = parseShortPortSyntax(n.Value)
+		case yaml.MappingNode:
+			var long struct {
+				Published string `yaml:"published"`
+			}
+			if err := n.Decode(&long); err != nil {
+				return nil, fmt.Errorf("invalid port mapping at line %d: %w", n.Line, err)
+			}
+			published = long.Published
+		default:
+			return nil, fmt.Errorf("invalid port mapping at line %d", n.Line)
+		}
+		if published == "" {
+			continue
+		}
+
+		start, end, isRange := strings.Cut(published, "-")
+		if !isRange {
+			end = start
+		}
+		startPort, startErr := strconv.Atoi(start)
+		endPort, endErr := strconv.Atoi(end)
+		if startErr != nil || endErr != nil || startPort > endPort {
+			return nil, fmt.Errorf("invalid published port '%s' at line %d", published, n.Line)
+		}
+		for p := startPort; p <= endPort; p++ {
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+// Gets the host port of a port mapping like [HOST_IP:][HOST_PORT:]CONTAINER_PORT[/PROTOCOL].
+func parseShortPortSyntax(mapping string) string {
+	mapping, _, _ = strings.Cut(mapping, "/")
+	parts := strings.Split(mapping, ":")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
@@ -0,0 +1,219 @@
+package preflight
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/docker"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+)
+
+const (
+	CheckCompose string = "compose"
+	CheckImages  string = "images"
+	CheckVolumes string = "volumes"
+	CheckPorts   string = "ports"
+	CheckEnv     string = "env"
+	CheckUnits   string = "units"
+)
+
+// A mismatch between the project config & its docker-compose file.
+type Problem struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// Checks the project's docker-compose file against its config, returning every problem
+// found. Nothing on the server is consulted.
+func Check(c *project.ProjectConfig) []*Problem {
+	composePath := filepath.Join(c.ProjectDir, c.DockerComposePath)
+	contents, err := os.ReadFile(composePath)
+	if err != nil {
+		return []*Problem{{Check: CheckCompose, Message: fmt.Sprintf("failed to read docker-compose file %s: %v", c.DockerComposePath, err)}}
+	}
+	compose, unresolved, err := parseCompose(contents, c.Env)
+	if err != nil {
+		return []*Problem{{Check: CheckCompose, Message: fmt.Sprintf("failed to parse docker-compose file %s: %v", c.DockerComposePath, err)}}
+	}
+
+	problems := []*Problem{}
+	problems = append(problems, checkEnv(c, unresolved)...)
+	problems = append(problems, checkImages(c, compose)...)
+	problems = append(problems, checkVolumes(c, compose)...)
+	problems = append(problems, checkPorts(c, contents, compose)...)
+	problems = append(problems, checkUnits(c)...)
+	return problems
+}
+
+func checkEnv(c *project.ProjectConfig, unresolved []*unresolvedVariable) []*Problem {
+	problems := []*Problem{}
+	seen := map[string]bool{}
+	for _, v := range unresolved {
+		if seen[v.Name] {
+			continue
+		}
+		seen[v.Name] = true
+		message := fmt.Sprintf("%s references %s, which is not in the project env & has no default", c.DockerComposePath, v.Name)
+		if v.Message != "" {
+			message = fmt.Sprintf("%s (%s)", message, v.Message)
+		}
+		problems = append(problems, &Problem{Check: CheckEnv, Message: message})
+	}
+	return problems
+}
+
+func checkImages(c *project.ProjectConfig, compose *composeFile) []*Problem {
+	problems := []*Problem{}
+	for _, image := range c.ImageNames {
+		used := slices.ContainsFunc(slices.Collect(maps.Values(compose.Services)), func(s *composeService) bool {
+			return s != nil && docker.SameImage(s.Image, image)
+		})
+		if !used {
+			problems = append(problems, &Problem{Check: CheckImages, Message: fmt.Sprintf("image %s is in image_names but no service in %s uses it", image, c.DockerComposePath)})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(compose.Services)) {
+		s := compose.Services[name]
+		if s == nil || s.Image == "" {
+			problems = append(problems, &Problem{Check: CheckImages, Message: fmt.Sprintf("service %s in %s has no image; images are not built on the server", name, c.DockerComposePath)})
+		}
+	}
+	return problems
+}
+
+func checkVolumes(c *project.ProjectConfig, compose *composeFile) []*Problem {
+	problems := []*Problem{}
+	secretsVolumeDeclared := false
+	for _, key := range slices.Sorted(maps.Keys(compose.Volumes)) {
+		name := compose.Volumes[key].externalName(key)
+		if name == "" {
+			continue
+		}
+		if name == c.DockerSecretsVolume {
+			secretsVolumeDeclared = true
+			continue
+		}
+		problems = append(problems, &Problem{Check: CheckVolumes, Message: fmt.Sprintf("external volume %s in %s is not the project's docker_secrets_volume (%s), so deploy does not create it", name, c.DockerComposePath, c.DockerSecretsVolume)})
+	}
+	if len(c.Secrets) > 0 && !secretsVolumeDeclared {
+		problems = append(problems, &Problem{Check: CheckVolumes, Message: fmt.Sprintf("the project has secrets but %s does not declare its docker_secrets_volume (%s) as an external volume", c.DockerComposePath, c.DockerSecretsVolume)})
+	}
+	return problems
+}
+
+func checkPorts(c *project.ProjectConfig, contents []byte, compose *composeFile) []*Problem {
+	problems := []*Problem{}
+	published, err := publishedPorts(compose)
+	if err != nil {
+		return []*Problem{{Check: CheckPorts, Message: fmt.Sprintf("%s: %v", c.DockerComposePath, err)}}
+	}
+	for _, port := range slices.Sorted(maps.Keys(published)) {
+		if services := published[port]; len(services) > 1 {
+			problems = append(problems, &Problem{Check: CheckPorts, Message: fmt.Sprintf("port %d is published by more than one service in %s (%s)", port, c.DockerComposePath, strings.Join(services, ", "))})
+		}
+	}
+
+	if c.Nginx != nil {
+		for _, r := range c.Nginx.Routes {
+			port, source := r.Port, "its port"
+			if port == 0 {
+				source = project.ApiPortEnvName
+				apiPort, err := strconv.Atoi(c.Env[project.ApiPortEnvName])
+				if err != nil {
+					problems = append(problems, &Problem{Check: CheckPorts, Message: fmt.Sprintf("nginx route %s proxies to %s, which is not set to a port in the project env", r.Path, project.ApiPortEnvName)})
+					continue
+				}
+				port = apiPort
+			}
+			if _, prs := published[port]; !prs {
+				problems = append(problems, &Problem{Check: CheckPorts, Message: fmt.Sprintf("nginx route %s proxies to port %d (%s), which no service in %s publishes", r.Path, port, source, c.DockerComposePath)})
+			}
+		}
+	}
+
+	if c.BlueGreen != nil && c.BlueGreen.AlternatePort > 0 {
+		// The green color is started with API_PORT set to the alternate port, so the port
+		// the service publishes must follow API_PORT
+		greenEnv := map[string]string{}
+		maps.Copy(greenEnv, c.Env)
+		greenEnv[project.ApiPortEnvName] = strconv.Itoa(c.BlueGreen.AlternatePort)
+		if green, _, err := parseCompose(contents, greenEnv); err == nil {
+			greenPublished, err := publishedPorts(green)
+			if _, prs := greenPublished[c.BlueGreen.AlternatePort]; err == nil && !prs {
+				problems = append(problems, &Problem{Check: CheckPorts, Message: fmt.Sprintf("blue/green deploys publish the green color on %s=%d, but no service in %s publishes ${%s}", project.ApiPortEnvName, c.BlueGreen.AlternatePort, c.DockerComposePath, project.ApiPortEnvName)})
+			}
+		}
+	}
+	return problems
+}
+
+// Blue/green deploys start each color as its own compose project, so a systemd unit also
+// running the compose file would hold API_PORT with the default project & keep blue from
+// starting.
+func checkUnits(c *project.ProjectConfig) []*Problem {
+	if c.BlueGreen == nil || c.SystemctlFilesDir == "" {
+		return []*Problem{}
+	}
+	unitDir := filepath.Join(c.ProjectDir, c.SystemctlFilesDir)
+	entries, err := os.ReadDir(unitDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Problem{}
+		}
+		return []*Problem{{Check: CheckUnits, Message: fmt.Sprintf("failed to read systemd unit directory %s: %v", c.SystemctlFilesDir, err)}}
+	}
+
+	problems := []*Problem{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(unitDir, e.Name()))
+		if err != nil {
+			problems = append(problems, &Problem{Check: CheckUnits, Message: fmt.Sprintf("failed to read systemd unit %s: %v", e.Name(), err)})
+			continue
+		}
+		for _, l := range strings.Split(string(contents), "\n") {
+			if runsCompose(l) {
+				problems = append(problems, &Problem{Check: CheckUnits, Message: fmt.Sprintf("systemd unit %s runs docker compose (%s), which conflicts with blue/green deploys starting each color themselves; remove the unit or blue_green", e.Name(), strings.TrimSpace(l))})
+				break
+			}
+		}
+	}
+	return problems
+}
+
+// Whether the unit file line starts a compose project, e.g. `ExecStart=docker compose -f ... up`.
+func runsCompose(line string) bool {
+	key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+	if !found || !strings.HasPrefix(key, "Exec") {
+		return false
+	}
+	fields := strings.Fields(value)
+	return slices.ContainsFunc(fields, func(f string) bool { return f == "compose" || strings.HasSuffix(f, "docker-compose") }) &&
+		slices.Contains(fields, "up")
+}
+
+// Gets the services publishing each host port.
+func publishedPorts(compose *composeFile) (map[int][]string, error) {
+	published := map[int][]string{}
+	for _, name := range slices.Sorted(maps.Keys(compose.Services)) {
+		s := compose.Services[name]
+		if s == nil {
+			continue
+		}
+		ports, err := s.publishedPorts()
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		for _, p := range ports {
+			published[p] = append(published[p], name)
+		}
+	}
+	return published, nil
+}
@@ -0,0 +1,175 @@
+package preflight
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/project"
+)
+
+const testCompose = `# Uses $UNDOCUMENTED in a comment, which is not interpolated
+services:
+  api:
+    image: quemot/foo:latest
+    ports:
+      - ${API_PORT:-8080}:80
+      - "127.0.0.1:9090:90/tcp"
+    environment:
+      DB_URL: ${DB_URL}
+      GREETING: $${NOT_A_VARIABLE}
+    volumes:
+      - foo-secrets:/app/secrets:ro
+      - shared:/app/shared
+  worker:
+    image: quemot/foo
+    ports:
+      - target: 90
+        published: "9090"
+volumes:
+  foo-secrets:
+    external: true
+  shared:
+    external: true
+    name: shared-data
+  cache: {}
+`
+
+func writeProject(t *testing.T, compose string, c *project.ProjectConfig) *project.ProjectConfig {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.ProjectDir = dir
+	c.DockerComposePath = "docker-compose.yml"
+	return c
+}
+
+func TestCheck(t *testing.T) {
+	c := writeProject(t, testCompose, &project.ProjectConfig{
+		Name:                "foo",
+		ImageNames:          []string{"quemot/foo:latest", "quemot/foo-migrate:latest"},
+		DockerSecretsVolume: "foo-secrets",
+		Secrets:             []string{"db-password"},
+		Env:                 map[string]string{project.ApiPortEnvName: "8081"},
+		Nginx:               &project.NginxConfig{Routes: []*project.NginxRoute{{Path: "/"}, {Path: "/metrics", Port: 9100}}},
+	})
+
+	messages := []string{}
+	for _, p := range Check(c) {
+		messages = append(messages, p.Check+": "+p.Message)
+	}
+	expected := []string{
+		"env: docker-compose.yml references DB_URL",
+		"images: image quemot/foo-migrate:latest is in image_names but no service",
+		"volumes: external volume shared-data",
+		"ports: port 9090 is published by more than one service in docker-compose.yml (api, worker)",
+		"ports: nginx route /metrics proxies to port 9100",
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d problems, got %d:\n%s", len(expected), len(messages), strings.Join(messages, "\n"))
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(messages[i], e) {
+			t.Errorf("expected problem %d to start with %q, got %q", i, e, messages[i])
+		}
+	}
+}
+
+func TestCheckBlueGreenPort(t *testing.T) {
+	compose := `services:
+  api:
+    image: quemot/foo
+    ports:
+      - 8080:80
+`
+	c := writeProject(t, compose, &project.ProjectConfig{
+		ImageNames:          []string{"quemot/foo"},
+		DockerSecretsVolume: "foo-secrets",
+		Env:                 map[string]string{project.ApiPortEnvName: "8080"},
+		BlueGreen:           &project.BlueGreenConfig{AlternatePort: 18080},
+	})
+
+	problems := Check(c)
+	if len(problems) != 1 || problems[0].Check != CheckPorts || !strings.Contains(problems[0].Message, "${API_PORT}") {
+		t.Errorf("expected a single problem about publishing ${API_PORT}, got %+v", problems)
+	}
+
+	c.Env = nil
+	problems = Check(c)
+	if len(problems) != 1 || problems[0].Check != CheckPorts {
+		t.Errorf("expected a single ports problem for a project without env, got %+v", problems)
+	}
+}
+
+func TestCheckBlueGreenUnits(t *testing.T) {
+	compose := `services:
+  api:
+    image: quemot/foo
+    ports:
+      - ${API_PORT}:80
+`
+	c := writeProject(t, compose, &project.ProjectConfig{
+		ImageNames:          []string{"quemot/foo"},
+		DockerSecretsVolume: "foo-secrets",
+		Env:                 map[string]string{project.ApiPortEnvName: "8080"},
+		BlueGreen:           &project.BlueGreenConfig{AlternatePort: 18080},
+		SystemctlFilesDir:   "install",
+	})
+	unitDir := filepath.Join(c.ProjectDir, "install")
+	if err := os.Mkdir(unitDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(unitDir, "foo-cleanup.timer"), []byte("[Timer]\nOnCalendar=daily\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if problems := Check(c); len(problems) != 0 {
+		t.Errorf("expected no problems, got %+v", problems)
+	}
+
+	unit := "[Service]\nExecStart=docker compose -f /etc/smt/foo/docker-compose.yml up\n"
+	if err := os.WriteFile(filepath.Join(unitDir, "foo.service"), []byte(unit), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems := Check(c)
+	if len(problems) != 1 || problems[0].Check != CheckUnits || !strings.Contains(problems[0].Message, "foo.service") {
+		t.Errorf("expected a single problem about foo.service, got %+v", problems)
+	}
+
+	c.BlueGreen = nil
+	if problems := Check(c); len(problems) != 0 {
+		t.Errorf("expected no problems without blue/green, got %+v", problems)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"SET": "value", "EMPTY": ""}
+	cases := map[string]string{
+		"${SET}":              "value",
+		"$SET/x":              "value/x",
+		"${EMPTY:-default}":   "default",
+		"${EMPTY-default}":    "",
+		"${MISSING-default}":  "default",
+		"${SET:+alternative}": "alternative",
+		"${EMPTY:+alt}":       "",
+		"$$SET":               "$SET",
+	}
+	for s, expected := range cases {
+		unresolved := []*unresolvedVariable{}
+		if actual := interpolate(s, env, &unresolved); actual != expected || len(unresolved) > 0 {
+			t.Errorf("interpolate(%q) = %q (unresolved: %d), expected %q", s, actual, len(unresolved), expected)
+		}
+	}
+
+	unresolved := []*unresolvedVariable{}
+	interpolate("${MISSING} ${EMPTY:?must be set} ${EMPTY?ok}", env, &unresolved)
+	names := []string{}
+	for _, v := range unresolved {
+		names = append(names, v.Name)
+	}
+	if !slices.Equal(names, []string{"MISSING", "EMPTY"}) {
+		t.Errorf("expected MISSING & EMPTY to be unresolved, got %v", names)
+	}
+}
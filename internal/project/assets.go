@@ -0,0 +1,126 @@
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	AssetVarServiceDir string = "${SERVICE_DIR}"
+	AssetVarName       string = "${NAME}"
+	AssetVarEnv        string = "${ENV}"
+)
+
+// Names of the built-in assets every deploy syncs.
+const (
+	AssetDockerComposeFile string = "docker-compose-file"
+	AssetSystemdUnits      string = "systemd-units"
+	AssetDockerImages      string = "docker-images"
+	AssetNginxSites        string = "nginx-sites"
+	AssetEnvFile           string = "env-file"
+	AssetServiceConfigJson string = "service-config-json"
+)
+
+var BuiltinAssetNames []string = []string{
+	AssetDockerComposeFile,
+	AssetSystemdUnits,
+	AssetDockerImages,
+	AssetNginxSites,
+	AssetEnvFile,
+	AssetServiceConfigJson,
+}
+
+var (
+	validateAssetModePatternString  string         = "^[0-7]{3,4}$"
+	validateAssetModePattern        *regexp.Regexp = regexp.MustCompile(validateAssetModePatternString)
+	validateAssetOwnerPatternString string         = "^[a-zA-Z0-9_.\\-]+(:[a-zA-Z0-9_.\\-]+)?$"
+	validateAssetOwnerPattern       *regexp.Regexp = regexp.MustCompile(validateAssetOwnerPatternString)
+
+	unknownAssetVarPattern *regexp.Regexp = regexp.MustCompile(`\$\{[^}]*\}`)
+)
+
+// A file or directory in the project deployed alongside the built-in assets. DstPath & the
+// OnChanged commands may contain ${SERVICE_DIR}, ${NAME} & ${ENV}, which expand to the
+// service directory on the server, the project name & the environment.
+type AdditionalAsset struct {
+	Name    string `json:"name"`
+	SrcPath string `json:"src_path"`
+	// Destination on the server; relative paths are resolved against the service directory
+	DstPath   string `json:"dst_path"`
+	Recursive bool   `json:"recursive"`
+	Force     bool   `json:"force"`
+	// Owner ("user" or "user:group") & octal mode applied whenever the asset changes
+	Owner string `json:"owner,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	// Commands run on the server, in the service directory, whenever the asset changes
+	OnChanged []string `json:"on_changed,omitempty"`
+}
+
+// Values of the placeholders in additional assets.
+type AssetVars struct {
+	ServiceDir  string
+	Name        string
+	Environment string
+}
+
+func (v *AssetVars) Expand(s string) string {
+	return strings.NewReplacer(
+		AssetVarServiceDir, v.ServiceDir,
+		AssetVarName, v.Name,
+		AssetVarEnv, v.Environment,
+	).Replace(s)
+}
+
+// Gets the asset's destination on the server.
+func (a *AdditionalAsset) GetDstPath(vars *AssetVars) string {
+	dstPath := vars.Expand(a.DstPath)
+	if !filepath.IsAbs(dstPath) {
+		dstPath = filepath.Join(vars.ServiceDir, dstPath)
+	}
+	return dstPath
+}
+
+// Gets the commands run on the server when the asset changes: applying its owner & mode,
+// then its on_changed commands.
+func (a *AdditionalAsset) GetPostCommands(vars *AssetVars) []string {
+	dstPath := a.GetDstPath(vars)
+	recursiveFlag := ""
+	if a.Recursive {
+		recursiveFlag = "-R "
+	}
+	cmds := []string{}
+	if a.Owner != "" {
+		cmds = append(cmds, fmt.Sprintf("chown %s%s %s", recursiveFlag, a.Owner, utils.ShellQuote(dstPath)))
+	}
+	if a.Mode != "" {
+		cmds = append(cmds, fmt.Sprintf("chmod %s%s %s", recursiveFlag, a.Mode, utils.ShellQuote(dstPath)))
+	}
+	for _, c := range a.OnChanged {
+		cmds = append(cmds, fmt.Sprintf("cd %s && %s", utils.ShellQuote(vars.ServiceDir), vars.Expand(c)))
+	}
+	return cmds
+}
+
+func (a *AdditionalAsset) Validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("additional asset name is required")
+	}
+	if a.SrcPath == "" || a.DstPath == "" {
+		return fmt.Errorf("additional asset %s requires src_path & dst_path", a.Name)
+	}
+	vars := &AssetVars{}
+	if unknown := unknownAssetVarPattern.FindString(vars.Expand(a.DstPath)); unknown != "" {
+		return fmt.Errorf("additional asset %s has unknown variable %s in dst_path (must be one of: %s, %s, %s)", a.Name, unknown, AssetVarServiceDir, AssetVarName, AssetVarEnv)
+	}
+	if a.Owner != "" && !validateAssetOwnerPattern.MatchString(a.Owner) {
+		return fmt.Errorf("additional asset %s has invalid owner '%s' (must match /%s/)", a.Name, a.Owner, validateAssetOwnerPatternString)
+	}
+	if a.Mode != "" && !validateAssetModePattern.MatchString(a.Mode) {
+		return fmt.Errorf("additional asset %s has invalid mode '%s' (must match /%s/)", a.Name, a.Mode, validateAssetModePatternString)
+	}
+	return nil
+}
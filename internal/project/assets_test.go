@@ -0,0 +1,61 @@
+package project
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAdditionalAssetDstPath(t *testing.T) {
+	vars := &AssetVars{ServiceDir: "/home/svc/services/foo", Name: "foo", Environment: "prod"}
+	cases := map[string]string{
+		"config/app.ini":                  "/home/svc/services/foo/config/app.ini",
+		"${SERVICE_DIR}/data/${ENV}.json": "/home/svc/services/foo/data/prod.json",
+		"/etc/${NAME}/app.conf":           "/etc/foo/app.conf",
+	}
+	for dstPath, expected := range cases {
+		a := &AdditionalAsset{Name: "a", SrcPath: "a", DstPath: dstPath}
+		if actual := a.GetDstPath(vars); actual != expected {
+			t.Errorf("GetDstPath(%q) = %q, expected %q", dstPath, actual, expected)
+		}
+	}
+}
+
+func TestAdditionalAssetPostCommands(t *testing.T) {
+	vars := &AssetVars{ServiceDir: "/srv/foo", Name: "foo", Environment: "prod"}
+	a := &AdditionalAsset{
+		Name:      "conf",
+		SrcPath:   "conf",
+		DstPath:   "conf",
+		Recursive: true,
+		Owner:     "foo:foo",
+		Mode:      "0750",
+		OnChanged: []string{"docker compose -p ${NAME} restart"},
+	}
+	expected := []string{
+		"chown -R foo:foo '/srv/foo/conf'",
+		"chmod -R 0750 '/srv/foo/conf'",
+		"cd '/srv/foo' && docker compose -p foo restart",
+	}
+	if actual := a.GetPostCommands(vars); !slices.Equal(actual, expected) {
+		t.Errorf("GetPostCommands() = %v, expected %v", actual, expected)
+	}
+}
+
+func TestAdditionalAssetValidate(t *testing.T) {
+	invalid := []*AdditionalAsset{
+		{SrcPath: "a", DstPath: "a"},
+		{Name: "a", DstPath: "a"},
+		{Name: "a", SrcPath: "a", DstPath: "${HOME}/a"},
+		{Name: "a", SrcPath: "a", DstPath: "a", Owner: "foo bar"},
+		{Name: "a", SrcPath: "a", DstPath: "a", Mode: "u+x"},
+	}
+	for _, a := range invalid {
+		if err := a.Validate(); err == nil {
+			t.Errorf("expected error for %+v, got none", a)
+		}
+	}
+	valid := &AdditionalAsset{Name: "a", SrcPath: "a", DstPath: "${SERVICE_DIR}/a", Owner: "foo:bar", Mode: "644"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
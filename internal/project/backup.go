@@ -0,0 +1,53 @@
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	DefaultBackupDataDir string = "data"
+	DefaultBackupDir     string = "backups"
+)
+
+// What `smt backup` archives for the project's service & when deploy takes one.
+type BackupConfig struct {
+	// Directories, relative to the service directory on the server, holding the service's data
+	DataDirs []string `json:"data_dirs,omitempty"`
+	// Named Docker volumes holding the service's data
+	Volumes []string `json:"volumes,omitempty"`
+	// Include the docker_secrets_volume, encrypted with the backup passphrase
+	IncludeSecrets bool `json:"include_secrets,omitempty"`
+	// Take a backup before each deploy
+	BeforeDeploy bool `json:"before_deploy,omitempty"`
+	// Local directory, relative to the project directory, that deploy saves backups in
+	Dir string `json:"dir,omitempty"`
+}
+
+func (b *BackupConfig) GetDataDirs() []string {
+	if b == nil || len(b.DataDirs) == 0 {
+		return []string{DefaultBackupDataDir}
+	}
+	return b.DataDirs
+}
+
+func (b *BackupConfig) GetDir() string {
+	if b == nil || b.Dir == "" {
+		return DefaultBackupDir
+	}
+	return b.Dir
+}
+
+func (b *BackupConfig) Validate() error {
+	for _, d := range b.DataDirs {
+		if !filepath.IsLocal(d) || filepath.Clean(d) == "." {
+			return fmt.Errorf("data directory '%s' must be a subdirectory of the service directory", d)
+		}
+	}
+	for _, v := range b.Volumes {
+		if !validateVolumePattern.MatchString(v) {
+			return fmt.Errorf("invalid volume name '%s' (must match /%s/)", v, validateVolumePatternString)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package project
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	ColorBlue  string = "blue"
+	ColorGreen string = "green"
+
+	DefaultBlueGreenDrainSeconds int = 5
+)
+
+// Runs each release as its own compose project ("color") next to the live one & moves
+// traffic to it through the generated nginx site once it is healthy. Blue publishes the
+// API on API_PORT & green on AlternatePort, so every host port in the compose file must
+// come from API_PORT. Colors are started by deploy itself, so the project must not also
+// run its compose file from a systemd unit; the preflight checks refuse to deploy one that
+// does.
+type BlueGreenConfig struct {
+	// Port green publishes the API on in place of API_PORT
+	AlternatePort int `json:"alternate_port"`
+	// Seconds to let in-flight requests finish after moving traffic before stopping the old color
+	DrainSeconds int `json:"drain_seconds,omitempty"`
+}
+
+func (b *BlueGreenConfig) Validate() error {
+	if b.AlternatePort <= 0 || b.AlternatePort > 65535 {
+		return fmt.Errorf("invalid alternate port %d", b.AlternatePort)
+	}
+	if b.DrainSeconds < 0 {
+		return fmt.Errorf("drain_seconds cannot be negative")
+	}
+	return nil
+}
+
+func (b *BlueGreenConfig) Drain() time.Duration {
+	if b.DrainSeconds == 0 {
+		return time.Duration(DefaultBlueGreenDrainSeconds) * time.Second
+	}
+	return time.Duration(b.DrainSeconds) * time.Second
+}
+
+// Gets the port the given color publishes the API on.
+func (b *BlueGreenConfig) Port(color string, env map[string]string) (int, error) {
+	if color == ColorGreen {
+		return b.AlternatePort, nil
+	}
+	apiPort, err := strconv.Atoi(env[ApiPortEnvName])
+	if err != nil {
+		return 0, fmt.Errorf("blue/green deploys require %s to be set to a port in the project env", ApiPortEnvName)
+	}
+	if apiPort == b.AlternatePort {
+		return 0, fmt.Errorf("%s and the blue/green alternate port must differ (both are %d)", ApiPortEnvName, apiPort)
+	}
+	return apiPort, nil
+}
+
+// Gets the color that replaces the given active color; blue if none is active.
+func OtherColor(color string) string {
+	if color == ColorBlue {
+		return ColorGreen
+	}
+	return ColorBlue
+}
@@ -0,0 +1,30 @@
+package project
+
+import "testing"
+
+func TestBlueGreenPort(t *testing.T) {
+	b := &BlueGreenConfig{AlternatePort: 18080}
+	env := map[string]string{ApiPortEnvName: "8080"}
+
+	if port, err := b.Port(ColorBlue, env); err != nil || port != 8080 {
+		t.Errorf("expected blue to use API_PORT 8080, got %d (err: %v)", port, err)
+	}
+	if port, err := b.Port(ColorGreen, env); err != nil || port != 18080 {
+		t.Errorf("expected green to use alternate port 18080, got %d (err: %v)", port, err)
+	}
+	if _, err := b.Port(ColorBlue, map[string]string{}); err == nil {
+		t.Errorf("expected error for blue without API_PORT, got none")
+	}
+	if _, err := b.Port(ColorBlue, map[string]string{ApiPortEnvName: "18080"}); err == nil {
+		t.Errorf("expected error for API_PORT matching the alternate port, got none")
+	}
+}
+
+func TestOtherColor(t *testing.T) {
+	cases := map[string]string{"": ColorBlue, ColorBlue: ColorGreen, ColorGreen: ColorBlue}
+	for active, expected := range cases {
+		if actual := OtherColor(active); actual != expected {
+			t.Errorf("OtherColor(%q) = %q, expected %q", active, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	EnvFileName string = ".env"
+)
+
+var (
+	ValidateEnvNamePatternString string         = "^[A-Za-z_][A-Za-z0-9_]*$"
+	ValidateEnvNamePattern       *regexp.Regexp = regexp.MustCompile(ValidateEnvNamePatternString)
+)
+
+// Renders the given variables as a Docker Compose env file, one sorted KEY=value per line.
+// Values containing anything other than plain characters are quoted.
+func RenderEnvFile(env map[string]string) string {
+	keys := sortedKeys(env)
+	builder := strings.Builder{}
+	for _, k := range keys {
+		builder.WriteString(fmt.Sprintf("%s=%s\n", k, quoteEnvValue(env[k])))
+	}
+	return builder.String()
+}
+
+func quoteEnvValue(v string) string {
+	if v == "" || !strings.ContainsAny(v, " \t\n\r#'\"\\$`") {
+		return v
+	}
+	if !strings.ContainsAny(v, "'\n\r") {
+		return fmt.Sprintf("'%s'", v)
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", "$$")
+	return fmt.Sprintf("\"%s\"", replacer.Replace(v))
+}
+
+// Parses an env file as rendered by RenderEnvFile. Blank lines & comments are skipped.
+func ParseEnvFile(contents string) (map[string]string, error) {
+	env := map[string]string{}
+	for i, l := range strings.Split(contents, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		idx := strings.Index(l, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid env file line %d: %s", i+1, l)
+		}
+		key, value := l[:idx], l[idx+1:]
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		} else if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = unquoteEnvValue(value[1 : len(value)-1])
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+func unquoteEnvValue(v string) string {
+	builder := strings.Builder{}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == '\\' && i+1 < len(v) {
+			i += 1
+			switch v[i] {
+			case 'n':
+				builder.WriteByte('\n')
+			case 'r':
+				builder.WriteByte('\r')
+			default:
+				builder.WriteByte(v[i])
+			}
+		} else if c == '$' && i+1 < len(v) && v[i+1] == '$' {
+			i += 1
+			builder.WriteByte('$')
+		} else {
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
+
+// Sets an env variable on the project. If an environment is active, the variable is set in
+// that environment's overlay so that other environments are unaffected.
+func (c *ProjectConfig) SetEnvVar(name string, value string) error {
+	if c.Env == nil {
+		c.Env = map[string]string{}
+	}
+	c.Env[name] = value
+	if c.base == nil {
+		return nil
+	}
+
+	overlayEnv, err := c.overlayEnv()
+	if err != nil {
+		return err
+	}
+	overlayEnv[name] = value
+	return c.saveOverlayEnv(overlayEnv)
+}
+
+// Removes an env variable from the project. If an environment is active, the variable is
+// removed from that environment's overlay & falls back to the top-level env's value, if any;
+// variables only set in the top-level env cannot be removed for a single environment.
+func (c *ProjectConfig) UnsetEnvVar(name string) error {
+	if c.base == nil {
+		delete(c.Env, name)
+		return nil
+	}
+
+	overlayEnv, err := c.overlayEnv()
+	if err != nil {
+		return err
+	}
+	baseValue, inBase := c.base.Env[name]
+	if _, inOverlay := overlayEnv[name]; !inOverlay && inBase {
+		return fmt.Errorf("%s is set in the top-level env and cannot be removed for environment %s alone; unset it without -env", name, c.Environment)
+	}
+	if inBase {
+		c.Env[name] = baseValue
+	} else {
+		delete(c.Env, name)
+	}
+	delete(overlayEnv, name)
+	return c.saveOverlayEnv(overlayEnv)
+}
+
+func (c *ProjectConfig) overlayEnv() (map[string]string, error) {
+	overlayEnv := map[string]string{}
+	raw, prs := c.base.Environments[c.Environment]["env"]
+	if prs {
+		if err := json.Unmarshal(raw, &overlayEnv); err != nil {
+			return nil, fmt.Errorf("invalid env in environment %s: %w", c.Environment, err)
+		}
+	}
+	return overlayEnv, nil
+}
+
+func (c *ProjectConfig) saveOverlayEnv(overlayEnv map[string]string) error {
+	overlayEnvJson, err := json.Marshal(overlayEnv)
+	if err != nil {
+		return fmt.Errorf("failed to serialize env for environment %s: %w", c.Environment, err)
+	}
+	c.base.Environments[c.Environment]["env"] = overlayEnvJson
+	return nil
+}
@@ -0,0 +1,44 @@
+package project
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestRenderEnvFile(t *testing.T) {
+	env := map[string]string{
+		"B_PLAIN":  "value",
+		"A_SPACES": "hello world",
+		"C_QUOTE":  "it's $HOME",
+		"D_EMPTY":  "",
+	}
+	expected := "A_SPACES='hello world'\nB_PLAIN=value\nC_QUOTE=\"it's $$HOME\"\nD_EMPTY=\n"
+	actual := RenderEnvFile(env)
+	if actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestParseEnvFileRoundTrip(t *testing.T) {
+	env := map[string]string{
+		"PLAIN":     "value",
+		"SPACES":    "hello world",
+		"QUOTES":    `it's "quoted"`,
+		"DOLLAR":    "it's $HOME",
+		"MULTILINE": "line one\nline two\\n",
+		"EMPTY":     "",
+	}
+	parsed, err := ParseEnvFile("# comment\n\n" + RenderEnvFile(env))
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if !maps.Equal(env, parsed) {
+		t.Errorf("expected %v, got %v", env, parsed)
+	}
+}
+
+func TestParseEnvFileInvalidLine(t *testing.T) {
+	if _, err := ParseEnvFile("FOO=bar\nnot a variable\n"); err == nil {
+		t.Errorf("expected error for invalid line, got none")
+	}
+}
@@ -0,0 +1,150 @@
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const (
+	// Key in an environment overlay naming the default server(s) for that environment.
+	EnvironmentServerKey string = "server"
+)
+
+// Set of top-level smt.json fields that an environment may override.
+var overridableFields []string = getOverridableFields()
+
+func getOverridableFields() []string {
+	fields := []string{}
+	t := reflect.TypeOf(ProjectConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" && name != "environments" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// Loads the project config at path with the overlay of the given environment applied.
+// If env is empty this is equivalent to LoadProjectConfig.
+func LoadProjectConfigForEnvironment(path string, env string) (*ProjectConfig, error) {
+	config, err := LoadProjectConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if env == "" {
+		return config, nil
+	}
+
+	effective, err := ApplyEnvironment(config, env)
+	if err != nil {
+		return nil, err
+	}
+	if err := finalizeProjectConfig(effective, path); err != nil {
+		return nil, fmt.Errorf("invalid config for environment %s: %w", env, err)
+	}
+	return effective, nil
+}
+
+// Returns a copy of the config with the overlay of the given environment applied. Fields in
+// the overlay replace their top-level counterparts, except for objects (e.g. commands, env),
+// whose entries are merged into the top-level object. The original config is retained so
+// that changes can be saved back without the overlay.
+func ApplyEnvironment(config *ProjectConfig, env string) (*ProjectConfig, error) {
+	overlay, prs := config.Environments[env]
+	if !prs {
+		return nil, fmt.Errorf("no environment named %s in %s (available: %s)", env, config.ProjectConfigPath, strings.Join(sortedKeys(config.Environments), ", "))
+	}
+
+	baseJson, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize project config: %w", err)
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(baseJson, &merged); err != nil {
+		return nil, fmt.Errorf("failed to serialize project config: %w", err)
+	}
+
+	var server string
+	for k, v := range overlay {
+		if k == EnvironmentServerKey {
+			if err := json.Unmarshal(v, &server); err != nil {
+				return nil, fmt.Errorf("environment %s: invalid %s value: %w", env, EnvironmentServerKey, err)
+			}
+			continue
+		}
+		if !slices.Contains(overridableFields, k) {
+			return nil, fmt.Errorf("environment %s: unknown or non-overridable field %s", env, k)
+		}
+		mergedValue, err := mergeJsonValues(merged[k], v)
+		if err != nil {
+			return nil, fmt.Errorf("environment %s: invalid value for %s: %w", env, k, err)
+		}
+		merged[k] = mergedValue
+	}
+
+	mergedJson, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize project config for environment %s: %w", env, err)
+	}
+	effective, err := parseProjectConfig(mergedJson)
+	if err != nil {
+		return nil, fmt.Errorf("environment %s: %w", env, err)
+	}
+
+	effective.ProjectConfigPath = config.ProjectConfigPath
+	effective.ProjectDir = config.ProjectDir
+	effective.NginxConfFiles = config.NginxConfFiles
+	effective.Environment = env
+	effective.EnvironmentServer = server
+	effective.base = config
+	return effective, nil
+}
+
+// Merges overlay into base if both are JSON objects; otherwise overlay replaces base.
+func mergeJsonValues(base json.RawMessage, overlay json.RawMessage) (json.RawMessage, error) {
+	var baseObj, overlayObj map[string]json.RawMessage
+	if base == nil || json.Unmarshal(base, &baseObj) != nil || baseObj == nil {
+		return overlay, nil
+	}
+	if err := json.Unmarshal(overlay, &overlayObj); err != nil || overlayObj == nil {
+		return overlay, nil
+	}
+	for k, v := range overlayObj {
+		baseObj[k] = v
+	}
+	return json.Marshal(baseObj)
+}
+
+// Updates the project's secret names. If the active environment overrides the secrets list
+// the change is written to that environment's overlay, otherwise to the top-level list.
+func (c *ProjectConfig) SetSecrets(secrets []string) error {
+	c.Secrets = secrets
+	if c.base == nil {
+		return nil
+	}
+
+	overlay := c.base.Environments[c.Environment]
+	if _, prs := overlay["secrets"]; prs {
+		secretsJson, err := json.Marshal(secrets)
+		if err != nil {
+			return fmt.Errorf("failed to serialize secrets for environment %s: %w", c.Environment, err)
+		}
+		overlay["secrets"] = secretsJson
+	} else {
+		c.base.Secrets = secrets
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
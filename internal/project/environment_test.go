@@ -0,0 +1,87 @@
+package project
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	raw := `{
+	"name": "foo",
+	"docker_compose_path": "docker-compose.prod.yml",
+	"commands": {"start": "systemctl start foo.service", "stop": "systemctl stop foo.service"},
+	"secrets": ["A"],
+	"env": {"API_PORT": "8080", "LOG_LEVEL": "info"},
+	"environments": {
+		"staging": {
+			"server": "staging-box",
+			"docker_compose_path": "docker-compose.staging.yml",
+			"env": {"API_PORT": "9090"},
+			"secrets": ["B"]
+		},
+		"bad": {
+			"not_a_field": true
+		}
+	}
+}`
+	base, err := parseProjectConfig([]byte(raw))
+	if err != nil {
+		t.Fatalf("failed to parse test config: %v", err)
+	}
+
+	staging, err := ApplyEnvironment(base, "staging")
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	if staging.EnvironmentServer != "staging-box" {
+		t.Errorf("expected server staging-box, got %s", staging.EnvironmentServer)
+	}
+	if staging.DockerComposePath != "docker-compose.staging.yml" {
+		t.Errorf("expected overridden compose path, got %s", staging.DockerComposePath)
+	}
+	if staging.Env["API_PORT"] != "9090" || staging.Env["LOG_LEVEL"] != "info" {
+		t.Errorf("expected env to be merged, got %v", staging.Env)
+	}
+	if len(staging.Commands) != 2 {
+		t.Errorf("expected commands to be inherited, got %v", staging.Commands)
+	}
+	if !slices.Equal(staging.Secrets, []string{"B"}) {
+		t.Errorf("expected secrets to be replaced, got %v", staging.Secrets)
+	}
+	if base.DockerComposePath != "docker-compose.prod.yml" || base.Env["API_PORT"] != "8080" {
+		t.Errorf("expected base config to be unchanged")
+	}
+
+	if err := staging.SetSecrets([]string{"B", "C"}); err != nil {
+		t.Fatalf("expected no error setting secrets, got '%v'", err)
+	}
+	var overlaySecrets []string
+	if err := json.Unmarshal(base.Environments["staging"]["secrets"], &overlaySecrets); err != nil {
+		t.Fatalf("failed to parse overlay secrets: %v", err)
+	}
+	if !slices.Equal(overlaySecrets, []string{"B", "C"}) || !slices.Equal(base.Secrets, []string{"A"}) {
+		t.Errorf("expected secrets to be written to overlay, got overlay=%v base=%v", overlaySecrets, base.Secrets)
+	}
+
+	if err := staging.UnsetEnvVar("LOG_LEVEL"); err == nil {
+		t.Errorf("expected error unsetting a top-level env var for one environment")
+	}
+	if err := staging.UnsetEnvVar("API_PORT"); err != nil {
+		t.Fatalf("expected no error unsetting an overridden env var, got '%v'", err)
+	}
+	var overlayEnv map[string]string
+	if err := json.Unmarshal(base.Environments["staging"]["env"], &overlayEnv); err != nil {
+		t.Fatalf("failed to parse overlay env: %v", err)
+	}
+	if _, prs := overlayEnv["API_PORT"]; prs || staging.Env["API_PORT"] != "8080" || base.Env["API_PORT"] != "8080" {
+		t.Errorf("expected API_PORT to fall back to the top-level env, got overlay=%v env=%v", overlayEnv, staging.Env)
+	}
+
+	if _, err := ApplyEnvironment(base, "bad"); err == nil {
+		t.Errorf("expected error for unknown field")
+	}
+	if _, err := ApplyEnvironment(base, "missing"); err == nil {
+		t.Errorf("expected error for missing environment")
+	}
+}
@@ -0,0 +1,55 @@
+package project
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultHealthCheckTimeoutSeconds  int = 60
+	DefaultHealthCheckIntervalSeconds int = 2
+)
+
+// Check run against the service after a deploy changes it. Exactly one of HttpPath,
+// Container or Command must be set.
+type HealthCheck struct {
+	// Path requested from localhost on the server at the project's API_PORT; any 2xx response passes
+	HttpPath string `json:"http_path,omitempty"`
+	// Name of the compose service whose container must report a "healthy" status
+	Container string `json:"container,omitempty"`
+	// Shell command run in the service directory on the server; exit code 0 passes
+	Command string `json:"command,omitempty"`
+
+	TimeoutSeconds  int `json:"timeout_seconds,omitempty"`
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+}
+
+func (h *HealthCheck) Validate() error {
+	set := 0
+	for _, v := range []string{h.HttpPath, h.Container, h.Command} {
+		if v != "" {
+			set += 1
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of http_path, container or command must be set")
+	}
+	if h.TimeoutSeconds < 0 || h.IntervalSeconds < 0 {
+		return fmt.Errorf("timeout_seconds & interval_seconds cannot be negative")
+	}
+	return nil
+}
+
+func (h *HealthCheck) Timeout() time.Duration {
+	if h.TimeoutSeconds == 0 {
+		return time.Duration(DefaultHealthCheckTimeoutSeconds) * time.Second
+	}
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+func (h *HealthCheck) Interval() time.Duration {
+	if h.IntervalSeconds == 0 {
+		return time.Duration(DefaultHealthCheckIntervalSeconds) * time.Second
+	}
+	return time.Duration(h.IntervalSeconds) * time.Second
+}
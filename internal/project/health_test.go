@@ -0,0 +1,41 @@
+package project
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthCheckValidate(t *testing.T) {
+	valid := []*HealthCheck{
+		{HttpPath: "/health"},
+		{Container: "api"},
+		{Command: "test -f ready", TimeoutSeconds: 10},
+	}
+	for _, h := range valid {
+		if err := h.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got '%v'", h, err)
+		}
+	}
+
+	invalid := []*HealthCheck{
+		{},
+		{HttpPath: "/health", Command: "true"},
+		{Container: "api", TimeoutSeconds: -1},
+	}
+	for _, h := range invalid {
+		if err := h.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid, got no error", h)
+		}
+	}
+}
+
+func TestHealthCheckDefaults(t *testing.T) {
+	h := &HealthCheck{HttpPath: "/health"}
+	if h.Timeout() != time.Duration(DefaultHealthCheckTimeoutSeconds)*time.Second {
+		t.Errorf("expected default timeout, got %s", h.Timeout())
+	}
+	h.IntervalSeconds = 5
+	if h.Interval() != 5*time.Second {
+		t.Errorf("expected interval of 5s, got %s", h.Interval())
+	}
+}
@@ -0,0 +1,62 @@
+package project
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	HookStagePreDeploy  string = "pre_deploy"
+	HookStagePostDeploy string = "post_deploy"
+
+	HookLocationLocal  string = "local"
+	HookLocationRemote string = "remote"
+
+	DefaultHookLocation string = HookLocationRemote
+)
+
+var (
+	SupportedHookStages    []string = []string{HookStagePreDeploy, HookStagePostDeploy}
+	SupportedHookLocations []string = []string{HookLocationLocal, HookLocationRemote}
+)
+
+// Command run before or after a deploy. Local hooks run in the project directory; remote
+// hooks run in the service directory on the server. A failing hook aborts the deploy
+// unless IgnoreFailure is set.
+type Hook struct {
+	Name     string `json:"name"`
+	Stage    string `json:"stage"`
+	Location string `json:"location,omitempty"`
+	Command  string `json:"command"`
+	// Names of assets (e.g. "docker-images"); if set, the hook only runs when one of them
+	// changed. Only valid for post-deploy hooks.
+	OnChanged     []string `json:"on_changed,omitempty"`
+	IgnoreFailure bool     `json:"ignore_failure,omitempty"`
+}
+
+func (h *Hook) GetLocation() string {
+	if h.Location == "" {
+		return DefaultHookLocation
+	}
+	return h.Location
+}
+
+func (h *Hook) Validate() error {
+	if h.Name == "" {
+		return fmt.Errorf("hook name is required")
+	}
+	if h.Command == "" {
+		return fmt.Errorf("hook %s has no command", h.Name)
+	}
+	if !slices.Contains(SupportedHookStages, h.Stage) {
+		return fmt.Errorf("hook %s has invalid stage '%s' (must be one of: %s)", h.Name, h.Stage, strings.Join(SupportedHookStages, ", "))
+	}
+	if !slices.Contains(SupportedHookLocations, h.GetLocation()) {
+		return fmt.Errorf("hook %s has invalid location '%s' (must be one of: %s)", h.Name, h.Location, strings.Join(SupportedHookLocations, ", "))
+	}
+	if len(h.OnChanged) > 0 && h.Stage != HookStagePostDeploy {
+		return fmt.Errorf("hook %s sets on_changed, which is only supported for %s hooks", h.Name, HookStagePostDeploy)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package project
+
+import "testing"
+
+func TestHookValidate(t *testing.T) {
+	valid := []*Hook{
+		{Name: "migrate", Stage: HookStagePreDeploy, Command: "./migrate.sh"},
+		{Name: "smoke", Stage: HookStagePostDeploy, Location: HookLocationLocal, Command: "make smoke"},
+		{Name: "warm", Stage: HookStagePostDeploy, Command: "curl localhost", OnChanged: []string{"docker-images"}},
+	}
+	for _, h := range valid {
+		if err := h.Validate(); err != nil {
+			t.Errorf("expected hook %s to be valid, got '%v'", h.Name, err)
+		}
+	}
+
+	invalid := []*Hook{
+		{Stage: HookStagePreDeploy, Command: "true"},
+		{Name: "no-command", Stage: HookStagePreDeploy},
+		{Name: "bad-stage", Stage: "during", Command: "true"},
+		{Name: "bad-location", Stage: HookStagePreDeploy, Location: "elsewhere", Command: "true"},
+		{Name: "pre-on-changed", Stage: HookStagePreDeploy, Command: "true", OnChanged: []string{"env-file"}},
+	}
+	for _, h := range invalid {
+		if err := h.Validate(); err == nil {
+			t.Errorf("expected hook %+v to be invalid, got no error", h)
+		}
+	}
+}
+
+func TestHookOnChangedAssetNames(t *testing.T) {
+	newConfig := func(onChanged ...string) *ProjectConfig {
+		return &ProjectConfig{
+			Name:                "foo",
+			DockerSecretsVolume: "foo-secrets",
+			AdditionalAssets:    []AdditionalAsset{{Name: "conf", SrcPath: "conf", DstPath: "conf"}},
+			Hooks:               []*Hook{{Name: "warm", Stage: HookStagePostDeploy, Command: "true", OnChanged: onChanged}},
+		}
+	}
+
+	for _, name := range []string{AssetDockerImages, AssetEnvFile, "conf"} {
+		if err := finalizeProjectConfig(newConfig(name), "smt.json"); err != nil {
+			t.Errorf("expected on_changed asset %s to be valid, got '%v'", name, err)
+		}
+	}
+	for _, name := range []string{"docker-image", "config"} {
+		if err := finalizeProjectConfig(newConfig(AssetEnvFile, name), "smt.json"); err == nil {
+			t.Errorf("expected on_changed asset %s to be invalid, got no error", name)
+		}
+	}
+}
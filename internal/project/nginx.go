@@ -0,0 +1,114 @@
+package project
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// Env variable holding the port the project's API is published on
+	ApiPortEnvName string = "API_PORT"
+)
+
+var (
+	validateMaxBodySizePatternString string         = "^[0-9]+[kKmMgG]?$"
+	validateMaxBodySizePattern       *regexp.Regexp = regexp.MustCompile(validateMaxBodySizePatternString)
+)
+
+// Routes from which deploy generates the project's nginx site file.
+type NginxConfig struct {
+	ServerNames []string      `json:"server_names"`
+	Routes      []*NginxRoute `json:"routes"`
+	// Value of client_max_body_size, e.g. "10m"; nginx's default if empty
+	MaxBodySize string `json:"max_body_size,omitempty"`
+	// Serve over HTTPS using the certificate for CertificateName
+	Tls             bool `json:"tls,omitempty"`
+	RedirectToHttps bool `json:"redirect_to_https,omitempty"`
+	// Name of the certificate under /etc/letsencrypt/live; defaults to the first server name
+	CertificateName string `json:"certificate_name,omitempty"`
+	// How missing certificates are issued; certbot if not set
+	Acme *AcmeConfig `json:"acme,omitempty"`
+}
+
+const (
+	AcmeClientCertbot string = "certbot"
+	AcmeClientCommand string = "command"
+
+	DefaultAcmeClient string = AcmeClientCertbot
+)
+
+var (
+	SupportedAcmeClients []string = []string{AcmeClientCertbot, AcmeClientCommand}
+)
+
+// ACME client run on the server to issue certificates for the project's server names.
+type AcmeConfig struct {
+	Client string `json:"client,omitempty"`
+	// Account email passed to certbot
+	Email string `json:"email,omitempty"`
+	// Shell command run by the "command" client, with SMT_CERT_NAME & SMT_DOMAINS set
+	Command string `json:"command,omitempty"`
+}
+
+func (a *AcmeConfig) GetClient() string {
+	if a == nil || a.Client == "" {
+		return DefaultAcmeClient
+	}
+	return a.Client
+}
+
+type NginxRoute struct {
+	Path string `json:"path"`
+	// Port on the server that requests are proxied to; defaults to the project's API_PORT
+	Port      int  `json:"port,omitempty"`
+	Websocket bool `json:"websocket,omitempty"`
+}
+
+// Name of the site file generated for the project.
+func GetGeneratedNginxSiteName(name string) string {
+	return fmt.Sprintf("%s.conf", name)
+}
+
+func (n *NginxConfig) GetCertificateName() string {
+	if n.CertificateName != "" {
+		return n.CertificateName
+	}
+	return n.ServerNames[0]
+}
+
+func (n *NginxConfig) Validate() error {
+	if len(n.ServerNames) == 0 {
+		return fmt.Errorf("at least one server name is required")
+	}
+	if len(n.Routes) == 0 {
+		return fmt.Errorf("at least one route is required")
+	}
+	paths := map[string]bool{}
+	for _, r := range n.Routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("route path '%s' must start with /", r.Path)
+		}
+		if paths[r.Path] {
+			return fmt.Errorf("duplicate route path %s", r.Path)
+		}
+		paths[r.Path] = true
+		if r.Port < 0 || r.Port > 65535 {
+			return fmt.Errorf("route %s has invalid port %d", r.Path, r.Port)
+		}
+	}
+	if n.MaxBodySize != "" && !validateMaxBodySizePattern.MatchString(n.MaxBodySize) {
+		return fmt.Errorf("invalid max body size '%s' (must match /%s/)", n.MaxBodySize, validateMaxBodySizePatternString)
+	}
+	if n.RedirectToHttps && !n.Tls {
+		return fmt.Errorf("redirect_to_https requires tls")
+	}
+	if client := n.Acme.GetClient(); !slices.Contains(SupportedAcmeClients, client) {
+		return fmt.Errorf("invalid acme client '%s' (must be one of: %s)", client, strings.Join(SupportedAcmeClients, ", "))
+	}
+	if n.Acme.GetClient() == AcmeClientCommand && n.Acme.Command == "" {
+		return fmt.Errorf("acme client %s requires a command", AcmeClientCommand)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
@@ -13,32 +14,64 @@ import (
 
 const ProjectConfigName string = "smt.json"
 
+const (
+	// Images are exported to a file & moved with the deploy transport
+	ImageTransferTransport string = "transport"
+	// Images are piped from `docker save` into `docker load` over SSH
+	ImageTransferStream string = "stream"
+	// Images are pushed to the project's registry & pulled by the server
+	ImageTransferRegistry string = "registry"
+
+	DefaultImageTransfer string = ImageTransferTransport
+
+	// Number of releases, & images of each image name, kept on the server when pruning
+	DefaultImageRetention int = 5
+)
+
+var (
+	SupportedImageTransfers []string = []string{ImageTransferTransport, ImageTransferStream, ImageTransferRegistry}
+)
+
 type ProjectConfig struct {
-	ProjectConfigPath   string            `json:"-"`
-	ProjectDir          string            `json:"-"`
-	NginxConfFiles      []string          `json:"-"`
-	Name                string            `json:"name"`
-	Type                string            `json:"type"`
-	ImageNames          []string          `json:"image_names"`
-	ImageCompareLabel   string            `json:"image_compare_label"`
-	DockerComposePath   string            `json:"docker_compose_path"`
-	Commands            map[string]string `json:"commands"`
-	SystemctlFilesDir   string            `json:"systemctl_files_dir"`
-	NginxFilesDir       string            `json:"nginx_files_dir"`
-	DockerSecretsVolume string            `json:"docker_secrets_volume"`
-	Secrets             []string          `json:"secrets"`
-	Env                 map[string]string `json:"env"`
-	AdditionalAssets    []AdditionalAsset `json:"additional_assets"`
-}
+	ProjectConfigPath   string                 `json:"-"`
+	ProjectDir          string                 `json:"-"`
+	NginxConfFiles      []string               `json:"-"`
+	Name                string                 `json:"name"`
+	Type                string                 `json:"type"`
+	ImageNames          []string               `json:"image_names"`
+	ImageCompareLabel   string                 `json:"image_compare_label"`
+	ImageTransfer       string                 `json:"image_transfer,omitempty"`
+	ImageBuilds         map[string]*ImageBuild `json:"image_builds,omitempty"`
+	ImageRetention      int                    `json:"image_retention,omitempty"`
+	Registry            *RegistryConfig        `json:"registry,omitempty"`
+	DockerComposePath   string                 `json:"docker_compose_path"`
+	Commands            map[string]string      `json:"commands"`
+	SystemctlFilesDir   string                 `json:"systemctl_files_dir"`
+	NginxFilesDir       string                 `json:"nginx_files_dir"`
+	DockerSecretsVolume string                 `json:"docker_secrets_volume"`
+	Secrets             []string               `json:"secrets"`
+	Env                 map[string]string      `json:"env"`
+	AdditionalAssets    []AdditionalAsset      `json:"additional_assets"`
+	HealthCheck         *HealthCheck           `json:"health_check,omitempty"`
+	Hooks               []*Hook                `json:"hooks,omitempty"`
+	Nginx               *NginxConfig           `json:"nginx,omitempty"`
+	BlueGreen           *BlueGreenConfig       `json:"blue_green,omitempty"`
+	Backup              *BackupConfig          `json:"backup,omitempty"`
+	DependsOn           []string               `json:"depends_on,omitempty"`
 
-type AdditionalAsset struct {
-	Name    string `json:"name"`
-	SrcPath string `json:"src_path"`
+	Environments      map[string]map[string]json.RawMessage `json:"environments,omitempty"`
+	Environment       string                                `json:"-"`
+	EnvironmentServer string                                `json:"-"`
 
-	// TODO: How do we make this work?
-	DstPath   string `json:"dst_path"`
-	Recursive bool   `json:"recursive"`
-	Force     bool   `json:"force"`
+	// Config as loaded from disk, without any environment overlay applied
+	base *ProjectConfig
+}
+
+// How to build one of the project's images with `deploy -build`. Paths are relative to the
+// project directory.
+type ImageBuild struct {
+	Context    string `json:"context,omitempty"`
+	Dockerfile string `json:"dockerfile,omitempty"`
 }
 
 var (
@@ -46,6 +79,14 @@ var (
 	validateVolumePattern       *regexp.Regexp = regexp.MustCompile(validateVolumePatternString)
 )
 
+// Gets the number of images of each image name to keep on the server.
+func (c *ProjectConfig) GetImageRetention() int {
+	if c.ImageRetention == 0 {
+		return DefaultImageRetention
+	}
+	return c.ImageRetention
+}
+
 func LoadProjectConfig(path string) (*ProjectConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -58,8 +99,92 @@ func LoadProjectConfig(path string) (*ProjectConfig, error) {
 	config.ProjectConfigPath = path
 	config.ProjectDir = filepath.Dir(path)
 
+	if err := finalizeProjectConfig(config, path); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Validates the config & populates its derived fields.
+func finalizeProjectConfig(config *ProjectConfig, path string) error {
 	if !validateVolumePattern.Match([]byte(config.DockerSecretsVolume)) {
-		return nil, fmt.Errorf("invalid Docker secrets volume name (must match /%s/); update the docker_secrets_volume entry in %s and try again", validateVolumePatternString, path)
+		return fmt.Errorf("invalid Docker secrets volume name (must match /%s/); update the docker_secrets_volume entry in %s and try again", validateVolumePatternString, path)
+	}
+
+	if config.ImageTransfer != "" && !slices.Contains(SupportedImageTransfers, config.ImageTransfer) {
+		return fmt.Errorf("invalid image transfer mode '%s' (must be one of: %s); update the image_transfer entry in %s and try again", config.ImageTransfer, strings.Join(SupportedImageTransfers, ", "), path)
+	}
+
+	if config.Registry != nil {
+		if err := config.Registry.Validate(); err != nil {
+			return fmt.Errorf("%w; update the registry entry in %s and try again", err, path)
+		}
+	} else if config.ImageTransfer == ImageTransferRegistry {
+		return fmt.Errorf("image transfer mode '%s' requires a registry; add a registry entry to %s and try again", ImageTransferRegistry, path)
+	}
+
+	if config.ImageRetention < 0 {
+		return fmt.Errorf("invalid image retention %d (must be positive); update the image_retention entry in %s and try again", config.ImageRetention, path)
+	}
+
+	if config.HealthCheck != nil {
+		if err := config.HealthCheck.Validate(); err != nil {
+			return fmt.Errorf("invalid health check: %w; update the health_check entry in %s and try again", err, path)
+		}
+	}
+
+	assetNames := map[string]bool{}
+	for _, a := range config.AdditionalAssets {
+		if err := a.Validate(); err != nil {
+			return fmt.Errorf("invalid additional asset: %w; update the additional_assets entry in %s and try again", err, path)
+		}
+		if assetNames[a.Name] {
+			return fmt.Errorf("duplicate additional asset name %s; update the additional_assets entry in %s and try again", a.Name, path)
+		}
+		assetNames[a.Name] = true
+	}
+
+	knownAssetNames := append(slices.Clone(BuiltinAssetNames), utils.Map(config.AdditionalAssets, func(a AdditionalAsset) string { return a.Name })...)
+	hookNames := map[string]bool{}
+	for _, h := range config.Hooks {
+		if err := h.Validate(); err != nil {
+			return fmt.Errorf("invalid hook: %w; update the hooks entry in %s and try again", err, path)
+		}
+		for _, name := range h.OnChanged {
+			if !slices.Contains(knownAssetNames, name) {
+				return fmt.Errorf("hook %s has unknown on_changed asset '%s' (must be one of: %s); update the hooks entry in %s and try again", h.Name, name, strings.Join(knownAssetNames, ", "), path)
+			}
+		}
+		if hookNames[h.Name] {
+			return fmt.Errorf("duplicate hook name %s; update the hooks entry in %s and try again", h.Name, path)
+		}
+		hookNames[h.Name] = true
+	}
+
+	if config.BlueGreen != nil {
+		if err := config.BlueGreen.Validate(); err != nil {
+			return fmt.Errorf("invalid blue/green config: %w; update the blue_green entry in %s and try again", err, path)
+		}
+		if config.Nginx == nil || config.HealthCheck == nil {
+			return fmt.Errorf("blue/green deploys require nginx & health_check entries; update %s and try again", path)
+		}
+	}
+
+	if config.Backup != nil {
+		if err := config.Backup.Validate(); err != nil {
+			return fmt.Errorf("invalid backup config: %w; update the backup entry in %s and try again", err, path)
+		}
+	}
+
+	if slices.Contains(config.DependsOn, config.Name) {
+		return fmt.Errorf("project %s cannot depend on itself; update the depends_on entry in %s and try again", config.Name, path)
+	}
+
+	for image := range config.ImageBuilds {
+		if !slices.Contains(config.ImageNames, image) {
+			return fmt.Errorf("image build declared for %s, which is not in image_names; update the image_builds entry in %s and try again", image, path)
+		}
 	}
 
 	nginxFilesDir := config.NginxFilesDir
@@ -67,16 +192,19 @@ func LoadProjectConfig(path string) (*ProjectConfig, error) {
 		nginxFilesDirFull := filepath.Join(config.ProjectDir, nginxFilesDir)
 		prs, err := utils.DirExists(nginxFilesDirFull)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read subdirectory '%s' of project: %w", nginxFilesDir, err)
+			return fmt.Errorf("failed to read subdirectory '%s' of project: %w", nginxFilesDir, err)
 		}
 		if prs {
 			files, err := os.ReadDir(nginxFilesDirFull)
 			if err != nil {
-				return nil, fmt.Errorf("failed to read nginx entries in %s: %w", nginxFilesDirFull, err)
+				return fmt.Errorf("failed to read nginx entries in %s: %w", nginxFilesDirFull, err)
 			}
 			nginxFilePaths := []string{}
 			for _, f := range files {
-				nginxFilePaths = append(nginxFilePaths, filepath.Join("nginx", f.Name()))
+				if f.IsDir() {
+					continue
+				}
+				nginxFilePaths = append(nginxFilePaths, filepath.Join(nginxFilesDir, f.Name()))
 			}
 			config.NginxConfFiles = nginxFilePaths
 		} else {
@@ -84,7 +212,13 @@ func LoadProjectConfig(path string) (*ProjectConfig, error) {
 		}
 	}
 
-	return config, nil
+	if config.Nginx != nil {
+		if err := config.Nginx.Validate(); err != nil {
+			return fmt.Errorf("invalid nginx config: %w; update the nginx entry in %s and try again", err, path)
+		}
+	}
+
+	return nil
 }
 
 func parseProjectConfig(data []byte) (*ProjectConfig, error) {
@@ -95,7 +229,12 @@ func parseProjectConfig(data []byte) (*ProjectConfig, error) {
 	return config, nil
 }
 
+// Saves the config to its project config path. If an environment overlay has been
+// applied, the config as originally loaded (with any changes made through it) is saved.
 func SaveProjectConfig(config *ProjectConfig) error {
+	if config.base != nil {
+		return SaveProjectConfig(config.base)
+	}
 	jsonStr, err := json.MarshalIndent(config, "", "\t")
 	if err != nil {
 		return err
@@ -0,0 +1,37 @@
+package project
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var (
+	validateRegistryUrlPatternString string         = "^[a-zA-Z0-9.\\-]+(:[0-9]+)?(/[a-z0-9._\\-]+)*$"
+	validateRegistryUrlPattern       *regexp.Regexp = regexp.MustCompile(validateRegistryUrlPatternString)
+)
+
+// Docker registry that deploy pushes the project's images to & the server pulls them from.
+// Both ends must already be logged in to the registry if it requires authentication.
+type RegistryConfig struct {
+	// Registry host, optionally with a port & a path prefix, e.g. registry.example.com:5000/team
+	Url string `json:"url"`
+}
+
+func (r *RegistryConfig) Validate() error {
+	if !validateRegistryUrlPattern.MatchString(r.Url) {
+		return fmt.Errorf("invalid registry url '%s' (must be a host with optional port & path, without a scheme, matching /%s/)", r.Url, validateRegistryUrlPatternString)
+	}
+	return nil
+}
+
+// Gets the image transfer mode of the project. Projects with a registry use it unless they
+// choose otherwise.
+func (c *ProjectConfig) GetImageTransfer() string {
+	if c.ImageTransfer != "" {
+		return c.ImageTransfer
+	}
+	if c.Registry != nil {
+		return ImageTransferRegistry
+	}
+	return DefaultImageTransfer
+}
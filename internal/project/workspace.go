@@ -0,0 +1,108 @@
+package project
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var (
+	// Directories never searched for projects, besides hidden ones
+	workspaceSkipDirs []string = []string{"node_modules", "vendor"}
+)
+
+// Finds the project config files under root, in lexical order. Hidden directories & those
+// holding dependencies are not searched.
+func FindProjectConfigs(root string) ([]string, error) {
+	rootAbs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+
+	paths := []string{}
+	err = filepath.WalkDir(rootAbs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != rootAbs && (strings.HasPrefix(d.Name(), ".") || slices.Contains(workspaceSkipDirs, d.Name())) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == ProjectConfigName {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s for projects: %w", rootAbs, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no %s files found under %s", ProjectConfigName, rootAbs)
+	}
+	return paths, nil
+}
+
+// Orders the projects of a workspace so that each comes after the projects in its
+// depends_on. Projects that do not depend on each other keep their order.
+func OrderByDependencies(projects []*ProjectConfig) ([]*ProjectConfig, error) {
+	byName := map[string]*ProjectConfig{}
+	for _, p := range projects {
+		if other, prs := byName[p.Name]; prs {
+			return nil, fmt.Errorf("project name %s is used by both %s and %s", p.Name, other.ProjectConfigPath, p.ProjectConfigPath)
+		}
+		byName[p.Name] = p
+	}
+	for _, p := range projects {
+		for _, d := range p.DependsOn {
+			if _, prs := byName[d]; !prs {
+				return nil, fmt.Errorf("project %s depends on %s, which is not in the workspace", p.Name, d)
+			}
+		}
+	}
+
+	ordered := []*ProjectConfig{}
+	visited, visiting := map[string]bool{}, map[string]bool{}
+	var visit func(p *ProjectConfig, path []string) error
+	visit = func(p *ProjectConfig, path []string) error {
+		if visited[p.Name] {
+			return nil
+		}
+		path = append(path, p.Name)
+		if visiting[p.Name] {
+			return fmt.Errorf("projects depend on each other in a cycle: %s", strings.Join(path, " -> "))
+		}
+		visiting[p.Name] = true
+		for _, d := range p.DependsOn {
+			if err := visit(byName[d], path); err != nil {
+				return err
+			}
+		}
+		visiting[p.Name] = false
+		visited[p.Name] = true
+		ordered = append(ordered, p)
+		return nil
+	}
+	for _, p := range projects {
+		if err := visit(p, []string{}); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// Whether the project depends, directly or not, on any of the named projects.
+func DependsOnAny(p *ProjectConfig, projects map[string]*ProjectConfig, names map[string]bool) bool {
+	for _, d := range p.DependsOn {
+		if names[d] {
+			return true
+		}
+		if dep, prs := projects[d]; prs && DependsOnAny(dep, projects, names) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package project
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFindProjectConfigs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"api", "web/frontend", ".git/sub", "web/node_modules/dep", "empty"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", dir, err)
+		}
+	}
+	for _, dir := range []string{"api", "web/frontend", ".git/sub", "web/node_modules/dep"} {
+		if err := os.WriteFile(filepath.Join(root, dir, ProjectConfigName), []byte("{}"), 0644); err != nil {
+			t.Fatalf("failed to write config in %s: %v", dir, err)
+		}
+	}
+
+	paths, err := FindProjectConfigs(root)
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	expected := []string{filepath.Join(root, "api", ProjectConfigName), filepath.Join(root, "web", "frontend", ProjectConfigName)}
+	if !slices.Equal(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	if _, err := FindProjectConfigs(filepath.Join(root, "empty")); err == nil {
+		t.Errorf("expected error for directory without projects")
+	}
+}
+
+func TestOrderByDependencies(t *testing.T) {
+	projects := []*ProjectConfig{
+		{Name: "web", DependsOn: []string{"api"}},
+		{Name: "api", DependsOn: []string{"db"}},
+		{Name: "docs"},
+		{Name: "db"},
+	}
+	ordered, err := OrderByDependencies(projects)
+	if err != nil {
+		t.Fatalf("expected no error, got '%v'", err)
+	}
+	names := []string{}
+	for _, p := range ordered {
+		names = append(names, p.Name)
+	}
+	if !slices.Equal(names, []string{"db", "api", "web", "docs"}) {
+		t.Errorf("expected projects after their dependencies, got %v", names)
+	}
+
+	byName := map[string]*ProjectConfig{}
+	for _, p := range projects {
+		byName[p.Name] = p
+	}
+	if !DependsOnAny(byName["web"], byName, map[string]bool{"db": true}) {
+		t.Errorf("expected web to depend on db through api")
+	}
+	if DependsOnAny(byName["docs"], byName, map[string]bool{"db": true}) {
+		t.Errorf("expected docs not to depend on db")
+	}
+
+	cyclic := []*ProjectConfig{
+		{Name: "a", DependsOn: []string{"b"}},
+		{Name: "b", DependsOn: []string{"a"}},
+	}
+	if _, err := OrderByDependencies(cyclic); err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Errorf("expected cycle error, got '%v'", err)
+	}
+
+	unknown := []*ProjectConfig{{Name: "a", DependsOn: []string{"missing"}}}
+	if _, err := OrderByDependencies(unknown); err == nil {
+		t.Errorf("expected error for unknown dependency")
+	}
+
+	duplicate := []*ProjectConfig{{Name: "a"}, {Name: "a"}}
+	if _, err := OrderByDependencies(duplicate); err == nil {
+		t.Errorf("expected error for duplicate project name")
+	}
+}
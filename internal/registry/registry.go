@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/docker"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/release"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+var (
+	composeImageLinePattern *regexp.Regexp = regexp.MustCompile(`^(\s*image:\s*)(["']?)([^"'\s#]+)(["']?)(\s*(#.*)?)$`)
+)
+
+// One of the project's images as distributed through the registry.
+type Image struct {
+	// Name of the image in the project's image_names
+	Name string
+	// Reference the server pulls: the pushed digest if known, otherwise the pushed tag
+	Reference string
+}
+
+// Gets the reference in the registry of the image with the given name, tagged with tag.
+// Any tag on the name is replaced.
+func GetTaggedReference(registryUrl string, name string, tag string) string {
+	repository, _ := release.SplitImageReference(name)
+	return fmt.Sprintf("%s/%s:%s", registryUrl, repository, tag)
+}
+
+// Tags each image in names with tag in the registry at registryUrl & pushes it, returning the
+// digest reference of each pushed image. On a dry run nothing is pushed, & the digest is only
+// known if the image was pushed before.
+func Push(exec deploy.Executor, registryUrl string, names []string, tag string, dryRun bool) ([]*Image, error) {
+	images := []*Image{}
+	for _, name := range names {
+		ref := GetTaggedReference(registryUrl, name, tag)
+		repository, _ := release.SplitImageReference(ref)
+		if dryRun {
+			digestRef, err := findDigestReference(exec, name, repository)
+			if err != nil {
+				return nil, err
+			}
+			if digestRef == "" {
+				slog.Info("DRY RUN: image not yet pushed; digest unknown until it is", "image", name, "ref", ref)
+				digestRef = ref
+			} else {
+				slog.Info("DRY RUN: push image", "image", name, "ref", ref, "digest", digestRef)
+			}
+			images = append(images, &Image{Name: name, Reference: digestRef})
+			continue
+		}
+
+		if _, stderr, err := exec.ExecuteCommand("docker", "tag", name, ref); err != nil {
+			return nil, fmt.Errorf("[%s] failed to tag image %s as %s (stderr: %s): %w", exec.Name(), name, ref, stderr, err)
+		}
+		slog.Info("pushing image", "image", name, "ref", ref)
+		if _, stderr, err := exec.ExecuteCommand("docker", "push", ref); err != nil {
+			return nil, fmt.Errorf("[%s] failed to push image %s (stderr: %s): %w", exec.Name(), ref, stderr, err)
+		}
+		digestRef, err := findDigestReference(exec, ref, repository)
+		if err != nil {
+			return nil, err
+		}
+		if digestRef == "" {
+			return nil, fmt.Errorf("[%s] pushed image %s but found no digest for it in %s", exec.Name(), ref, registryUrl)
+		}
+		slog.Debug("pushed image", "image", name, "digest", digestRef)
+		images = append(images, &Image{Name: name, Reference: digestRef})
+	}
+	return images, nil
+}
+
+// Finds the digest reference (repository@sha256:...) of the image ref in repository, or
+// empty if the image has not been pushed to or pulled from it.
+func findDigestReference(exec deploy.Executor, ref string, repository string) (string, error) {
+	stdout, stderr, err := exec.ExecuteCommand("docker", "image", "inspect", "--format", "{{ json .RepoDigests }}", ref)
+	if err != nil {
+		return "", fmt.Errorf("[%s] failed to inspect image %s (stderr: %s): %w", exec.Name(), ref, stderr, err)
+	}
+	var digests []string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stdout)), &digests); err != nil {
+		return "", fmt.Errorf("[%s] failed to parse digests of image %s: %w", exec.Name(), ref, err)
+	}
+	for _, d := range digests {
+		if strings.HasPrefix(d, repository+"@") {
+			return d, nil
+		}
+	}
+	return "", nil
+}
+
+// Replaces the image of each docker-compose service that uses one of the given images with
+// the image's registry reference, returning the updated contents & the names of the images
+// that no service uses.
+func PinComposeImages(contents string, images []*Image) (string, []string) {
+	used := map[string]bool{}
+	lines := strings.Split(contents, "\n")
+	for i, l := range lines {
+		m := composeImageLinePattern.FindStringSubmatch(l)
+		if m == nil || m[2] != m[4] {
+			continue
+		}
+		for _, image := range images {
+			if docker.SameImage(m[3], image.Name) {
+				lines[i] = m[1] + m[2] + image.Reference + m[4] + m[5]
+				used[image.Name] = true
+				break
+			}
+		}
+	}
+
+	unused := []string{}
+	for _, image := range images {
+		if !used[image.Name] {
+			unused = append(unused, image.Name)
+		}
+	}
+	return strings.Join(lines, "\n"), unused
+}
+
+// Creates a provider that has the destination pull each image by its registry reference &
+// tags it with the image's name, so that the rest of deploy sees the same images as with
+// the other image transfer modes.
+func NewPullProvider(name string, images []*Image) deploy.Provider {
+	return &pullProvider{name: name, images: images}
+}
+
+type pullProvider struct {
+	name   string
+	images []*Image
+}
+
+func (p *pullProvider) Name() string { return p.name }
+
+func (p *pullProvider) Yaml(indent int) string {
+	propIndent := strings.Repeat(" ", indent+4)
+	imageLines := []string{}
+	for _, i := range p.images {
+		imageLines = append(imageLines, fmt.Sprintf("%s- %s", strings.Repeat(" ", indent+8), i.Reference))
+	}
+	return fmt.Sprintf(
+		`%sregistry_pull:
+%sname: %s
+%simages:
+%s`,
+		strings.Repeat(" ", indent),
+		propIndent, p.name,
+		propIndent,
+		strings.Join(imageLines, "\n"))
+}
+
+func (p *pullProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	dst := cfg.DstExecutor
+	result := deploy.SYNC_RESULT_NOCHANGE
+	for _, i := range p.images {
+		pulledId, err := getImageId(dst, i.Reference)
+		if err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+		current, err := docker.InspectImage(dst, i.Name, "")
+		if err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+		if pulledId != "" && current != nil && current.ID == pulledId {
+			slog.Debug("image up to date", "name", p.Name(), "image", i.Name, "ref", i.Reference, "dst", dst.Name())
+			continue
+		}
+
+		if current == nil {
+			result = deploy.SYNC_RESULT_CREATED
+		} else if result == deploy.SYNC_RESULT_NOCHANGE {
+			result = deploy.SYNC_RESULT_UPDATED
+		}
+
+		if cfg.DryRun {
+			slog.Info("DRY RUN: pull image", "image", i.Name, "ref", i.Reference, "dst", dst.Name())
+			continue
+		}
+		if pulledId == "" {
+			slog.Info("pulling image", "image", i.Name, "ref", i.Reference, "dst", dst.Name())
+			if _, stderr, err := dst.ExecuteShell(fmt.Sprintf("docker pull --quiet %s", utils.ShellQuote(i.Reference))); err != nil {
+				return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("[%s] failed to pull image %s (stderr: %s): %w", dst.Name(), i.Reference, stderr, err)
+			}
+		}
+		if _, stderr, err := dst.ExecuteShell(fmt.Sprintf("docker tag %s %s", utils.ShellQuote(i.Reference), utils.ShellQuote(i.Name))); err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("[%s] failed to tag image %s as %s (stderr: %s): %w", dst.Name(), i.Reference, i.Name, stderr, err)
+		}
+	}
+	return result, nil
+}
+
+func (p *pullProvider) Digest(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+	// References are pinned to digests, so they identify the pulled content
+	refs := utils.Map(p.images, func(i *Image) string { return i.Reference })
+	dstDigest, err := plan.HashImages(dst, utils.Map(p.images, func(i *Image) string { return i.Name }))
+	if err != nil {
+		return nil, err
+	}
+	return &plan.Digest{Src: plan.HashValues(refs...), Dst: dstDigest}, nil
+}
+
+// Gets the ID of the image with the given reference, or empty if it does not exist.
+func getImageId(exec deploy.Executor, ref string) (string, error) {
+	stdout, stderr, err := exec.ExecuteShell(fmt.Sprintf("(docker image inspect --format '{{ .Id }}' %s 2>/dev/null) || echo 'not-exists'", utils.ShellQuote(ref)))
+	if err != nil {
+		return "", fmt.Errorf("[%s] failed to inspect image %s (stderr: %s): %w", exec.Name(), ref, stderr, err)
+	}
+	id := strings.TrimSpace(stdout)
+	if id == "not-exists" {
+		return "", nil
+	}
+	return id, nil
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGetTaggedReference(t *testing.T) {
+	cases := map[string]string{
+		"foo":                  "localhost:5000/foo:abc123",
+		"foo:latest":           "localhost:5000/foo:abc123",
+		"quemot/foo:1.2":       "localhost:5000/quemot/foo:abc123",
+		"quemot/foo-api:stage": "localhost:5000/quemot/foo-api:abc123",
+	}
+	for name, expected := range cases {
+		if actual := GetTaggedReference("localhost:5000", name, "abc123"); actual != expected {
+			t.Errorf("GetTaggedReference(%q) = %q, expected %q", name, actual, expected)
+		}
+	}
+}
+
+func TestPinComposeImages(t *testing.T) {
+	contents := `services:
+  api:
+    image: quemot/foo:latest
+    restart: always
+  worker:
+    image: "quemot/foo" # same image
+  db:
+    image: postgres:16
+`
+	images := []*Image{
+		{Name: "quemot/foo:latest", Reference: "localhost:5000/quemot/foo@sha256:abc"},
+		{Name: "quemot/bar:latest", Reference: "localhost:5000/quemot/bar@sha256:def"},
+	}
+	expected := `services:
+  api:
+    image: localhost:5000/quemot/foo@sha256:abc
+    restart: always
+  worker:
+    image: "localhost:5000/quemot/foo@sha256:abc" # same image
+  db:
+    image: postgres:16
+`
+
+	actual, unused := PinComposeImages(contents, images)
+	if actual != expected {
+		t.Errorf("expected pinned contents:\n%s\ngot:\n%s", expected, actual)
+	}
+	if !slices.Equal(unused, []string{"quemot/bar:latest"}) {
+		t.Errorf("expected quemot/bar:latest to be unused, got %v", unused)
+	}
+}
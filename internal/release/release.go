@@ -0,0 +1,335 @@
+package release
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/docker"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/nginx"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/service"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+const (
+	ReleasesDirName        string = "releases"
+	ReleaseFileName        string = "release.json"
+	CurrentReleaseFileName string = "current"
+	ReleaseTagPrefix       string = "smt-release-"
+	// Directory in a release holding copies of the service's nginx sites
+	ReleaseSitesDirName string = "nginx-sites"
+
+	releaseIdFormat string = "20060102T150405Z"
+)
+
+var (
+	// Files & directories, relative to the service directory, that are captured with each release.
+	ReleaseAssetPaths []string = []string{
+		"docker-compose.yml",
+		".env",
+		service.SystemdUnitDirName,
+		service.ServiceConfigFileName,
+	}
+)
+
+type Release struct {
+	ID        string          `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Files     []string        `json:"files"`
+	Images    []*ReleaseImage `json:"images"`
+	// Unset for releases recorded before nginx sites were part of them
+	Sites []string `json:"sites"`
+}
+
+type ReleaseImage struct {
+	Repository string `json:"repository"`
+	ImageID    string `json:"image_id"`
+	Sha        string `json:"sha"`
+	Tag        string `json:"tag"`
+}
+
+func GetReleasesDir(servicePath string) string {
+	return filepath.Join(servicePath, ReleasesDirName)
+}
+
+func GetReleaseDir(servicePath string, id string) string {
+	return filepath.Join(GetReleasesDir(servicePath), id)
+}
+
+// Records the currently-deployed assets of the service at servicePath as a new release.
+// Each asset in ReleaseAssetPaths & each of the service's nginx sites is copied into the
+// release directory, and each image in imageNames is tagged with a release-specific tag so
+// that it survives being replaced by a later deploy. The new release is marked as the
+// current release.
+func RecordRelease(exec deploy.Executor, servicePath string, imageNames []string, compareLabel string, sites []string) (*Release, error) {
+	now := time.Now().UTC()
+	release := &Release{
+		ID:        now.Format(releaseIdFormat),
+		Timestamp: now,
+		Files:     []string{},
+		Images:    []*ReleaseImage{},
+		Sites:     []string{},
+	}
+
+	// IDs have a resolution of a second, so a release recorded in the same second as the
+	// last one would otherwise overwrite it
+	releaseDir := GetReleaseDir(servicePath, release.ID)
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("(test -e %s && echo 'exists') || (mkdir -p %s && echo 'created')", utils.ShellQuote(releaseDir), utils.ShellQuote(releaseDir)))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to create release directory %s: %w", exec.Name(), releaseDir, err)
+	}
+	if strings.TrimSpace(stdout) == "exists" {
+		return nil, fmt.Errorf("[%s] release %s already exists; releases can be recorded at most once a second", exec.Name(), release.ID)
+	}
+
+	for _, p := range ReleaseAssetPaths {
+		srcPath := filepath.Join(servicePath, p)
+		stdoutRaw, _, err := exec.ExecuteShell(fmt.Sprintf("(test -e '%s' && cp -r '%s' '%s' && echo 'copied') || echo 'not-exists'", srcPath, srcPath, releaseDir))
+		if err != nil {
+			return nil, fmt.Errorf("[%s] failed to copy %s into release %s: %w", exec.Name(), srcPath, release.ID, err)
+		}
+		if strings.Trim(stdoutRaw, " \n") == "copied" {
+			release.Files = append(release.Files, p)
+		} else {
+			slog.Debug("release asset does not exist; skipping", "path", srcPath, "release", release.ID)
+		}
+	}
+
+	sitesDir := filepath.Join(releaseDir, ReleaseSitesDirName)
+	if len(sites) > 0 {
+		if _, _, err := exec.ExecuteCommand("mkdir", "-p", sitesDir); err != nil {
+			return nil, fmt.Errorf("[%s] failed to create release directory %s: %w", exec.Name(), sitesDir, err)
+		}
+	}
+	for _, s := range sites {
+		if _, stderr, err := exec.ExecuteCommand("cp", nginx.GetAvailablePath(s), sitesDir); err != nil {
+			return nil, fmt.Errorf("[%s] failed to copy nginx site %s into release %s (stderr: %s): %w", exec.Name(), s, release.ID, stderr, err)
+		}
+		release.Sites = append(release.Sites, s)
+	}
+
+	for _, imageName := range imageNames {
+		inspected, err := docker.InspectImage(exec, imageName, compareLabel)
+		if err != nil {
+			return nil, err
+		}
+		if inspected == nil {
+			return nil, fmt.Errorf("[%s] image %s does not exist", exec.Name(), imageName)
+		}
+		repository, _ := SplitImageReference(imageName)
+		image := &ReleaseImage{
+			Repository: imageName,
+			ImageID:    inspected.ID,
+			Sha:        inspected.CompareValue,
+			Tag:        fmt.Sprintf("%s:%s%s", repository, ReleaseTagPrefix, release.ID),
+		}
+		if _, stderr, err := exec.ExecuteCommand("docker", "tag", image.ImageID, image.Tag); err != nil {
+			return nil, fmt.Errorf("[%s] failed to tag image %s as %s (stderr: %s): %w", exec.Name(), imageName, image.Tag, stderr, err)
+		}
+		release.Images = append(release.Images, image)
+	}
+
+	if err := writeFile(exec, filepath.Join(releaseDir, ReleaseFileName), release); err != nil {
+		return nil, err
+	}
+	if err := SetCurrentRelease(exec, servicePath, release.ID); err != nil {
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// Restores the assets, nginx sites & images of the given release into the service at
+// servicePath, overwriting whatever is currently deployed. currentSites are the service's
+// sites before the restore; those not in the release are removed. nginx is reloaded if the
+// release has sites, but the service is not restarted.
+func RestoreRelease(exec deploy.Executor, servicePath string, release *Release, currentSites []string) error {
+	releaseDir := GetReleaseDir(servicePath, release.ID)
+	for _, p := range release.Files {
+		srcPath := filepath.Join(releaseDir, p)
+		dstPath := filepath.Join(servicePath, p)
+		if _, _, err := exec.ExecuteShell(fmt.Sprintf("rm -rf '%s' && cp -r '%s' '%s'", dstPath, srcPath, dstPath)); err != nil {
+			return fmt.Errorf("[%s] failed to restore %s from release %s: %w", exec.Name(), dstPath, release.ID, err)
+		}
+	}
+
+	if release.Sites != nil {
+		if err := restoreSites(exec, releaseDir, release, currentSites); err != nil {
+			return err
+		}
+	}
+
+	for _, image := range release.Images {
+		if _, stderr, err := exec.ExecuteCommand("docker", "tag", image.Tag, image.Repository); err != nil {
+			return fmt.Errorf("[%s] failed to re-tag image %s as %s (stderr: %s): %w", exec.Name(), image.Tag, image.Repository, stderr, err)
+		}
+	}
+
+	return SetCurrentRelease(exec, servicePath, release.ID)
+}
+
+func restoreSites(exec deploy.Executor, releaseDir string, release *Release, currentSites []string) error {
+	removed := slices.DeleteFunc(slices.Clone(currentSites), func(s string) bool { return slices.Contains(release.Sites, s) })
+	if err := nginx.RemoveSites(exec, removed); err != nil {
+		return err
+	}
+	sitesDir := filepath.Join(releaseDir, ReleaseSitesDirName)
+	for _, s := range release.Sites {
+		if err := nginx.InstallSite(exec, s, filepath.Join(sitesDir, s)); err != nil {
+			return fmt.Errorf("failed to restore nginx site %s from release %s: %w", s, release.ID, err)
+		}
+	}
+	if _, stderr, err := exec.ExecuteShell(fmt.Sprintf("nginx -t && %s", nginx.ReloadCommand)); err != nil {
+		return fmt.Errorf("[%s] failed to reload nginx after restoring sites of release %s (stderr: %s): %w", exec.Name(), release.ID, stderr, err)
+	}
+	return nil
+}
+
+// Lists all releases recorded for the service at servicePath, oldest first.
+func ListReleases(exec deploy.Executor, servicePath string) ([]*Release, error) {
+	releasesDir := GetReleasesDir(servicePath)
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("test -d '%s' && for f in '%s'/*/%s; do test -f \"$f\" && cat \"$f\"; done; true", releasesDir, releasesDir, ReleaseFileName))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to read releases in %s: %w", exec.Name(), releasesDir, err)
+	}
+
+	releases := []*Release{}
+	decoder := json.NewDecoder(strings.NewReader(stdout))
+	for {
+		var release *Release
+		if err := decoder.Decode(&release); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("[%s] failed to parse releases in %s: %w", exec.Name(), releasesDir, err)
+		}
+		releases = append(releases, release)
+	}
+
+	slices.SortFunc(releases, func(x, y *Release) int { return strings.Compare(x.ID, y.ID) })
+	return releases, nil
+}
+
+func GetCurrentRelease(exec deploy.Executor, servicePath string) (string, error) {
+	currentPath := filepath.Join(GetReleasesDir(servicePath), CurrentReleaseFileName)
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("test -f '%s' && cat '%s'; true", currentPath, currentPath))
+	if err != nil {
+		return "", fmt.Errorf("[%s] failed to read current release from %s: %w", exec.Name(), currentPath, err)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+func SetCurrentRelease(exec deploy.Executor, servicePath string, id string) error {
+	currentPath := filepath.Join(GetReleasesDir(servicePath), CurrentReleaseFileName)
+	if _, _, err := exec.ExecuteShell(fmt.Sprintf("echo '%s' > '%s'", id, currentPath)); err != nil {
+		return fmt.Errorf("[%s] failed to set current release to %s: %w", exec.Name(), id, err)
+	}
+	return nil
+}
+
+// Selects the releases that fall outside the retention policy: all but the newest keep
+// releases, excluding the current one.
+func SelectPrunable(releases []*Release, current string, keep int) []*Release {
+	prunable := []*Release{}
+	for idx, r := range releases {
+		if idx >= len(releases)-keep || r.ID == current {
+			continue
+		}
+		prunable = append(prunable, r)
+	}
+	return prunable
+}
+
+// Removes the releases of the service at servicePath that fall outside the retention policy
+// unless dryRun is set. Returns the releases that were (or would be) removed & those kept.
+// The images of removed releases are left to be pruned with the service's other images.
+func Prune(exec deploy.Executor, servicePath string, keep int, dryRun bool) ([]*Release, []*Release, error) {
+	if keep < 1 {
+		return nil, nil, fmt.Errorf("invalid number of releases to keep: %d (must be at least 1)", keep)
+	}
+	releases, err := ListReleases(exec, servicePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := GetCurrentRelease(exec, servicePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pruned := SelectPrunable(releases, current, keep)
+	for _, r := range pruned {
+		releaseDir := GetReleaseDir(servicePath, r.ID)
+		if dryRun {
+			slog.Info("DRY RUN: removing release", "dst", exec.Name(), "release", r.ID)
+			continue
+		}
+		if _, _, err := exec.ExecuteCommand("rm", "-rf", releaseDir); err != nil {
+			return nil, nil, fmt.Errorf("[%s] failed to remove release directory %s: %w", exec.Name(), releaseDir, err)
+		}
+		slog.Info("removed release", "dst", exec.Name(), "release", r.ID)
+	}
+	kept := slices.DeleteFunc(slices.Clone(releases), func(r *Release) bool { return slices.Contains(pruned, r) })
+	return pruned, kept, nil
+}
+
+// IDs of the images recorded with the given releases.
+func ImageIDs(releases []*Release) []string {
+	ids := []string{}
+	for _, r := range releases {
+		for _, i := range r.Images {
+			ids = append(ids, i.ImageID)
+		}
+	}
+	return ids
+}
+
+// Selects the release to roll back to. If id is provided, the release with that ID is
+// returned; otherwise the release immediately preceding the current one is returned.
+func FindRollbackTarget(releases []*Release, current string, id string) (*Release, error) {
+	if id != "" {
+		idx := slices.IndexFunc(releases, func(r *Release) bool { return r.ID == id })
+		if idx < 0 {
+			return nil, fmt.Errorf("no release found with ID %s", id)
+		}
+		return releases[idx], nil
+	}
+
+	currentIdx := slices.IndexFunc(releases, func(r *Release) bool { return r.ID == current })
+	if currentIdx < 0 {
+		currentIdx = len(releases) - 1
+	}
+	if currentIdx < 1 {
+		return nil, fmt.Errorf("no release found prior to current release")
+	}
+	return releases[currentIdx-1], nil
+}
+
+// Splits an image reference like "foo/bar:baz" into its repository ("foo/bar") and tag ("baz").
+// The tag is empty if the reference does not contain one.
+func SplitImageReference(ref string) (string, string) {
+	idx := strings.LastIndex(ref, ":")
+	if idx < 0 || strings.Contains(ref[idx+1:], "/") {
+		return ref, ""
+	}
+	return ref[:idx], ref[idx+1:]
+}
+
+func writeFile(exec deploy.Executor, path string, value any) error {
+	contents, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return fmt.Errorf("[%s] failed to serialize %s: %w", exec.Name(), path, err)
+	}
+	b64Contents := base64.StdEncoding.EncodeToString(contents)
+	if _, _, err := exec.ExecuteShell(fmt.Sprintf("echo '%s' | base64 -d > '%s'", b64Contents, path)); err != nil {
+		return fmt.Errorf("[%s] failed to write %s: %w", exec.Name(), path, err)
+	}
+	return nil
+}
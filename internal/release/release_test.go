@@ -0,0 +1,104 @@
+package release
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+func TestFindRollbackTarget(t *testing.T) {
+	releases := []*Release{{ID: "20260101T000000Z"}, {ID: "20260102T000000Z"}, {ID: "20260103T000000Z"}}
+	cases := []struct {
+		testName string
+		releases []*Release
+		current  string
+		id       string
+		expected string
+		isError  bool
+	}{
+		{"previous to latest", releases, "20260103T000000Z", "", "20260102T000000Z", false},
+		{"previous to rolled-back current", releases, "20260102T000000Z", "", "20260101T000000Z", false},
+		{"unknown current uses latest", releases, "", "", "20260102T000000Z", false},
+		{"oldest is current", releases, "20260101T000000Z", "", "", true},
+		{"single release", releases[:1], "20260101T000000Z", "", "", true},
+		{"explicit id", releases, "20260103T000000Z", "20260101T000000Z", "20260101T000000Z", false},
+		{"unknown explicit id", releases, "20260103T000000Z", "20250101T000000Z", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testName, func(s *testing.T) {
+			actual, err := FindRollbackTarget(c.releases, c.current, c.id)
+			if c.isError {
+				if err == nil {
+					s.Errorf("expected error, but got release %s", actual.ID)
+				}
+				return
+			}
+			if err != nil {
+				s.Fatalf("expected no error, but got '%v'", err)
+			}
+			if actual.ID != c.expected {
+				s.Errorf("expected release %s, got %s", c.expected, actual.ID)
+			}
+		})
+	}
+}
+
+func TestSelectPrunable(t *testing.T) {
+	releases := []*Release{{ID: "20260101T000000Z"}, {ID: "20260102T000000Z"}, {ID: "20260103T000000Z"}, {ID: "20260104T000000Z"}}
+	cases := []struct {
+		testName string
+		current  string
+		keep     int
+		expected []string
+	}{
+		{"keeps newest", "20260104T000000Z", 2, []string{"20260101T000000Z", "20260102T000000Z"}},
+		{"keeps all", "20260104T000000Z", 4, []string{}},
+		{"keeps more than exist", "20260104T000000Z", 10, []string{}},
+		{"keeps rolled-back current", "20260101T000000Z", 2, []string{"20260102T000000Z"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testName, func(s *testing.T) {
+			actual := utils.Map(SelectPrunable(releases, c.current, c.keep), func(r *Release) string { return r.ID })
+			if !slices.Equal(actual, c.expected) {
+				s.Errorf("expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestImageIDs(t *testing.T) {
+	releases := []*Release{
+		{ID: "a", Images: []*ReleaseImage{{ImageID: "sha256:1"}, {ImageID: "sha256:2"}}},
+		{ID: "b", Images: []*ReleaseImage{}},
+		{ID: "c", Images: []*ReleaseImage{{ImageID: "sha256:3"}}},
+	}
+	expected := []string{"sha256:1", "sha256:2", "sha256:3"}
+	if actual := ImageIDs(releases); !slices.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestSplitImageReference(t *testing.T) {
+	cases := []struct {
+		ref        string
+		repository string
+		tag        string
+	}{
+		{"quemot-dev/foo", "quemot-dev/foo", ""},
+		{"quemot-dev/foo:1.2", "quemot-dev/foo", "1.2"},
+		{"localhost:5000/foo", "localhost:5000/foo", ""},
+		{"localhost:5000/foo:bar", "localhost:5000/foo", "bar"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.ref, func(s *testing.T) {
+			repository, tag := SplitImageReference(c.ref)
+			if repository != c.repository || tag != c.tag {
+				s.Errorf("expected (%s, %s), got (%s, %s)", c.repository, c.tag, repository, tag)
+			}
+		})
+	}
+}
@@ -8,6 +8,8 @@ import (
 
 const (
 	ServiceConfigFileName string = "config.json"
+	SystemdUnitDirName    string = "systemctl"
+	DefaultDataDirName    string = "data"
 )
 
 type ServiceDefinition struct {
@@ -17,6 +19,30 @@ type ServiceDefinition struct {
 
 type ServiceConfig struct {
 	Commands map[string]string `json:"commands"`
+	// Names of the nginx site files deployed for the service, so that sites removed from
+	// the project can be removed from the server
+	NginxSites []string `json:"nginx_sites,omitempty"`
+	// Names of the systemd unit files deployed for the service, so that units removed from
+	// the project can be disabled & removed from the server
+	SystemdUnits []string `json:"systemd_units,omitempty"`
+	// Images deployed for the service & how many of each to keep, so that old images can be
+	// pruned without the project at hand
+	ImageNames        []string `json:"image_names,omitempty"`
+	ImageCompareLabel string   `json:"image_compare_label,omitempty"`
+	ImageRetention    int      `json:"image_retention,omitempty"`
+	// Color serving traffic in blue/green mode
+	ActiveColor string `json:"active_color,omitempty"`
+	// What `smt backup` archives for the service
+	Backup *BackupSpec `json:"backup,omitempty"`
+}
+
+type BackupSpec struct {
+	// Directories, relative to the service directory, holding the service's data
+	DataDirs []string `json:"data_dirs"`
+	// Named Docker volumes holding the service's data
+	Volumes []string `json:"volumes,omitempty"`
+	// Secrets volume to include, encrypted; not backed up if empty
+	SecretsVolume string `json:"secrets_volume,omitempty"`
 }
 
 func NewServiceDefinition(name string) *ServiceDefinition {
@@ -27,6 +53,19 @@ func NewServiceDefinition(name string) *ServiceDefinition {
 	}
 }
 
+// Gets what to back up for the service, defaulting to its data directory for services
+// deployed before backups were configured.
+func (c *ServiceConfig) GetBackupSpec() *BackupSpec {
+	if c.Backup == nil {
+		return &BackupSpec{DataDirs: []string{DefaultDataDirName}}
+	}
+	return c.Backup
+}
+
 func GetDefaultConfigPath(servicePath string) string {
 	return filepath.Join(servicePath, ServiceConfigFileName)
 }
+
+func GetSystemdUnitDir(servicePath string) string {
+	return filepath.Join(servicePath, SystemdUnitDirName)
+}
@@ -0,0 +1,299 @@
+package systemd
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	deploy "github.com/mrshanahan/deploy-assets/pkg/config"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/content"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/plan"
+	"github.com/mrshanahan/quemot-dev-service-management-tool/internal/utils"
+)
+
+var (
+	// Unit types that are enabled when deployed. Other files in the unit directory (e.g.
+	// drop-ins or env files) are deployed but not enabled.
+	EnabledUnitTypes []string = []string{".service", ".timer", ".socket", ".path"}
+	// Unit types that activate the service of the same name, which is then only linked
+	TriggerUnitTypes []string = []string{".timer", ".socket", ".path"}
+
+	unitStatusProperties []string = []string{"LoadState", "ActiveState", "SubState", "UnitFileState", "NextElapseUSecRealtime"}
+)
+
+// A file in the project's systemd unit directory, named by its file name on the server.
+type Unit struct {
+	Name     string
+	Contents string
+}
+
+// State of a unit as reported by `systemctl show`.
+type UnitStatus struct {
+	Name          string `json:"name"`
+	LoadState     string `json:"load_state"`
+	ActiveState   string `json:"active_state"`
+	SubState      string `json:"sub_state"`
+	UnitFileState string `json:"unit_file_state"`
+	// Next time a timer elapses; empty for other units
+	NextElapse string `json:"next_elapse,omitempty"`
+}
+
+func IsEnabledUnit(name string) bool {
+	return slices.Contains(EnabledUnitTypes, filepath.Ext(name))
+}
+
+// Whether the named unit is a service that is activated by a timer, socket or path unit in
+// names, in which case it is linked rather than enabled.
+func IsTriggeredUnit(name string, names []string) bool {
+	if filepath.Ext(name) != ".service" {
+		return false
+	}
+	base := strings.TrimSuffix(name, ".service")
+	return slices.ContainsFunc(TriggerUnitTypes, func(t string) bool { return slices.Contains(names, base+t) })
+}
+
+// Creates a provider that installs the given units into unitDir & enables each one by name,
+// starting it if it is not running. Updated units that are running are restarted. Units in
+// previousUnits that are no longer among them are stopped, disabled & deleted.
+func NewUnitsProvider(name string, units []*Unit, previousUnits []string, unitDir string) deploy.Provider {
+	return &unitsProvider{
+		name:          name,
+		units:         units,
+		previousUnits: previousUnits,
+		unitDir:       unitDir,
+	}
+}
+
+type unitsProvider struct {
+	name          string
+	units         []*Unit
+	previousUnits []string
+	unitDir       string
+}
+
+func (p *unitsProvider) Name() string { return p.name }
+
+func (p *unitsProvider) Yaml(indent int) string {
+	propIndent := strings.Repeat(" ", indent+4)
+	listLines := func(xs []string) string {
+		lines := []string{}
+		for _, x := range xs {
+			lines = append(lines, fmt.Sprintf("%s- %s", strings.Repeat(" ", indent+8), x))
+		}
+		return strings.Join(lines, "\n")
+	}
+	return fmt.Sprintf(
+		`%ssystemd_units:
+%sname: %s
+%sunits:
+%s
+%sprevious_units:
+%s
+%sunit_dir: %s`,
+		strings.Repeat(" ", indent),
+		propIndent, p.name,
+		propIndent,
+		listLines(unitNames(p.units)),
+		propIndent,
+		listLines(p.previousUnits),
+		propIndent, p.unitDir)
+}
+
+func (p *unitsProvider) Digest(src deploy.Executor, dst deploy.Executor) (*plan.Digest, error) {
+	values := []string{}
+	for _, u := range p.units {
+		values = append(values, u.Name, u.Contents)
+	}
+	dstDigest, err := plan.HashRemoteFiles(dst, p.unitDir)
+	if err != nil {
+		return nil, err
+	}
+	return &plan.Digest{Src: plan.HashValues(values...), Dst: dstDigest}, nil
+}
+
+func (p *unitsProvider) Sync(cfg deploy.SyncConfig) (deploy.SyncResult, error) {
+	dst := cfg.DstExecutor
+	names := unitNames(p.units)
+
+	result := deploy.SYNC_RESULT_NOCHANGE
+	created, updated := []*Unit{}, []*Unit{}
+	for _, u := range p.units {
+		unitResult, err := content.CompareRemote(dst, filepath.Join(p.unitDir, u.Name), u.Contents)
+		if err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+		if unitResult == deploy.SYNC_RESULT_NOCHANGE && IsEnabledUnit(u.Name) && !IsTriggeredUnit(u.Name, names) {
+			// Re-enable units that were disabled outside of smt
+			enabled, err := isEnabled(dst, u.Name)
+			if err != nil {
+				return deploy.SYNC_RESULT_NOCHANGE, err
+			}
+			if !enabled {
+				unitResult = deploy.SYNC_RESULT_UPDATED
+			}
+		}
+		switch unitResult {
+		case deploy.SYNC_RESULT_CREATED:
+			created = append(created, u)
+		case deploy.SYNC_RESULT_UPDATED:
+			updated = append(updated, u)
+		default:
+			continue
+		}
+		if result == deploy.SYNC_RESULT_NOCHANGE {
+			result = unitResult
+		}
+	}
+
+	removed := utils.Filter(p.previousUnits, func(n string) bool { return !slices.Contains(names, n) })
+	if len(removed) > 0 && result == deploy.SYNC_RESULT_NOCHANGE {
+		result = deploy.SYNC_RESULT_UPDATED
+	}
+
+	if result == deploy.SYNC_RESULT_NOCHANGE {
+		slog.Debug("systemd units unchanged", "name", p.Name(), "dst", dst.Name())
+		return result, nil
+	}
+
+	if cfg.DryRun {
+		for _, u := range created {
+			slog.Info("DRY RUN: installing systemd unit", "name", p.Name(), "dst", dst.Name(), "unit", u.Name)
+		}
+		for _, u := range updated {
+			slog.Info("DRY RUN: updating systemd unit", "name", p.Name(), "dst", dst.Name(), "unit", u.Name)
+		}
+		for _, r := range removed {
+			slog.Info("DRY RUN: removing systemd unit", "name", p.Name(), "dst", dst.Name(), "unit", r)
+		}
+		return result, nil
+	}
+
+	for _, r := range removed {
+		if err := RemoveUnit(dst, p.unitDir, r); err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+	}
+
+	if _, _, err := dst.ExecuteCommand("mkdir", "-p", p.unitDir); err != nil {
+		return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("[%s] failed to create unit directory %s: %w", dst.Name(), p.unitDir, err)
+	}
+	changed := append(slices.Clone(created), updated...)
+	for _, u := range changed {
+		if err := content.WriteRemote(dst, filepath.Join(p.unitDir, u.Name), u.Contents); err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, err
+		}
+	}
+	if _, _, err := dst.ExecuteCommand("systemctl", "daemon-reload"); err != nil {
+		return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("[%s] failed to reload systemd units: %w", dst.Name(), err)
+	}
+
+	// Link triggered services before enabling the units that activate them
+	slices.SortStableFunc(changed, func(x, y *Unit) int {
+		return boolToInt(!IsTriggeredUnit(x.Name, names)) - boolToInt(!IsTriggeredUnit(y.Name, names))
+	})
+	for _, u := range changed {
+		if !IsEnabledUnit(u.Name) {
+			continue
+		}
+		unitPath := utils.ShellQuote(filepath.Join(p.unitDir, u.Name))
+		var cmd string
+		if IsTriggeredUnit(u.Name, names) {
+			cmd = fmt.Sprintf("systemctl link %s", unitPath)
+		} else {
+			cmd = fmt.Sprintf("systemctl enable --now %s", unitPath)
+		}
+		if slices.Contains(updated, u) {
+			cmd = fmt.Sprintf("%s && systemctl try-restart %s", cmd, utils.ShellQuote(u.Name))
+		}
+		if _, stderr, err := dst.ExecuteShell(cmd); err != nil {
+			return deploy.SYNC_RESULT_NOCHANGE, fmt.Errorf("[%s] failed to enable systemd unit %s (stderr: %s): %w", dst.Name(), u.Name, strings.TrimSpace(stderr), err)
+		}
+		slog.Info("enabled systemd unit", "name", p.Name(), "dst", dst.Name(), "unit", u.Name)
+	}
+
+	return result, nil
+}
+
+// Stops, disables & deletes the named unit from unitDir.
+func RemoveUnit(exec deploy.Executor, unitDir string, name string) error {
+	unitPath := filepath.Join(unitDir, name)
+	cmd := fmt.Sprintf("rm -f %s", utils.ShellQuote(unitPath))
+	if IsEnabledUnit(name) {
+		cmd = fmt.Sprintf("(systemctl disable --now %s || true) && %s", utils.ShellQuote(name), cmd)
+	}
+	if _, stderr, err := exec.ExecuteShell(cmd); err != nil {
+		return fmt.Errorf("[%s] failed to remove systemd unit %s (stderr: %s): %w", exec.Name(), name, strings.TrimSpace(stderr), err)
+	}
+	slog.Info("removed systemd unit", "dst", exec.Name(), "unit", name)
+	return nil
+}
+
+// Lists the names of the unit files installed in unitDir, for services deployed before the
+// units were tracked in the service config.
+func ListUnits(exec deploy.Executor, unitDir string) ([]string, error) {
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("test -d %s && for f in %s/*; do test -f \"$f\" && basename \"$f\"; done; true", utils.ShellQuote(unitDir), utils.ShellQuote(unitDir)))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] failed to list systemd units in %s: %w", exec.Name(), unitDir, err)
+	}
+	return strings.Fields(stdout), nil
+}
+
+// Reports the state of each of the named units.
+func GetUnitStatuses(exec deploy.Executor, names []string) ([]*UnitStatus, error) {
+	statuses := []*UnitStatus{}
+	for _, n := range names {
+		if !IsEnabledUnit(n) {
+			continue
+		}
+		stdout, stderr, err := exec.ExecuteCommand("systemctl", "show", n, "--property", strings.Join(unitStatusProperties, ","))
+		if err != nil {
+			return nil, fmt.Errorf("[%s] failed to get state of unit %s (stderr: %s): %w", exec.Name(), n, strings.TrimSpace(stderr), err)
+		}
+		statuses = append(statuses, parseUnitStatus(n, stdout))
+	}
+	return statuses, nil
+}
+
+func parseUnitStatus(name string, output string) *UnitStatus {
+	status := &UnitStatus{Name: name}
+	for _, l := range strings.Split(output, "\n") {
+		k, v, found := strings.Cut(strings.TrimSpace(l), "=")
+		if !found {
+			continue
+		}
+		switch k {
+		case "LoadState":
+			status.LoadState = v
+		case "ActiveState":
+			status.ActiveState = v
+		case "SubState":
+			status.SubState = v
+		case "UnitFileState":
+			status.UnitFileState = v
+		case "NextElapseUSecRealtime":
+			status.NextElapse = v
+		}
+	}
+	return status
+}
+
+func isEnabled(exec deploy.Executor, name string) (bool, error) {
+	stdout, _, err := exec.ExecuteShell(fmt.Sprintf("systemctl is-enabled %s 2>/dev/null; true", utils.ShellQuote(name)))
+	if err != nil {
+		return false, fmt.Errorf("[%s] failed to check if unit %s is enabled: %w", exec.Name(), name, err)
+	}
+	return strings.TrimSpace(stdout) == "enabled", nil
+}
+
+func unitNames(units []*Unit) []string {
+	return utils.Map(units, func(u *Unit) string { return u.Name })
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
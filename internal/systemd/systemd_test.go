@@ -0,0 +1,37 @@
+package systemd
+
+import "testing"
+
+func TestIsTriggeredUnit(t *testing.T) {
+	names := []string{"app.service", "backup.service", "backup.timer", "app.env"}
+	cases := []struct {
+		name     string
+		expected bool
+	}{
+		{"app.service", false},
+		{"backup.service", true},
+		{"backup.timer", false},
+		{"app.env", false},
+	}
+	for _, c := range cases {
+		if actual := IsTriggeredUnit(c.name, names); actual != c.expected {
+			t.Errorf("IsTriggeredUnit(%q) = %v, expected %v", c.name, actual, c.expected)
+		}
+	}
+}
+
+func TestParseUnitStatus(t *testing.T) {
+	output := "LoadState=loaded\nActiveState=active\nSubState=waiting\nUnitFileState=enabled\nNextElapseUSecRealtime=Fri 2026-10-16 03:00:00 UTC\n"
+	status := parseUnitStatus("backup.timer", output)
+	expected := UnitStatus{
+		Name:          "backup.timer",
+		LoadState:     "loaded",
+		ActiveState:   "active",
+		SubState:      "waiting",
+		UnitFileState: "enabled",
+		NextElapse:    "Fri 2026-10-16 03:00:00 UTC",
+	}
+	if *status != expected {
+		t.Errorf("parseUnitStatus() = %+v, expected %+v", *status, expected)
+	}
+}
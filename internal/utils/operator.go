@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"os"
+	"os/user"
+)
+
+// Returns the name of the local user & machine running smt, for recording on the server.
+func GetOperator() (string, string) {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return username, host
+}
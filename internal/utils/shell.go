@@ -0,0 +1,8 @@
+package utils
+
+import "strings"
+
+// Quotes s for use as a single word in a POSIX shell command.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
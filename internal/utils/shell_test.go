@@ -0,0 +1,17 @@
+package utils
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"":                      "''",
+		"/etc/nginx/foo.conf":   "'/etc/nginx/foo.conf'",
+		"it's here":             `'it'\''s here'`,
+		"$(rm -rf /) `x` \"y\"": "'$(rm -rf /) `x` \"y\"'",
+	}
+	for input, expected := range cases {
+		if actual := ShellQuote(input); actual != expected {
+			t.Errorf("expected %s, got %s", expected, actual)
+		}
+	}
+}
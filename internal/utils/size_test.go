@@ -0,0 +1,20 @@
+package utils
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	cases := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GiB"},
+	}
+	for _, c := range cases {
+		if actual := FormatBytes(c.n); actual != c.expected {
+			t.Errorf("FormatBytes(%d) = %q, expected %q", c.n, actual, c.expected)
+		}
+	}
+}